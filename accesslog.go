@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader is the header carrying the id of a request, it is taken from the client when set,
+// sent on to the connections and returned in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the ids accepted from the clients, longer ids are replaced.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the id of the request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the id of the request, the requests of the router itself have none.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newAccessLogger returns the logger of the access log, which is independent of the level of the logs of the router.
+func newAccessLogger(out io.Writer) *log.Logger {
+	return &log.Logger{
+		Out:       out,
+		Formatter: &log.JSONFormatter{},
+		Hooks:     make(log.LevelHooks),
+		Level:     log.InfoLevel,
+		ExitFunc:  os.Exit,
+	}
+}
+
+// SetAccessLogOutput sets where the access log is written, nil disables it.
+func (s *Service) SetAccessLogOutput(out io.Writer) {
+	if out == nil {
+		s.accessLog.Store(nil)
+		return
+	}
+	s.accessLog.Store(newAccessLogger(out))
+}
+
+// AccessLogMiddleware identifies each request and writes one JSON line per request,
+// with the models, connection and tokens the router reports once the request is served.
+func (s *Service) AccessLogMiddleware(c *gin.Context) {
+	start := time.Now()
+	id := c.GetHeader(RequestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		id = uuid.NewString()
+	}
+	c.Header(RequestIDHeader, id)
+	c.Request = c.Request.WithContext(WithRequestID(c.Request.Context(), id))
+	c.Next()
+
+	l := s.accessLog.Load()
+	if l == nil {
+		return
+	}
+	ctx := c.Request.Context()
+	fields := log.Fields{
+		"request_id":  id,
+		"client":      c.ClientIP(),
+		"method":      c.Request.Method,
+		"route":       c.FullPath(),
+		"path":        c.Request.URL.Path,
+		"status":      c.Writer.Status(),
+		"duration_ms": msSince(start, time.Now()),
+	}
+	if k := apiKeyFromContext(ctx); k != nil {
+		fields["api_key"] = k.name
+	}
+	if p := principalFromContext(ctx); p != "" {
+		fields["principal"] = p
+	}
+	if ri := requestInfoFromContext(ctx); ri != nil {
+		info := ri.snapshot()
+		fields["stream"] = info.stream
+		if info.canceled {
+			fields["canceled"] = true
+		}
+		if info.requestedModel != "" {
+			fields["requested_model"] = info.requestedModel
+		}
+		if info.alias != "" {
+			fields["alias"] = info.alias
+		}
+		if info.model != "" {
+			fields["model"] = info.model
+			fields["connection_id"] = info.connection
+			fields["prompt_tokens"] = info.promptTokens
+			fields["eval_tokens"] = info.evalTokens
+		}
+		if !info.firstResponse.IsZero() {
+			fields["ttft_ms"] = msSince(start, info.firstResponse)
+		}
+	}
+	l.WithFields(fields).Info("request")
+}
+
+func msSince(start, t time.Time) float64 {
+	return float64(t.Sub(start).Microseconds()) / 1000
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// APIKeyConfig is an API key accepted by the router and the models it may use.
+type APIKeyConfig struct {
+	// Name identifies the key in the logs and errors, the key itself is never logged.
+	Name string `json:"name" yaml:"name" toml:"name"`
+	Key  string `json:"key" yaml:"key" toml:"key"`
+	// Certificate authenticates the clients presenting a certificate with this identity as the key, with mutual TLS.
+	// The identity is the common name of the certificate, or its first subject alternative name.
+	Certificate string `json:"certificate,omitempty" yaml:"certificate,omitempty" toml:"certificate,omitempty"`
+	// Models are the models, aliases and presets the key may use, * matches any sequence of characters.
+	Models []ModelID `json:"models" yaml:"models" toml:"models"`
+	// Admin gives access to the state of the router, ie: the limits of the clients.
+	Admin bool `json:"admin,omitempty" yaml:"admin,omitempty" toml:"admin,omitempty"`
+}
+
+func (kc APIKeyConfig) validate() error {
+	if kc.Name == "" {
+		return errors.New("empty api key name")
+	}
+	if kc.Key == "" && kc.Certificate == "" {
+		return fmt.Errorf("empty key for api key %s", kc.Name)
+	}
+	if len(kc.Models) == 0 {
+		return fmt.Errorf("api key %s allows no models", kc.Name)
+	}
+	return nil
+}
+
+// apiKeysFile is the content of a file holding API keys, ie: mounted from a secret.
+type apiKeysFile struct {
+	APIKeys []APIKeyConfig `json:"api_keys" yaml:"api_keys" toml:"api_keys"`
+}
+
+func loadAPIKeysFile(path string) ([]APIKeyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read api keys file: %w", err)
+	}
+	var f apiKeysFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&f)
+	case ".toml":
+		dec := toml.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	default:
+		return nil, fmt.Errorf("unsupported api keys file format: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f.APIKeys, nil
+}
+
+// apiKey is an API key accepted by the router.
+type apiKey struct {
+	name   string
+	models []ModelID
+	admin  bool
+}
+
+func (k *apiKey) allows(name string) bool {
+	return slices.ContainsFunc(k.models, func(m ModelID) bool {
+		return matchWildcard(m.String(), name) || modelKey(m.String()) == modelKey(name)
+	})
+}
+
+type apiKeyCtxKey struct{}
+
+func apiKeyFromContext(ctx context.Context) *apiKey {
+	k, _ := ctx.Value(apiKeyCtxKey{}).(*apiKey)
+	return k
+}
+
+func (r *Router) setAPIKeys(keys []APIKeyConfig) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	r.apiKeys = map[[sha256.Size]byte]*apiKey{}
+	r.certKeys = map[string]*apiKey{}
+	names := map[string]bool{}
+	for _, kc := range keys {
+		if err := kc.validate(); err != nil {
+			return fmt.Errorf("invalid api key: %w", err)
+		}
+		// keys are looked up by their hash so that the lookup does not leak the keys
+		h := sha256.Sum256([]byte(kc.Key))
+		if _, ok := r.apiKeys[h]; (ok && kc.Key != "") || r.certKeys[kc.Certificate] != nil || names[kc.Name] {
+			return fmt.Errorf("duplicate api key %s", kc.Name)
+		}
+		names[kc.Name] = true
+		k := &apiKey{name: kc.Name, models: slices.Clone(kc.Models), admin: kc.Admin}
+		if kc.Key != "" {
+			r.apiKeys[h] = k
+		}
+		if kc.Certificate != "" {
+			r.certKeys[kc.Certificate] = k
+		}
+	}
+	return nil
+}
+
+// Authenticate checks the API key sent by a client and returns a context carrying it,
+// the requests are not authenticated when the router has no API keys.
+// Without a token, the client certificate of the context authenticates the request as the key set for it.
+func (r *Router) Authenticate(ctx context.Context, token string) (context.Context, error) {
+	if r.apiKeys == nil {
+		return ctx, nil
+	}
+	var k *apiKey
+	if token != "" {
+		k = r.apiKeys[sha256.Sum256([]byte(token))]
+	} else if p := principalFromContext(ctx); p != "" {
+		k = r.certKeys[p]
+	}
+	if k == nil {
+		return ctx, NewHttpError(http.StatusUnauthorized, "gollamas: missing or invalid api key")
+	}
+	log.WithField("api_key", k.name).Trace("Routing: authenticated request.")
+	return context.WithValue(ctx, apiKeyCtxKey{}, k), nil
+}
+
+// authorize checks that the API key of the request may use the model, under its requested name or the model it resolves to.
+func (r *Router) authorize(ctx context.Context, name string) error {
+	k := apiKeyFromContext(ctx)
+	if k == nil || r.allows(k, name) {
+		return nil
+	}
+	log.WithField("api_key", k.name).WithField("requested_model", name).Info("Access to model denied.")
+	return NewHttpErrorf(http.StatusForbidden, "gollamas: api key %s is not allowed to use model %s", k.name, name)
+}
+
+// AuthorizeAdmin checks that the API key of the request, if any, is an admin key.
+func (r *Router) AuthorizeAdmin(ctx context.Context) error {
+	if k := apiKeyFromContext(ctx); k != nil && !k.admin {
+		return NewHttpErrorf(http.StatusForbidden, "gollamas: api key %s is not an admin key", k.name)
+	}
+	return nil
+}
+
+func (r *Router) allows(k *apiKey, name string) bool {
+	if k.allows(name) {
+		return true
+	}
+	m := ModelID(name)
+	if p := r.presets[m]; p != nil {
+		m = p.model
+		if k.allows(m.String()) {
+			return true
+		}
+	}
+	if id, ok := r.all2ModelID[m]; ok {
+		m = id
+	} else if id, ok := r.all2ModelID[ModelID(modelKey(m.String()))]; ok {
+		m = id
+	} else if id, ok := r.alias2model[m]; ok {
+		m = id
+	}
+	return k.allows(m.String())
+}
+
+// allowedModels keeps the models the API key of the request may use.
+func allowedModels[T any](ctx context.Context, r *Router, models []T, name func(T) string) []T {
+	k := apiKeyFromContext(ctx)
+	if k == nil {
+		return models
+	}
+	return slices.DeleteFunc(models, func(m T) bool {
+		return !r.allows(k, name(m))
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAPIKeysFile(t *testing.T) {
+	expected := []APIKeyConfig{
+		{Name: "ci", Key: "secret1", Models: []ModelID{"llama3.2", "qwen*"}},
+	}
+	for name, content := range map[string]string{
+		"keys.yaml": `
+api_keys:
+  - name: ci
+    key: secret1
+    models: [llama3.2, "qwen*"]
+`,
+		"keys.toml": `
+[[api_keys]]
+name = "ci"
+key = "secret1"
+models = ["llama3.2", "qwen*"]
+`,
+		"keys.json": `{"api_keys": [{"name": "ci", "key": "secret1", "models": ["llama3.2", "qwen*"]}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			keys, err := loadAPIKeysFile(writeTestConfigFile(t, name, content))
+			assert.NoError(t, err)
+			assert.Equal(t, expected, keys)
+		})
+	}
+
+	_, err := loadAPIKeysFile(writeTestConfigFile(t, "keys.yaml", "api_keys:\n  - name: ci\n    token: secret1\n"))
+	assert.ErrorContains(t, err, "field token not found")
+	_, err = loadAPIKeysFile(writeTestConfigFile(t, "keys.txt", ""))
+	assert.ErrorContains(t, err, "unsupported api keys file format")
+}
+
+func TestAPIKeyAllows(t *testing.T) {
+	k := &apiKey{name: "ci", models: []ModelID{"llama3.2", "qwen*"}}
+	assert.True(t, k.allows("llama3.2"))
+	assert.True(t, k.allows("llama3.2:latest"))
+	assert.True(t, k.allows("qwen2.5-coder:14b"))
+	assert.False(t, k.allows("llama3.2:1b"))
+	assert.False(t, k.allows("deepseek-r1:14b"))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Backend is a connection able to serve a model, as seen by a [Balancer].
+type Backend interface {
+	ConnectionID() ConnectionID
+	// Weight is the relative share of requests the backend should receive, always at least 1.
+	Weight() int
+	// InFlight is the number of requests currently processed by the backend.
+	InFlight() int64
+}
+
+// Balancer picks the backend which serves a request among the backends of a model.
+// Implementations must be safe for concurrent use, each model gets its own instance.
+type Balancer interface {
+	// Pick returns the index of the selected backend, backends is never empty.
+	Pick(backends []Backend) int
+}
+
+type BalancerFactory func() Balancer
+
+const (
+	RoundRobinBalancer       = "round-robin"
+	WeightedBalancer         = "weighted"
+	RandomBalancer           = "random"
+	LeastOutstandingBalancer = "least-outstanding"
+)
+
+var balancers = map[string]BalancerFactory{
+	RoundRobinBalancer:       func() Balancer { return &roundRobinBalancer{} },
+	WeightedBalancer:         func() Balancer { return &weightedBalancer{current: map[ConnectionID]int{}} },
+	RandomBalancer:           func() Balancer { return randomBalancer{} },
+	LeastOutstandingBalancer: func() Balancer { return &leastOutstandingBalancer{} },
+}
+
+// NewBalancer instantiates the balancing strategy with the given name.
+func NewBalancer(name string) (Balancer, error) {
+	f, ok := balancers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown balancer %s, expected one of %s", name, strings.Join(BalancerNames(), ", "))
+	}
+	return f(), nil
+}
+
+// BalancerNames lists the available balancing strategies.
+func BalancerNames() []string {
+	names := make([]string, 0, len(balancers))
+	for k := range balancers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	return names
+}
+
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+func (b *roundRobinBalancer) Pick(backends []Backend) int {
+	return int((b.next.Add(1) - 1) % uint64(len(backends)))
+}
+
+// weightedBalancer is a smooth weighted round robin, as implemented in nginx.
+type weightedBalancer struct {
+	mu      sync.Mutex
+	current map[ConnectionID]int
+}
+
+func (b *weightedBalancer) Pick(backends []Backend) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total := 0
+	best := 0
+	for i, be := range backends {
+		w := be.Weight()
+		total += w
+		b.current[be.ConnectionID()] += w
+		if b.current[be.ConnectionID()] > b.current[backends[best].ConnectionID()] {
+			best = i
+		}
+	}
+	b.current[backends[best].ConnectionID()] -= total
+	return best
+}
+
+type randomBalancer struct{}
+
+func (randomBalancer) Pick(backends []Backend) int {
+	return rand.IntN(len(backends))
+}
+
+// leastOutstandingBalancer picks the backend with the fewest requests in flight,
+// ties are spread in a round robin fashion.
+type leastOutstandingBalancer struct {
+	next atomic.Uint64
+}
+
+func (b *leastOutstandingBalancer) Pick(backends []Backend) int {
+	start := int((b.next.Add(1) - 1) % uint64(len(backends)))
+	best := start
+	for i := range backends {
+		j := (start + i) % len(backends)
+		if backends[j].InFlight() < backends[best].InFlight() {
+			best = j
+		}
+	}
+	return best
+}
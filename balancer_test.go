@@ -0,0 +1,67 @@
+package main_test
+
+import (
+	"testing"
+
+	gollamas "github.com/slawo/gollamas"
+	"github.com/stretchr/testify/assert"
+)
+
+type testBackend struct {
+	id       gollamas.ConnectionID
+	weight   int
+	inflight int64
+}
+
+func (b *testBackend) ConnectionID() gollamas.ConnectionID { return b.id }
+func (b *testBackend) Weight() int                         { return b.weight }
+func (b *testBackend) InFlight() int64                     { return b.inflight }
+
+func pickN(b gollamas.Balancer, backends []gollamas.Backend, n int) []gollamas.ConnectionID {
+	var res []gollamas.ConnectionID
+	for range n {
+		res = append(res, backends[b.Pick(backends)].ConnectionID())
+	}
+	return res
+}
+
+func TestNewBalancerFailsOnUnknownName(t *testing.T) {
+	b, err := gollamas.NewBalancer("unknown")
+	assert.EqualError(t, err, "unknown balancer unknown, expected one of least-outstanding, random, round-robin, weighted")
+	assert.Nil(t, b)
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	b, err := gollamas.NewBalancer(gollamas.RoundRobinBalancer)
+	assert.NoError(t, err)
+	backends := []gollamas.Backend{&testBackend{id: "c1"}, &testBackend{id: "c2"}, &testBackend{id: "c3"}}
+	assert.Equal(t, []gollamas.ConnectionID{"c1", "c2", "c3", "c1", "c2"}, pickN(b, backends, 5))
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	b, err := gollamas.NewBalancer(gollamas.WeightedBalancer)
+	assert.NoError(t, err)
+	backends := []gollamas.Backend{&testBackend{id: "c1", weight: 5}, &testBackend{id: "c2", weight: 1}, &testBackend{id: "c3", weight: 1}}
+	assert.Equal(t, []gollamas.ConnectionID{"c1", "c1", "c2", "c1", "c3", "c1", "c1"}, pickN(b, backends, 7))
+}
+
+func TestRandomBalancer(t *testing.T) {
+	b, err := gollamas.NewBalancer(gollamas.RandomBalancer)
+	assert.NoError(t, err)
+	backends := []gollamas.Backend{&testBackend{id: "c1"}, &testBackend{id: "c2"}}
+	for _, id := range pickN(b, backends, 20) {
+		assert.Contains(t, []gollamas.ConnectionID{"c1", "c2"}, id)
+	}
+}
+
+func TestLeastOutstandingBalancer(t *testing.T) {
+	b, err := gollamas.NewBalancer(gollamas.LeastOutstandingBalancer)
+	assert.NoError(t, err)
+	backends := []gollamas.Backend{&testBackend{id: "c1", inflight: 3}, &testBackend{id: "c2", inflight: 1}, &testBackend{id: "c3", inflight: 2}}
+	assert.Equal(t, []gollamas.ConnectionID{"c2", "c2", "c2"}, pickN(b, backends, 3))
+
+	// ties are spread across backends
+	b, _ = gollamas.NewBalancer(gollamas.LeastOutstandingBalancer)
+	backends = []gollamas.Backend{&testBackend{id: "c1"}, &testBackend{id: "c2"}}
+	assert.Equal(t, []gollamas.ConnectionID{"c1", "c2", "c1"}, pickN(b, backends, 3))
+}
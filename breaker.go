@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBreakerMinRequests      = 5
+	defaultBreakerWindow           = time.Minute
+	defaultBreakerOpenDuration     = 30 * time.Second
+	defaultBreakerHalfOpenRequests = 1
+	breakerBuckets                 = 10
+)
+
+// CircuitBreakerConfig configures the circuit breaker of each connection.
+// The circuit breakers are disabled when FailureRatio is zero.
+type CircuitBreakerConfig struct {
+	// FailureRatio is the ratio of failed or slow requests over the window which opens the circuit.
+	FailureRatio float64 `json:"failure_ratio,omitempty" yaml:"failure_ratio,omitempty" toml:"failure_ratio,omitempty"`
+	// MinRequests is the number of requests in the window below which the circuit stays closed, defaults to 5.
+	MinRequests int `json:"min_requests,omitempty" yaml:"min_requests,omitempty" toml:"min_requests,omitempty"`
+	// Window is the period over which the failure ratio is computed, defaults to 1m.
+	Window Duration `json:"window,omitempty" yaml:"window,omitempty" toml:"window,omitempty"`
+	// SlowCallDuration counts the requests waiting longer than this for their first response as failures, disabled when empty.
+	SlowCallDuration Duration `json:"slow_call_duration,omitempty" yaml:"slow_call_duration,omitempty" toml:"slow_call_duration,omitempty"`
+	// OpenDuration is how long requests fail fast before probe requests are let through, defaults to 30s.
+	OpenDuration Duration `json:"open_duration,omitempty" yaml:"open_duration,omitempty" toml:"open_duration,omitempty"`
+	// HalfOpenRequests is the number of successful probe requests which close the circuit, defaults to 1.
+	HalfOpenRequests int `json:"half_open_requests,omitempty" yaml:"half_open_requests,omitempty" toml:"half_open_requests,omitempty"`
+}
+
+func (bc CircuitBreakerConfig) validate() error {
+	if bc.FailureRatio < 0 || bc.FailureRatio > 1 {
+		return fmt.Errorf("invalid circuit breaker failure ratio: %v, expected a value between 0 and 1", bc.FailureRatio)
+	}
+	if bc.MinRequests < 0 {
+		return fmt.Errorf("invalid circuit breaker min requests: %d", bc.MinRequests)
+	}
+	if bc.Window < 0 {
+		return fmt.Errorf("invalid circuit breaker window: %s", bc.Window)
+	}
+	if bc.SlowCallDuration < 0 {
+		return fmt.Errorf("invalid circuit breaker slow call duration: %s", bc.SlowCallDuration)
+	}
+	if bc.OpenDuration < 0 {
+		return fmt.Errorf("invalid circuit breaker open duration: %s", bc.OpenDuration)
+	}
+	if bc.HalfOpenRequests < 0 {
+		return fmt.Errorf("invalid circuit breaker half open requests: %d", bc.HalfOpenRequests)
+	}
+	return nil
+}
+
+func (bc CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	if bc.MinRequests == 0 {
+		bc.MinRequests = defaultBreakerMinRequests
+	}
+	if bc.Window == 0 {
+		bc.Window = Duration(defaultBreakerWindow)
+	}
+	if bc.OpenDuration == 0 {
+		bc.OpenDuration = Duration(defaultBreakerOpenDuration)
+	}
+	if bc.HalfOpenRequests == 0 {
+		bc.HalfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+	return bc
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breakerOutcome is how a request let through by the circuit breaker ended.
+type breakerOutcome int
+
+const (
+	breakerSuccess breakerOutcome = iota
+	breakerFailure
+	// breakerIgnored is the outcome of the requests ended by their caller before the connection answered,
+	// they tell nothing about the connection.
+	breakerIgnored
+)
+
+type breakerBucket struct {
+	start    time.Time
+	total    int
+	failures int
+}
+
+// circuitBreaker stops sending requests to a connection failing too often,
+// after a while probe requests are let through to find out whether the connection recovered.
+type circuitBreaker struct {
+	cfg CircuitBreakerConfig
+	id  ConnectionID
+	now func() time.Time
+
+	mu         sync.Mutex
+	state      breakerState
+	generation int
+	openedAt   time.Time
+	buckets    [breakerBuckets]breakerBucket
+	probes     int
+	successes  int
+}
+
+func newCircuitBreaker(id ConnectionID, cfg CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{
+		cfg: cfg.withDefaults(),
+		id:  id,
+		now: time.Now,
+	}
+}
+
+// State returns the current state of the circuit, an open circuit reports half-open once probes are allowed.
+func (cb *circuitBreaker) State() breakerState {
+	if cb == nil {
+		return breakerClosed
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh()
+	return cb.state
+}
+
+// ready reports whether a request would currently be let through.
+func (cb *circuitBreaker) ready() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh()
+	return cb.state == breakerClosed || (cb.state == breakerHalfOpen && cb.probes < cb.cfg.HalfOpenRequests)
+}
+
+// allow returns the function recording the outcome of the request, or an error when the circuit is open.
+func (cb *circuitBreaker) allow() (func(outcome breakerOutcome), error) {
+	if cb == nil {
+		return func(breakerOutcome) {}, nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh()
+	switch cb.state {
+	case breakerOpen:
+		return nil, cb.openError()
+	case breakerHalfOpen:
+		if cb.probes >= cb.cfg.HalfOpenRequests {
+			return nil, cb.openError()
+		}
+		cb.probes++
+	}
+	gen := cb.generation
+	return func(outcome breakerOutcome) {
+		cb.record(gen, outcome)
+	}, nil
+}
+
+// breakerOpenError is returned when the circuit breaker of a connection does not let a request through,
+// it is answered with 503 and the request can be sent to another connection.
+type breakerOpenError struct {
+	*HttpError
+}
+
+func (e *breakerOpenError) Unwrap() error {
+	return e.HttpError
+}
+
+func (cb *circuitBreaker) openError() error {
+	return &breakerOpenError{NewHttpErrorf(http.StatusServiceUnavailable, "gollamas: connection %s is unavailable, circuit breaker is %s", cb.id, cb.state)}
+}
+
+// refresh moves an open circuit to half-open once the open duration has elapsed.
+func (cb *circuitBreaker) refresh() {
+	if cb.state == breakerOpen && cb.now().Sub(cb.openedAt) >= time.Duration(cb.cfg.OpenDuration) {
+		cb.transition(breakerHalfOpen)
+	}
+}
+
+func (cb *circuitBreaker) record(gen int, outcome breakerOutcome) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if gen != cb.generation {
+		// the request started before the last transition, its outcome is outdated
+		return
+	}
+	switch cb.state {
+	case breakerHalfOpen:
+		// an ignored probe only frees its slot for the next probe
+		cb.probes--
+		if outcome == breakerIgnored {
+			return
+		}
+		if outcome == breakerFailure {
+			cb.transition(breakerOpen)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.cfg.HalfOpenRequests {
+			cb.transition(breakerClosed)
+		}
+	case breakerClosed:
+		if outcome == breakerIgnored {
+			return
+		}
+		now := cb.now()
+		width := time.Duration(cb.cfg.Window) / breakerBuckets
+		start := now.Truncate(width)
+		b := &cb.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+		if !b.start.Equal(start) {
+			*b = breakerBucket{start: start}
+		}
+		b.total++
+		if outcome == breakerFailure {
+			b.failures++
+		}
+		total, failures := 0, 0
+		for _, b := range cb.buckets {
+			if now.Sub(b.start) < time.Duration(cb.cfg.Window) {
+				total += b.total
+				failures += b.failures
+			}
+		}
+		if total >= cb.cfg.MinRequests && float64(failures)/float64(total) >= cb.cfg.FailureRatio {
+			cb.transition(breakerOpen)
+		}
+	}
+}
+
+func (cb *circuitBreaker) transition(state breakerState) {
+	logger := log.WithField("connection_id", cb.id).WithField("from", cb.state.String()).WithField("to", state.String())
+	switch state {
+	case breakerOpen:
+		logger.Warn("Circuit breaker opened.")
+		cb.openedAt = cb.now()
+	case breakerHalfOpen:
+		logger.Info("Circuit breaker half-open, probing connection.")
+	case breakerClosed:
+		logger.Info("Circuit breaker closed.")
+		cb.buckets = [breakerBuckets]breakerBucket{}
+	}
+	cb.state = state
+	cb.generation++
+	cb.probes = 0
+	cb.successes = 0
+}
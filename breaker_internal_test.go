@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/slawo/gollamas/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestCircuitBreaker(cfg CircuitBreakerConfig) (*circuitBreaker, *testClock) {
+	clock := &testClock{t: time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC)}
+	cb := newCircuitBreaker("c1", cfg)
+	cb.now = clock.now
+	return cb, clock
+}
+
+func requireAllow(t *testing.T, cb *circuitBreaker, failed bool) {
+	record, err := cb.allow()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if failed {
+		record(breakerFailure)
+	} else {
+		record(breakerSuccess)
+	}
+}
+
+func TestCircuitBreakerOpensOnFailureRatio(t *testing.T) {
+	cb, clock := newTestCircuitBreaker(CircuitBreakerConfig{FailureRatio: 0.5, MinRequests: 4})
+	requireAllow(t, cb, true)
+	requireAllow(t, cb, true)
+	requireAllow(t, cb, true)
+	// below the minimum number of requests
+	assert.Equal(t, breakerClosed, cb.State())
+	requireAllow(t, cb, false)
+	assert.Equal(t, breakerOpen, cb.State())
+	assert.False(t, cb.ready())
+
+	_, err := cb.allow()
+	var he *HttpError
+	assert.ErrorAs(t, err, &he)
+	assert.Equal(t, http.StatusServiceUnavailable, he.StatusCode())
+	assert.EqualError(t, err, "gollamas: connection c1 is unavailable, circuit breaker is open")
+
+	clock.advance(defaultBreakerOpenDuration)
+	assert.Equal(t, breakerHalfOpen, cb.State())
+	assert.True(t, cb.ready())
+}
+
+func TestCircuitBreakerIgnoresFailuresOutsideOfWindow(t *testing.T) {
+	cb, clock := newTestCircuitBreaker(CircuitBreakerConfig{FailureRatio: 0.5, MinRequests: 4, Window: Duration(10 * time.Second)})
+	requireAllow(t, cb, true)
+	requireAllow(t, cb, true)
+	requireAllow(t, cb, true)
+	clock.advance(11 * time.Second)
+	requireAllow(t, cb, false)
+	requireAllow(t, cb, false)
+	requireAllow(t, cb, false)
+	assert.Equal(t, breakerClosed, cb.State())
+	requireAllow(t, cb, true)
+	requireAllow(t, cb, true)
+	requireAllow(t, cb, true)
+	assert.Equal(t, breakerOpen, cb.State())
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	cb, clock := newTestCircuitBreaker(CircuitBreakerConfig{FailureRatio: 1, MinRequests: 1, OpenDuration: Duration(time.Second), HalfOpenRequests: 2})
+	requireAllow(t, cb, true)
+	assert.Equal(t, breakerOpen, cb.State())
+
+	// a failed probe opens the circuit again
+	clock.advance(time.Second)
+	requireAllow(t, cb, true)
+	assert.Equal(t, breakerOpen, cb.State())
+
+	clock.advance(time.Second)
+	r1, err := cb.allow()
+	assert.NoError(t, err)
+	r2, err := cb.allow()
+	assert.NoError(t, err)
+	// only 2 probes at a time
+	_, err = cb.allow()
+	assert.EqualError(t, err, "gollamas: connection c1 is unavailable, circuit breaker is half-open")
+	assert.False(t, cb.ready())
+	r1(breakerSuccess)
+	assert.Equal(t, breakerHalfOpen, cb.State())
+	r2(breakerSuccess)
+	assert.Equal(t, breakerClosed, cb.State())
+	assert.True(t, cb.ready())
+}
+
+func TestCircuitBreakerHalfOpenIgnoresCanceledProbes(t *testing.T) {
+	cb, clock := newTestCircuitBreaker(CircuitBreakerConfig{FailureRatio: 1, MinRequests: 1, OpenDuration: Duration(time.Second)})
+	requireAllow(t, cb, true)
+	clock.advance(time.Second)
+
+	// the canceled probe neither closes nor opens the circuit, it lets the next probe through
+	record, err := cb.allow()
+	assert.NoError(t, err)
+	assert.False(t, cb.ready())
+	record(breakerIgnored)
+	assert.Equal(t, breakerHalfOpen, cb.State())
+	assert.True(t, cb.ready())
+	requireAllow(t, cb, false)
+	assert.Equal(t, breakerClosed, cb.State())
+
+	// nor are the canceled requests counted while the circuit is closed
+	record, err = cb.allow()
+	assert.NoError(t, err)
+	record(breakerIgnored)
+	assert.Equal(t, breakerClosed, cb.State())
+}
+
+func TestConnectionIgnoresCanceledProbes(t *testing.T) {
+	cl := mocks.NewIOllamaClient(t)
+	c := newConnection("c1", cl, 0)
+	cb, clock := newTestCircuitBreaker(CircuitBreakerConfig{FailureRatio: 1, MinRequests: 1, OpenDuration: Duration(time.Second)})
+	c.breaker = cb
+	requireAllow(t, cb, true)
+	clock.advance(time.Second)
+	assert.Equal(t, breakerHalfOpen, cb.State())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := &api.ChatRequest{Model: "llama3.2"}
+	cl.On("Chat", ctx, req, mock.Anything).Once().Run(func(mock.Arguments) {
+		cancel()
+	}).Return(context.Canceled)
+	assert.ErrorIs(t, c.Chat(ctx, req, func(api.ChatResponse) error { return nil }), context.Canceled)
+	assert.Equal(t, breakerHalfOpen, cb.State())
+	assert.True(t, c.Available())
+}
+
+func TestCircuitBreakerIgnoresOutdatedRequests(t *testing.T) {
+	cb, clock := newTestCircuitBreaker(CircuitBreakerConfig{FailureRatio: 1, MinRequests: 1, OpenDuration: Duration(time.Second)})
+	outdated, err := cb.allow()
+	assert.NoError(t, err)
+	requireAllow(t, cb, true)
+	assert.Equal(t, breakerOpen, cb.State())
+	clock.advance(time.Second)
+	requireAllow(t, cb, false)
+	assert.Equal(t, breakerClosed, cb.State())
+	outdated(breakerFailure)
+	assert.Equal(t, breakerClosed, cb.State())
+}
+
+func TestNilCircuitBreaker(t *testing.T) {
+	var cb *circuitBreaker
+	assert.Equal(t, breakerClosed, cb.State())
+	assert.True(t, cb.ready())
+	requireAllow(t, cb, true)
+}
+
+func TestConnectionCountsSlowCallsAsFailures(t *testing.T) {
+	cl := mocks.NewIOllamaClient(t)
+	c := newConnection("c1", cl, 0)
+	c.breaker = newCircuitBreaker("c1", CircuitBreakerConfig{FailureRatio: 1, MinRequests: 1, SlowCallDuration: Duration(time.Millisecond)})
+	ctx := context.Background()
+
+	req := &api.ChatRequest{Model: "llama3.2"}
+	cl.On("Chat", ctx, req, mock.Anything).Once().Run(func(args mock.Arguments) {
+		time.Sleep(2 * time.Millisecond)
+		fn := args.Get(2).(api.ChatResponseFunc)
+		assert.NoError(t, fn(api.ChatResponse{}))
+	}).Return(nil)
+	assert.NoError(t, c.Chat(ctx, req, func(api.ChatResponse) error { return nil }))
+	assert.Equal(t, breakerOpen, c.breaker.State())
+	assert.False(t, c.Available())
+	assert.Equal(t, int64(0), c.InFlight())
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	connectionsSection = "connections"
+	modelsSection      = "models"
+	aliasesSection     = "aliases"
+	presetsSection     = "presets"
+)
+
+// Duration is a [time.Duration] written as a string in config files, ie: "10s".
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// configEntryError is a validation error which relates to a single entry of the configuration.
+// It prints exactly as the underlying error.
+type configEntryError struct {
+	section string
+	key     string
+	err     error
+}
+
+func newConfigEntryError(section, key string, err error) *configEntryError {
+	return &configEntryError{
+		section: section,
+		key:     key,
+		err:     err,
+	}
+}
+
+func (e *configEntryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *configEntryError) Unwrap() error {
+	return e.err
+}
+
+// configFile holds a configuration loaded from a file and the line of each of its entries.
+type configFile struct {
+	path   string
+	config GollamasConfig
+	lines  map[string]int
+}
+
+func entryKey(section, key string) string {
+	return section + "/" + key
+}
+
+func loadConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	log.WithField("path", path).Trace("Loading config file.")
+	f := &configFile{
+		path:  path,
+		lines: map[string]int{},
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = f.decodeYAML(data)
+	case ".toml":
+		err = f.decodeTOML(data)
+	case ".json":
+		err = f.decodeJSON(data)
+	default:
+		return nil, fmt.Errorf("unsupported config file format: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// init validates each entry the same way as the command line flags and fills in the connection ids.
+func (f *configFile) init() error {
+	c := &f.config
+	if c.Connections == nil {
+		c.Connections = map[ConnectionID]ConnectionConfig{}
+	}
+	if c.Models == nil {
+		c.Models = map[ModelID]ModelConfig{}
+	}
+	if c.Aliases == nil {
+		c.Aliases = map[ModelID]ModelID{}
+	}
+	for _, id := range slices.Sorted(maps.Keys(c.Connections)) {
+		v := c.Connections[id]
+		cc, err := newConnectionConfig(fmt.Sprintf("%s=%s", id, v.Url), id.String(), v.Url)
+		if err != nil {
+			return f.annotate(newConfigEntryError(connectionsSection, id.String(), err))
+		}
+		if err := v.Queue.validate(); err != nil {
+			return f.annotate(newConfigEntryError(connectionsSection, id.String(), err))
+		}
+		if err := v.validateClient(); err != nil {
+			return f.annotate(newConfigEntryError(connectionsSection, id.String(), err))
+		}
+		v.ConnectionID = cc.ConnectionID
+		c.Connections[id] = v
+	}
+	for _, id := range slices.Sorted(maps.Keys(c.Models)) {
+		v := c.Models[id]
+		dests := v.ConnectionIDs()
+		if len(dests) == 0 || slices.Contains(v.Connections, "") {
+			dests = append(dests, "")
+		}
+		for _, d := range dests {
+			if _, _, err := newProxyConfig(fmt.Sprintf("%s=%s", id, d), id.String(), d.String()); err != nil {
+				return f.annotate(newConfigEntryError(modelsSection, id.String(), err))
+			}
+		}
+		if v.Balancer != "" {
+			if _, err := NewBalancer(v.Balancer); err != nil {
+				return f.annotate(newConfigEntryError(modelsSection, id.String(), err))
+			}
+		}
+		if v.Retry != nil {
+			if err := v.Retry.validate(); err != nil {
+				return f.annotate(newConfigEntryError(modelsSection, id.String(), err))
+			}
+		}
+		if err := v.Options.validate(); err != nil {
+			return f.annotate(newConfigEntryError(modelsSection, id.String(), err))
+		}
+		if v.RateLimit != nil {
+			if err := v.RateLimit.validate(); err != nil {
+				return f.annotate(newConfigEntryError(modelsSection, id.String(), err))
+			}
+		}
+		if v.Queue != nil {
+			if err := v.Queue.validate(); err != nil {
+				return f.annotate(newConfigEntryError(modelsSection, id.String(), err))
+			}
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(c.Aliases)) {
+		v := c.Aliases[id]
+		if err := validateAlias(fmt.Sprintf("%s=%s", id, v), id.String(), v.String()); err != nil {
+			return f.annotate(newConfigEntryError(aliasesSection, id.String(), err))
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(c.Presets)) {
+		if err := c.Presets[id].validate(); err != nil {
+			return f.annotate(newConfigEntryError(presetsSection, id.String(), fmt.Errorf("invalid preset %s: %w", id, err)))
+		}
+	}
+	return nil
+}
+
+// annotate prefixes errors related to an entry of the file with the file path and the line of the entry.
+func (f *configFile) annotate(err error) error {
+	var entryErr *configEntryError
+	if f == nil || !errors.As(err, &entryErr) {
+		return err
+	}
+	line, ok := f.lines[entryKey(entryErr.section, entryErr.key)]
+	if !ok {
+		return err
+	}
+	return fmt.Errorf("%s:%d: %w", f.path, line, err)
+}
+
+func (f *configFile) setLine(section, key string, line int) {
+	k := entryKey(section, key)
+	if _, ok := f.lines[k]; !ok {
+		f.lines[k] = line
+	}
+}
+
+func (f *configFile) decodeYAML(data []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f.config); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+	doc := root.Content[0].Content
+	for i := 0; i+1 < len(doc); i += 2 {
+		section, entries := doc[i].Value, doc[i+1]
+		if entries.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(entries.Content); j += 2 {
+			f.setLine(section, entries.Content[j].Value, entries.Content[j].Line)
+		}
+	}
+	return nil
+}
+
+func (f *configFile) decodeTOML(data []byte) error {
+	dec := toml.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f.config); err != nil {
+		return err
+	}
+	p := unstable.Parser{}
+	p.Reset(data)
+	var table []string
+	for p.NextExpression() {
+		e := p.Expression()
+		switch e.Kind {
+		case unstable.Table, unstable.ArrayTable:
+			table = f.recordTOMLKeys(&p, nil, e)
+		case unstable.KeyValue:
+			f.recordTOMLKeys(&p, table, e)
+		}
+	}
+	return p.Error()
+}
+
+// recordTOMLKeys records the line of the entries defined by the key of the given node,
+// including the ones nested in inline tables, and returns the full key path of the node.
+func (f *configFile) recordTOMLKeys(p *unstable.Parser, prefix []string, n *unstable.Node) []string {
+	path := slices.Clone(prefix)
+	it := n.Key()
+	for it.Next() {
+		k := it.Node()
+		path = append(path, string(k.Data))
+		if len(path) == 2 {
+			f.setLine(path[0], path[1], p.Shape(k.Raw).Start.Line)
+		}
+	}
+	if n.Kind == unstable.KeyValue && n.Value().Kind == unstable.InlineTable {
+		children := n.Value().Children()
+		for children.Next() {
+			f.recordTOMLKeys(p, path, children.Node())
+		}
+	}
+	return path
+}
+
+func (f *configFile) decodeJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f.config); err != nil {
+		return err
+	}
+	type frame struct {
+		object  bool
+		wantKey bool
+		key     string
+	}
+	var stack []*frame
+	valueDone := func() {
+		if len(stack) > 0 && stack[len(stack)-1].object {
+			stack[len(stack)-1].wantKey = true
+		}
+	}
+	dec = json.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{', '[':
+				stack = append(stack, &frame{object: t == '{', wantKey: t == '{'})
+			default:
+				stack = stack[:len(stack)-1]
+				valueDone()
+			}
+		case string:
+			if top := len(stack) - 1; top >= 0 && stack[top].object && stack[top].wantKey {
+				stack[top].key = t
+				stack[top].wantKey = false
+				if top == 1 {
+					line := bytes.Count(data[:dec.InputOffset()], []byte{'\n'}) + 1
+					f.setLine(stack[0].key, t, line)
+				}
+				continue
+			}
+			valueDone()
+		default:
+			valueDone()
+		}
+	}
+}
+
+func getConfigFile(cli *cli.Command) (*configFile, error) {
+	path := cli.String("config")
+	if path == "" {
+		return nil, nil
+	}
+	return loadConfigFile(path)
+}
+
+// overlay layers the configuration given through flags and environment variables on top of the file configuration.
+// Entries given on the command line replace the file entries with the same id.
+func (f *configFile) overlay(cli *cli.Command, cfg *GollamasConfig) (*GollamasConfig, error) {
+	res := &GollamasConfig{
+		ConfigFile:           cfg.ConfigFile,
+		WatchConfig:          cfg.WatchConfig,
+		Listen:               f.config.Listen,
+		MetricsListen:        f.config.MetricsListen,
+		Connections:          maps.Clone(f.config.Connections),
+		Models:               maps.Clone(f.config.Models),
+		Aliases:              maps.Clone(f.config.Aliases),
+		Presets:              maps.Clone(f.config.Presets),
+		ListAliases:          f.config.ListAliases,
+		Balancer:             f.config.Balancer,
+		HealthCheck:          f.config.HealthCheck,
+		Retry:                f.config.Retry,
+		CircuitBreaker:       f.config.CircuitBreaker,
+		DiscoveryInterval:    f.config.DiscoveryInterval,
+		PreferLoaded:         f.config.PreferLoaded,
+		PreferLoadedInterval: f.config.PreferLoadedInterval,
+		KeepWarmInterval:     f.config.KeepWarmInterval,
+		KeepAlive:            f.config.KeepAlive,
+		Options:              f.config.Options,
+		APIKeys:              slices.Clone(f.config.APIKeys),
+		APIKeysFile:          f.config.APIKeysFile,
+		RateLimit:            f.config.RateLimit,
+		Queue:                f.config.Queue,
+		Readiness:            f.config.Readiness,
+		Shutdown:             f.config.Shutdown,
+		Tracing:              f.config.Tracing,
+		TLS:                  f.config.TLS,
+	}
+	for k, v := range cfg.Connections {
+		delete(f.lines, entryKey(connectionsSection, k.String()))
+		res.Connections[k] = v
+	}
+	for k, v := range cfg.Models {
+		delete(f.lines, entryKey(modelsSection, k.String()))
+		res.Models[k] = v
+	}
+	for k, v := range cfg.Aliases {
+		delete(f.lines, entryKey(aliasesSection, k.String()))
+		res.Aliases[k] = v
+	}
+	res.Listen = overlayValue(cli, "listen", res.Listen, cfg.Listen)
+	res.MetricsListen = overlayValue(cli, "metrics-listen", res.MetricsListen, cfg.MetricsListen)
+	if cli.IsSet("list-aliases") {
+		res.ListAliases = cfg.ListAliases
+	}
+	res.Balancer = overlayValue(cli, "balancer", res.Balancer, cfg.Balancer)
+	hc := &res.HealthCheck
+	hc.Interval = overlayValue(cli, "health-check-interval", hc.Interval, cfg.HealthCheck.Interval)
+	hc.Timeout = overlayValue(cli, "health-check-timeout", hc.Timeout, cfg.HealthCheck.Timeout)
+	hc.HealthyThreshold = overlayValue(cli, "health-check-healthy-threshold", hc.HealthyThreshold, cfg.HealthCheck.HealthyThreshold)
+	hc.UnhealthyThreshold = overlayValue(cli, "health-check-unhealthy-threshold", hc.UnhealthyThreshold, cfg.HealthCheck.UnhealthyThreshold)
+	hc.CheckVersion = overlayValue(cli, "health-check-version", hc.CheckVersion, cfg.HealthCheck.CheckVersion)
+	res.Retry.MaxAttempts = overlayValue(cli, "retry-max-attempts", res.Retry.MaxAttempts, cfg.Retry.MaxAttempts)
+	res.Retry.Backoff = overlayValue(cli, "retry-backoff", res.Retry.Backoff, cfg.Retry.Backoff)
+	cb := &res.CircuitBreaker
+	cb.FailureRatio = overlayValue(cli, "circuit-breaker-failure-ratio", cb.FailureRatio, cfg.CircuitBreaker.FailureRatio)
+	cb.OpenDuration = overlayValue(cli, "circuit-breaker-open-duration", cb.OpenDuration, cfg.CircuitBreaker.OpenDuration)
+	cb.SlowCallDuration = overlayValue(cli, "circuit-breaker-slow-call-duration", cb.SlowCallDuration, cfg.CircuitBreaker.SlowCallDuration)
+	res.DiscoveryInterval = overlayValue(cli, "discovery-interval", res.DiscoveryInterval, cfg.DiscoveryInterval)
+	res.PreferLoaded = overlayValue(cli, "prefer-loaded", res.PreferLoaded, cfg.PreferLoaded)
+	res.PreferLoadedInterval = overlayValue(cli, "prefer-loaded-interval", res.PreferLoadedInterval, cfg.PreferLoadedInterval)
+	res.KeepWarmInterval = overlayValue(cli, "keep-warm-interval", res.KeepWarmInterval, cfg.KeepWarmInterval)
+	res.KeepAlive.Default = overlayValue(cli, "keep-alive", res.KeepAlive.Default, cfg.KeepAlive.Default)
+	res.KeepAlive.Override = overlayValue(cli, "keep-alive-override", res.KeepAlive.Override, cfg.KeepAlive.Override)
+	res.APIKeysFile = overlayValue(cli, "api-keys-file", res.APIKeysFile, cfg.APIKeysFile)
+	rl := &res.RateLimit
+	rl.RequestsPerMinute = overlayValue(cli, "rate-limit-requests-per-minute", rl.RequestsPerMinute, cfg.RateLimit.RequestsPerMinute)
+	rl.Concurrency = overlayValue(cli, "rate-limit-concurrency", rl.Concurrency, cfg.RateLimit.Concurrency)
+	rl.TokensPerDay = overlayValue(cli, "rate-limit-tokens-per-day", rl.TokensPerDay, cfg.RateLimit.TokensPerDay)
+	rl.TokensPerMonth = overlayValue(cli, "rate-limit-tokens-per-month", rl.TokensPerMonth, cfg.RateLimit.TokensPerMonth)
+	q := &res.Queue
+	q.Concurrency = overlayValue(cli, "queue-concurrency", q.Concurrency, cfg.Queue.Concurrency)
+	q.MaxDepth = overlayValue(cli, "queue-max-depth", q.MaxDepth, cfg.Queue.MaxDepth)
+	q.MaxWait = overlayValue(cli, "queue-max-wait", q.MaxWait, cfg.Queue.MaxWait)
+	res.Readiness.MinConnections = overlayValue(cli, "ready-min-connections", res.Readiness.MinConnections, cfg.Readiness.MinConnections)
+	if len(res.Readiness.RequiredModels) == 0 || cli.IsSet("ready-required-models") {
+		res.Readiness.RequiredModels = cfg.Readiness.RequiredModels
+	}
+	res.Readiness.CacheTTL = overlayValue(cli, "ready-cache-ttl", res.Readiness.CacheTTL, cfg.Readiness.CacheTTL)
+	res.Shutdown.Delay = overlayValue(cli, "shutdown-delay", res.Shutdown.Delay, cfg.Shutdown.Delay)
+	res.Shutdown.DrainTimeout = overlayValue(cli, "drain-timeout", res.Shutdown.DrainTimeout, cfg.Shutdown.DrainTimeout)
+	res.Tracing.OTLPEndpoint = overlayValue(cli, "otlp-endpoint", res.Tracing.OTLPEndpoint, cfg.Tracing.OTLPEndpoint)
+	res.Tracing.SampleRatio = overlayValue(cli, "trace-sample-ratio", res.Tracing.SampleRatio, cfg.Tracing.SampleRatio)
+	res.TLS.CertFile = overlayValue(cli, "tls-cert", res.TLS.CertFile, cfg.TLS.CertFile)
+	res.TLS.KeyFile = overlayValue(cli, "tls-key", res.TLS.KeyFile, cfg.TLS.KeyFile)
+	res.TLS.ClientCAFile = overlayValue(cli, "tls-client-ca", res.TLS.ClientCAFile, cfg.TLS.ClientCAFile)
+	var entryErr *configEntryError
+	_, models, err := reconcileConnectionsAndProxyConfigs(res.Connections, res.Models)
+	if err == nil {
+		err = validateAliasesAndPresets(models, res.Aliases, res.Presets)
+	}
+	if errors.As(err, &entryErr) {
+		if _, ok := f.lines[entryKey(entryErr.section, entryErr.key)]; ok {
+			return nil, f.annotate(err)
+		}
+	}
+	return res, nil
+}
+
+// optionalDuration returns the value of a duration flag, or nil when it is not set as zero is a valid value.
+func optionalDuration(cli *cli.Command, flag string) *Duration {
+	if !cli.IsSet(flag) {
+		return nil
+	}
+	d := Duration(cli.Duration(flag))
+	return &d
+}
+
+// optionalInt returns the value of an int flag, or nil when it is not set as zero is a valid value.
+func optionalInt(cli *cli.Command, flag string) *int {
+	if !cli.IsSet(flag) {
+		return nil
+	}
+	i := cli.Int(flag)
+	return &i
+}
+
+// overlayValue returns the value of the flag when it is set or when the file leaves the setting empty.
+func overlayValue[T comparable](cli *cli.Command, flag string, file, flagValue T) T {
+	var zero T
+	if file == zero || cli.IsSet(flag) {
+		return flagValue
+	}
+	return file
+}
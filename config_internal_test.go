@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func writeTestConfigFile(t *testing.T, name, content string) string {
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	expected := GollamasConfig{
+		Listen: "0.0.0.0:11434",
+		Connections: map[ConnectionID]ConnectionConfig{
+			"c1": {ConnectionID: "c1", Url: "http://server1:11434"},
+		},
+		Models: map[ModelID]ModelConfig{
+			"llama3.2":        {ConnectionID: "c1"},
+			"deepseek-r1:14b": {ConnectionID: "http://server2:11434"},
+		},
+		Aliases:     map[ModelID]ModelID{"gpt-3.5-turbo": "llama3.2"},
+		ListAliases: true,
+	}
+	for name, content := range map[string]string{
+		"config.yaml": `
+listen: 0.0.0.0:11434
+list_aliases: true
+connections:
+  c1:
+    url: http://server1:11434
+models:
+  llama3.2:
+    connection: c1
+  deepseek-r1:14b:
+    connection: http://server2:11434
+aliases:
+  gpt-3.5-turbo: llama3.2
+`,
+		"config.toml": `
+listen = "0.0.0.0:11434"
+list_aliases = true
+
+[connections.c1]
+url = "http://server1:11434"
+
+[models]
+"llama3.2" = { connection = "c1" }
+"deepseek-r1:14b" = { connection = "http://server2:11434" }
+
+[aliases]
+"gpt-3.5-turbo" = "llama3.2"
+`,
+		"config.json": `{
+	"listen": "0.0.0.0:11434",
+	"list_aliases": true,
+	"connections": {"c1": {"url": "http://server1:11434"}},
+	"models": {
+		"llama3.2": {"connection": "c1"},
+		"deepseek-r1:14b": {"connection": "http://server2:11434"}
+	},
+	"aliases": {"gpt-3.5-turbo": "llama3.2"}
+}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			f, err := loadConfigFile(writeTestConfigFile(t, name, content))
+			assert.NoError(t, err)
+			if assert.NotNil(t, f) {
+				assert.Equal(t, expected, f.config)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	for name, tt := range map[string]struct {
+		file    string
+		content string
+		err     string
+	}{
+		"UnsupportedFormat": {
+			file: "config.ini",
+			err:  "unsupported config file format: %s",
+		},
+		"UnknownField": {
+			file:    "config.yaml",
+			content: "unknown: value\n",
+			err:     "%s: yaml: unmarshal errors:\n  line 1: field unknown not found in type main.GollamasConfig",
+		},
+		"YAMLEmptyConnectionUrl": {
+			file:    "config.yaml",
+			content: "connections:\n  c1:\n    url: http://server1\n  c2:\n    url: \"\"\n",
+			err:     "%s:4: empty connection destination in c2=",
+		},
+		"YAMLInvalidConnectionClient": {
+			file:    "config.yaml",
+			content: "connections:\n  c1:\n    url: http://server1\n  c2:\n    url: http://server2\n    proxy_url: proxy:3128\n",
+			err:     "%s:4: invalid proxy url: proxy:3128",
+		},
+		"YAMLEmptyModelConnection": {
+			file:    "config.yaml",
+			content: "models:\n  llama3.2:\n    connection: c1\n  tinyllama: {}\n",
+			err:     "%s:4: empty proxy destination in tinyllama=",
+		},
+		"YAMLEmptyAdditionalConnection": {
+			file:    "config.yaml",
+			content: "models:\n  llama3.2:\n    connections: [c1, \"\"]\n",
+			err:     "%s:2: empty proxy destination in llama3.2=",
+		},
+		"YAMLUnknownBalancer": {
+			file:    "config.yaml",
+			content: "models:\n  llama3.2:\n    connections: [c1, c2]\n    balancer: fastest\n",
+			err:     "%s:2: unknown balancer fastest, expected one of least-outstanding, random, round-robin, weighted",
+		},
+		"YAMLUnknownOption": {
+			file:    "config.yaml",
+			content: "models:\n  llama3.2:\n    connection: c1\n    options:\n      defaults:\n        num_context: 8192\n",
+			err:     "%s:2: unknown option: num_context",
+		},
+		"YAMLPresetWithoutModel": {
+			file:    "config.yaml",
+			content: "models:\n  llama3.2:\n    connection: c1\npresets:\n  assistant:\n    system: You are helpful.\n",
+			err:     "%s:5: invalid preset assistant: empty preset model",
+		},
+		"YAMLEmptyAliasModel": {
+			file:    "config.yaml",
+			content: "aliases:\n  gpt-4: \"\"\n",
+			err:     "%s:2: empty alias model in: gpt-4=",
+		},
+		"TOMLEmptyConnectionUrl": {
+			file:    "config.toml",
+			content: "[connections.c1]\nurl = \"http://server1\"\n\n[connections.c2]\nurl = \"\"\n",
+			err:     "%s:4: empty connection destination in c2=",
+		},
+		"TOMLEmptyModelConnection": {
+			file:    "config.toml",
+			content: "[models]\nllama = { connection = \"c1\" }\ntiny = { connection = \"\" }\n",
+			err:     "%s:3: empty proxy destination in tiny=",
+		},
+		"JSONEmptyAliasName": {
+			file:    "config.json",
+			content: "{\n  \"aliases\": {\n    \"\": \"llama3.2\"\n  }\n}",
+			err:     "%s:3: empty alias name in: =llama3.2",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := writeTestConfigFile(t, tt.file, tt.content)
+			f, err := loadConfigFile(p)
+			assert.EqualError(t, err, fmt.Sprintf(tt.err, p))
+			assert.Nil(t, f)
+		})
+	}
+}
+
+func TestRunCliConfigFile(t *testing.T) {
+	p := writeTestConfigFile(t, "config.yaml", `
+listen: 0.0.0.0:11434
+list_aliases: true
+connections:
+  c1:
+    url: http://server1:11434
+models:
+  llama3.2:
+    connection: c1
+  tinyllama:
+    connection: c1
+aliases:
+  gpt-3.5-turbo: llama3.2
+`)
+	m := prepareTestOsArgs(t, "gollamas", "--config", p, "--listen", "localhost:8080",
+		"--proxy", "tinyllama=http://server2:11434", "--alias", "gpt-4=tinyllama")
+	m.On("mockRunGollamas", GollamasConfig{
+		Listen: "localhost:8080",
+		Connections: map[ConnectionID]ConnectionConfig{
+			"c1": {ConnectionID: "c1", Url: "http://server1:11434"},
+		},
+		Models: map[ModelID]ModelConfig{
+			"llama3.2":  {ConnectionID: "c1"},
+			"tinyllama": {ConnectionID: "http://server2:11434"},
+		},
+		Aliases:     map[ModelID]ModelID{"gpt-3.5-turbo": "llama3.2", "gpt-4": "tinyllama"},
+		ListAliases: true,
+		ConfigFile:  p,
+	}).Return(nil)
+	assert.NoError(t, runCli("gollamas"))
+	m.AssertExpectations(t)
+}
+
+func TestLoadConfigFileMultipleConnections(t *testing.T) {
+	p := writeTestConfigFile(t, "config.toml", `
+balancer = "weighted"
+
+[connections]
+c1 = { url = "http://server1:11434", weight = 3 }
+c2 = { url = "http://server2:11434" }
+
+[models."qwen2.5-coder:14b"]
+connections = ["c1", "c2"]
+balancer = "least-outstanding"
+`)
+	f, err := loadConfigFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, GollamasConfig{
+		Connections: map[ConnectionID]ConnectionConfig{
+			"c1": {ConnectionID: "c1", Url: "http://server1:11434", Weight: 3},
+			"c2": {ConnectionID: "c2", Url: "http://server2:11434"},
+		},
+		Models: map[ModelID]ModelConfig{
+			"qwen2.5-coder:14b": {Connections: []ConnectionID{"c1", "c2"}, Balancer: "least-outstanding"},
+		},
+		Aliases:  map[ModelID]ModelID{},
+		Balancer: "weighted",
+	}, f.config)
+}
+
+func TestLoadConfigFileConnectionClient(t *testing.T) {
+	f, err := loadConfigFile(writeTestConfigFile(t, "config.yaml", `
+connections:
+  c1:
+    url: https://ollama.internal
+    connect_timeout: 5s
+    response_header_timeout: 5m
+    idle_conn_timeout: 30s
+    max_idle_conns: 10
+    ca_file: /etc/gollamas/ca.crt
+    cert_file: /etc/gollamas/tls.crt
+    key_file: /etc/gollamas/tls.key
+    proxy_url: http://proxy:3128
+    headers:
+      Authorization: Bearer secret1
+models:
+  llama3.2:
+    connection: c1
+`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, f) {
+		assert.Equal(t, ConnectionConfig{
+			ConnectionID:          "c1",
+			Url:                   "https://ollama.internal",
+			ConnectTimeout:        Duration(5 * time.Second),
+			ResponseHeaderTimeout: Duration(5 * time.Minute),
+			IdleConnTimeout:       Duration(30 * time.Second),
+			MaxIdleConns:          10,
+			CAFile:                "/etc/gollamas/ca.crt",
+			CertFile:              "/etc/gollamas/tls.crt",
+			KeyFile:               "/etc/gollamas/tls.key",
+			ProxyURL:              "http://proxy:3128",
+			Headers:               map[string]string{"Authorization": "Bearer secret1"},
+		}, f.config.Connections["c1"])
+	}
+}
+
+func TestRunCliConfigFileHealthCheck(t *testing.T) {
+	for _, tc := range []struct{ file, content string }{
+		{"config.yaml", "models:\n  llama3.2:\n    connection: http://server1:11434\nhealth_check:\n  interval: 10s\n  unhealthy_threshold: 5\n  check_version: true\n"},
+		{"config.toml", "[models]\n\"llama3.2\" = { connection = \"http://server1:11434\" }\n[health_check]\ninterval = \"10s\"\nunhealthy_threshold = 5\ncheck_version = true\n"},
+		{"config.json", `{"models": {"llama3.2": {"connection": "http://server1:11434"}}, "health_check": {"interval": "10s", "unhealthy_threshold": 5, "check_version": true}}`},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			p := writeTestConfigFile(t, tc.file, tc.content)
+			m := prepareTestOsArgs(t, "gollamas", "--config", p, "--health-check-timeout", "2s", "--health-check-unhealthy-threshold", "2")
+			m.On("mockRunGollamas", GollamasConfig{
+				Listen:      "localhost:11434",
+				Connections: map[ConnectionID]ConnectionConfig{},
+				Models: map[ModelID]ModelConfig{
+					"llama3.2": {ConnectionID: "http://server1:11434"},
+				},
+				Aliases:    map[ModelID]ModelID{},
+				ConfigFile: p,
+				HealthCheck: HealthCheckConfig{
+					Interval:           Duration(10 * time.Second),
+					Timeout:            Duration(2 * time.Second),
+					UnhealthyThreshold: 2,
+					CheckVersion:       true,
+				},
+			}).Return(nil)
+			assert.NoError(t, runCli("gollamas"))
+			m.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRunCliConfigFileKeepAlive(t *testing.T) {
+	for _, tc := range []struct{ file, content string }{
+		{"config.yaml", "connections:\n  c1:\n    url: http://server1:11434\n    keep_alive:\n      override: 30m\nmodels:\n  llama3.2:\n    connection: c1\n    keep_alive:\n      default: 0s\nkeep_alive:\n  default: 1h\n"},
+		{"config.toml", "[connections]\nc1 = { url = \"http://server1:11434\", keep_alive = { override = \"30m\" } }\n[models]\n\"llama3.2\" = { connection = \"c1\", keep_alive = { default = \"0s\" } }\n[keep_alive]\ndefault = \"1h\"\n"},
+		{"config.json", `{"connections": {"c1": {"url": "http://server1:11434", "keep_alive": {"override": "30m"}}}, "models": {"llama3.2": {"connection": "c1", "keep_alive": {"default": "0s"}}}, "keep_alive": {"default": "1h"}}`},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			p := writeTestConfigFile(t, tc.file, tc.content)
+			m := prepareTestOsArgs(t, "gollamas", "--config", p, "--keep-alive-override=-1s")
+			d := func(d time.Duration) *Duration { v := Duration(d); return &v }
+			m.On("mockRunGollamas", GollamasConfig{
+				Listen: "localhost:11434",
+				Connections: map[ConnectionID]ConnectionConfig{
+					"c1": {ConnectionID: "c1", Url: "http://server1:11434", KeepAlive: KeepAliveConfig{Override: d(30 * time.Minute)}},
+				},
+				Models: map[ModelID]ModelConfig{
+					"llama3.2": {ConnectionID: "c1", KeepAlive: KeepAliveConfig{Default: d(0)}},
+				},
+				Aliases:    map[ModelID]ModelID{},
+				ConfigFile: p,
+				KeepAlive:  KeepAliveConfig{Default: d(time.Hour), Override: d(-time.Second)},
+			}).Return(nil)
+			assert.NoError(t, runCli("gollamas"))
+			m.AssertExpectations(t)
+		})
+	}
+}
+
+func TestLoadConfigFilePresets(t *testing.T) {
+	p := writeTestConfigFile(t, "config.yaml", `
+models:
+  qwen2.5-coder:14b:
+    connection: http://server1:11434
+presets:
+  code-reviewer:
+    model: qwen2.5-coder:14b
+    system: You review code.
+    options:
+      temperature: 0.1
+      num_ctx: 16384
+`)
+	f, err := loadConfigFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, map[ModelID]PresetConfig{
+		"code-reviewer": {Model: "qwen2.5-coder:14b", System: "You review code.", Options: map[string]any{"temperature": 0.1, "num_ctx": 16384}},
+	}, f.config.Presets)
+}
+
+func TestRunCliConfigFileReconcileError(t *testing.T) {
+	p := writeTestConfigFile(t, "config.yaml", `
+connections:
+  c1:
+    url: http://server1:11434
+models:
+  llama3.2:
+    connection: c1
+  tinyllama:
+    connection: ftp://server2
+`)
+	m := prepareTestOsArgs(t, "gollamas", "--config", p)
+	err := runCli("gollamas")
+	assert.EqualError(t, err, fmt.Sprintf("could not initialize gollamas config: %s:8: invalid connection id: ftp://server2, invalid url scheme", p))
+	m.AssertNotCalled(t, "mockRunGollamas", mock.Anything)
+}
+
+func TestRunCliConfigFileAliasAndPresetErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name: "alias to unknown model",
+			config: `
+models:
+  llama3.2:
+    connection: http://server1:11434
+aliases:
+  gpt-4o: llama3.2
+  gpt-4: mistral
+`,
+			err: "%s:7: alias gpt-4 points to unknown model mistral",
+		},
+		{
+			name: "preset to unknown model",
+			config: `
+models:
+  llama3.2:
+    connection: http://server1:11434
+presets:
+  assistant:
+    model: mistral
+`,
+			err: "%s:6: preset assistant points to unknown model mistral",
+		},
+		{
+			name: "preset named as an alias",
+			config: `
+models:
+  llama3.2:
+    connection: http://server1:11434
+aliases:
+  assistant: llama3.2
+presets:
+  assistant:
+    model: llama3.2
+`,
+			err: "%s:8: preset assistant refers to an existing alias",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := writeTestConfigFile(t, "config.yaml", tt.config)
+			m := prepareTestOsArgs(t, "gollamas", "--config", p)
+			err := runCli("gollamas")
+			assert.EqualError(t, err, "could not initialize gollamas config: "+fmt.Sprintf(tt.err, p))
+			m.AssertNotCalled(t, "mockRunGollamas", mock.Anything)
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// connection is the client of an ollama server used by the router,
+// it keeps track of the requests routed to the server and of its health.
+type connection struct {
+	IOllamaClient
+	id        ConnectionID
+	weight    int
+	inflight  atomic.Int64
+	unhealthy atomic.Bool
+	breaker   *circuitBreaker
+	queue     *requestQueue // nil when the requests to the connection are not limited
+	mu        sync.Mutex
+	health    ConnectionHealth
+	onRecover func() // called when the connection becomes healthy again
+	keepAlive KeepAliveConfig
+}
+
+func newConnection(id ConnectionID, cl IOllamaClient, weight int) *connection {
+	return &connection{
+		IOllamaClient: cl,
+		id:            id,
+		weight:        max(weight, 1),
+	}
+}
+
+func (c *connection) ConnectionID() ConnectionID {
+	return c.id
+}
+
+func (c *connection) Weight() int {
+	return c.weight
+}
+
+func (c *connection) InFlight() int64 {
+	return c.inflight.Load()
+}
+
+// Healthy reports whether the connection passes its health checks, connections start healthy.
+func (c *connection) Healthy() bool {
+	return !c.unhealthy.Load()
+}
+
+// Available reports whether requests can be routed to the connection:
+// it passes its health checks and its circuit breaker lets requests through.
+func (c *connection) Available() bool {
+	return c.Healthy() && c.breaker.ready()
+}
+
+// connectionCall follows a request sent to the connection.
+type connectionCall struct {
+	c         *connection
+	model     string
+	start     time.Time
+	latency   time.Duration
+	responded bool
+	record    func(outcome breakerOutcome)
+	release   func() // lets the next queued request through, nil for the requests which are not queued
+}
+
+// begin starts a request, it fails when the circuit breaker of the connection is open.
+func (c *connection) begin(model string) (*connectionCall, error) {
+	record, err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	c.inflight.Add(1)
+	return &connectionCall{
+		c:      c,
+		model:  model,
+		start:  time.Now(),
+		record: record,
+	}, nil
+}
+
+// beginQueued starts a request once the queue of the connection lets it through.
+func (c *connection) beginQueued(ctx context.Context, model string) (*connectionCall, error) {
+	release, err := c.queue.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := c.begin(model)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	cc.release = release
+	return cc, nil
+}
+
+// respond marks the first response of a streamed request.
+func (cc *connectionCall) respond() {
+	if !cc.responded {
+		cc.responded = true
+		cc.latency = time.Since(cc.start)
+	}
+}
+
+func (cc *connectionCall) end(ctx context.Context, err error) {
+	cc.c.inflight.Add(-1)
+	cc.respond()
+	slow := cc.c.breaker != nil && cc.c.breaker.cfg.SlowCallDuration > 0 && cc.latency > time.Duration(cc.c.breaker.cfg.SlowCallDuration)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// the caller went away, the connection may never have answered
+		cc.record(breakerIgnored)
+	case (err != nil && isRetryable(ctx, err)) || slow:
+		cc.record(breakerFailure)
+	default:
+		cc.record(breakerSuccess)
+	}
+	requestInfoFromContext(ctx).upstream(cc.c.id, cc.model, err)
+	if cc.release != nil {
+		cc.release()
+	}
+}
+
+func (c *connection) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) (err error) {
+	ctx, span := startUpstreamSpan(ctx, "ollama chat", c.id, req.Model)
+	defer func() { endSpan(span, err) }()
+	cc, err := c.beginQueued(ctx, req.Model)
+	if err != nil {
+		return err
+	}
+	defer func() { cc.end(ctx, err) }()
+	ri := requestInfoFromContext(ctx)
+	return c.IOllamaClient.Chat(ctx, req, func(resp api.ChatResponse) error {
+		cc.respond()
+		ri.respond()
+		if resp.Done {
+			ri.done(resp.Metrics)
+			setSpanTokens(span, resp.Metrics)
+		}
+		return fn(resp)
+	})
+}
+
+func (c *connection) Embed(ctx context.Context, req *api.EmbedRequest) (res *api.EmbedResponse, err error) {
+	ctx, span := startUpstreamSpan(ctx, "ollama embed", c.id, req.Model)
+	defer func() { endSpan(span, err) }()
+	cc, err := c.beginQueued(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { cc.end(ctx, err) }()
+	res, err = c.IOllamaClient.Embed(ctx, req)
+	if err == nil && res != nil {
+		m := api.Metrics{PromptEvalCount: res.PromptEvalCount}
+		requestInfoFromContext(ctx).done(m)
+		setSpanTokens(span, m)
+	}
+	return res, err
+}
+
+func (c *connection) Embeddings(ctx context.Context, req *api.EmbeddingRequest) (_ *api.EmbeddingResponse, err error) {
+	ctx, span := startUpstreamSpan(ctx, "ollama embeddings", c.id, req.Model)
+	defer func() { endSpan(span, err) }()
+	cc, err := c.beginQueued(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { cc.end(ctx, err) }()
+	return c.IOllamaClient.Embeddings(ctx, req)
+}
+
+func (c *connection) Generate(ctx context.Context, req *api.GenerateRequest, fn api.GenerateResponseFunc) (err error) {
+	ctx, span := startUpstreamSpan(ctx, "ollama generate", c.id, req.Model)
+	defer func() { endSpan(span, err) }()
+	cc, err := c.beginQueued(ctx, req.Model)
+	if err != nil {
+		return err
+	}
+	defer func() { cc.end(ctx, err) }()
+	ri := requestInfoFromContext(ctx)
+	return c.IOllamaClient.Generate(ctx, req, func(resp api.GenerateResponse) error {
+		cc.respond()
+		ri.respond()
+		if resp.Done {
+			ri.done(resp.Metrics)
+			setSpanTokens(span, resp.Metrics)
+		}
+		return fn(resp)
+	})
+}
+
+func (c *connection) Pull(ctx context.Context, req *api.PullRequest, fn api.PullProgressFunc) (err error) {
+	ctx, span := startUpstreamSpan(ctx, "ollama pull", c.id, cmp.Or(req.Model, req.Name))
+	defer func() { endSpan(span, err) }()
+	// the pulls are not queued, they download the model for minutes without loading it
+	cc, err := c.begin(cmp.Or(req.Model, req.Name))
+	if err != nil {
+		return err
+	}
+	defer func() { cc.end(ctx, err) }()
+	return c.IOllamaClient.Pull(ctx, req, func(resp api.ProgressResponse) error {
+		cc.respond()
+		return fn(resp)
+	})
+}
+
+func (c *connection) Show(ctx context.Context, req *api.ShowRequest) (_ *api.ShowResponse, err error) {
+	ctx, span := startUpstreamSpan(ctx, "ollama show", c.id, req.Model)
+	defer func() { endSpan(span, err) }()
+	cc, err := c.beginQueued(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { cc.end(ctx, err) }()
+	return c.IOllamaClient.Show(ctx, req)
+}
+
+// List, ListRunning and Version are only traced, they are sent to all the connections and left out of the health of the connection.
+
+func (c *connection) List(ctx context.Context) (_ *api.ListResponse, err error) {
+	ctx, span := startUpstreamSpan(ctx, "ollama list", c.id, "")
+	defer func() { endSpan(span, err) }()
+	return c.IOllamaClient.List(ctx)
+}
+
+func (c *connection) ListRunning(ctx context.Context) (_ *api.ProcessResponse, err error) {
+	ctx, span := startUpstreamSpan(ctx, "ollama ps", c.id, "")
+	defer func() { endSpan(span, err) }()
+	return c.IOllamaClient.ListRunning(ctx)
+}
+
+func (c *connection) Version(ctx context.Context) (_ string, err error) {
+	ctx, span := startUpstreamSpan(ctx, "ollama version", c.id, "")
+	defer func() { endSpan(span, err) }()
+	return c.IOllamaClient.Version(ctx)
+}
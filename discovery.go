@@ -0,0 +1,326 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/types/model"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultDiscoveryInterval = time.Minute
+
+// discoveryMinRefresh limits the refreshes triggered by requests for unknown models.
+var discoveryMinRefresh = 5 * time.Second
+
+// IsWildcard reports whether the model id is a pattern such as "*" or "llama*"
+// matching the models found on its connections.
+func (mid ModelID) IsWildcard() bool {
+	return strings.Contains(string(mid), "*")
+}
+
+// matchWildcard reports whether name matches the pattern, where * matches any sequence of characters.
+func matchWildcard(pattern, name string) bool {
+	prefix, rest, found := strings.Cut(pattern, "*")
+	if !found {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	name = name[len(prefix):]
+	parts := strings.Split(rest, "*")
+	last := parts[len(parts)-1]
+	for _, p := range parts[:len(parts)-1] {
+		i := strings.Index(name, p)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(p):]
+	}
+	return len(name) >= len(last) && strings.HasSuffix(name, last)
+}
+
+// wildcardRoute routes the models matching its pattern to the connections on which they are found.
+type wildcardRoute struct {
+	pattern   ModelID
+	backends  []*connection
+	balancer  string
+	retry     RetryConfig
+	residency *residency
+	keepAlive KeepAliveConfig
+	options   OptionsPolicy
+	fallbacks []*modelRoute
+	rateLimit RateLimitConfig
+	queue     QueueConfig
+}
+
+// specificity ranks the patterns, the more literal characters the more specific.
+func (w *wildcardRoute) specificity() int {
+	return len(strings.ReplaceAll(string(w.pattern), "*", ""))
+}
+
+func (w *wildcardRoute) matches(name string) bool {
+	return matchWildcard(string(w.pattern), name)
+}
+
+func (w *wildcardRoute) newRoute(name ModelID, backends []*connection) *modelRoute {
+	// the balancer name has been validated when creating the router
+	b, _ := NewBalancer(w.balancer)
+	return &modelRoute{
+		model:     name,
+		backends:  backends,
+		balancer:  b,
+		retry:     w.retry,
+		budget:    newRetryBudget(w.retry.Budget),
+		residency: w.residency,
+		keepAlive: w.keepAlive,
+		options:   w.options,
+		fallbacks: w.fallbacks,
+		rateLimit: w.rateLimit,
+		queue:     newRequestQueue("model", name.String(), w.queue),
+	}
+}
+
+// discovery keeps track of the models found on the connections of the wildcard routes.
+type discovery struct {
+	wildcards []*wildcardRoute
+	interval  time.Duration
+
+	mu     sync.RWMutex
+	routes map[string]*modelRoute
+
+	refreshMu   sync.Mutex
+	lastRefresh time.Time
+	// discovered is closed once the models were listed for the first time
+	discovered chan struct{}
+	once       sync.Once
+
+	// ctx ends the refreshes triggered by the requests once the discovery is stopped
+	ctx       context.Context
+	cancel    context.CancelFunc
+	refreshes sync.WaitGroup
+
+	loop *loop
+}
+
+func newDiscovery(wildcards []*wildcardRoute, interval time.Duration) *discovery {
+	slices.SortStableFunc(wildcards, func(a, b *wildcardRoute) int {
+		return cmp.Or(cmp.Compare(b.specificity(), a.specificity()), cmp.Compare(a.pattern, b.pattern))
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	return &discovery{
+		wildcards:  wildcards,
+		interval:   cmp.Or(interval, defaultDiscoveryInterval),
+		routes:     map[string]*modelRoute{},
+		discovered: make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+func (d *discovery) start() {
+	d.loop = startLoop(d.interval, d.refresh)
+}
+
+func (d *discovery) stop() {
+	d.loop.stop()
+	d.cancel()
+	d.refreshes.Wait()
+}
+
+// modelKey normalises model names so that ie: llama3.2 and llama3.2:latest are the same model.
+func modelKey(name string) string {
+	if n := model.ParseName(name); n.IsValid() {
+		return n.DisplayShortest()
+	}
+	return name
+}
+
+// lookup returns the route of a discovered model.
+func (d *discovery) lookup(name string) *modelRoute {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.routes[modelKey(name)]
+}
+
+// lookupOrRefresh returns the route of a discovered model. When the model is unknown and matches a wildcard route
+// the discovered models are refreshed in the background, the request does not wait for the connections to be listed.
+// Only the requests received before the first discovery completes wait for it.
+func (d *discovery) lookupOrRefresh(ctx context.Context, name string) *modelRoute {
+	select {
+	case <-d.discovered:
+	case <-ctx.Done():
+		return nil
+	}
+	if route := d.lookup(name); route != nil {
+		return route
+	}
+	if d.match(name) != nil {
+		d.refreshAsync()
+	}
+	return nil
+}
+
+// refreshAsync starts a refresh unless one is already running or the last one is too recent.
+func (d *discovery) refreshAsync() {
+	if !d.refreshMu.TryLock() {
+		return
+	}
+	if time.Since(d.lastRefresh) < discoveryMinRefresh {
+		d.refreshMu.Unlock()
+		return
+	}
+	d.refreshes.Add(1)
+	go func() {
+		defer d.refreshes.Done()
+		defer d.refreshMu.Unlock()
+		d.refreshLocked(d.ctx)
+	}()
+}
+
+// match returns the most specific wildcard route matching the model name.
+func (d *discovery) match(name string) *wildcardRoute {
+	for _, w := range d.wildcards {
+		if w.matches(name) {
+			return w
+		}
+	}
+	return nil
+}
+
+// matches reports whether a model listed by the connection is exposed by one of its wildcard routes.
+func (d *discovery) matches(cid ConnectionID, name string) bool {
+	for _, w := range d.wildcards {
+		if w.matches(name) && slices.ContainsFunc(w.backends, func(c *connection) bool { return c.id == cid }) {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh lists the models of each connection of the wildcard routes and updates the discovered routes.
+func (d *discovery) refresh(ctx context.Context) {
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
+	d.refreshLocked(ctx)
+}
+
+func (d *discovery) refreshLocked(ctx context.Context) {
+	defer d.once.Do(func() { close(d.discovered) })
+	conns := map[ConnectionID]*connection{}
+	for _, w := range d.wildcards {
+		for _, c := range w.backends {
+			conns[c.id] = c
+		}
+	}
+	type listed struct {
+		cid    ConnectionID
+		models []string
+		err    error
+	}
+	ch := make(chan listed)
+	wg := sync.WaitGroup{}
+	for cid, c := range conns {
+		wg.Add(1)
+		go func(cid ConnectionID, c *connection) {
+			defer wg.Done()
+			res := listed{cid: cid}
+			lr, err := c.List(ctx)
+			res.err = err
+			if lr != nil {
+				for _, m := range lr.Models {
+					res.models = append(res.models, m.Model)
+				}
+			}
+			ch <- res
+		}(cid, c)
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	// models found on each connection, a connection which fails to answer keeps its previous models
+	present := map[ConnectionID]map[string]string{}
+	failed := map[ConnectionID]bool{}
+	for l := range ch {
+		if l.err != nil {
+			log.WithField("connection_id", l.cid).WithError(l.err).Error("Failed to discover models.")
+			failed[l.cid] = true
+			continue
+		}
+		present[l.cid] = map[string]string{}
+		for _, m := range l.models {
+			present[l.cid][modelKey(m)] = m
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, route := range d.routes {
+		for _, b := range route.backends {
+			if failed[b.id] {
+				if present[b.id] == nil {
+					present[b.id] = map[string]string{}
+				}
+				present[b.id][key] = route.model.String()
+			}
+		}
+	}
+	names := map[string]string{}
+	for _, models := range present {
+		for key, name := range models {
+			names[key] = name
+		}
+	}
+	routes := map[string]*modelRoute{}
+	for key, name := range names {
+		for _, w := range d.wildcards {
+			if !w.matches(name) && !w.matches(key) {
+				continue
+			}
+			var backends []*connection
+			for _, c := range w.backends {
+				if _, ok := present[c.id][key]; ok {
+					backends = append(backends, c)
+				}
+			}
+			if len(backends) == 0 {
+				continue
+			}
+			if prev, ok := d.routes[key]; ok && slices.Equal(prev.backends, backends) {
+				routes[key] = prev
+			} else {
+				log.WithField("model", name).WithField("pattern", w.pattern).WithField("connections", len(backends)).Info("Discovered model.")
+				routes[key] = w.newRoute(ModelID(name), backends)
+				if ok {
+					// the requests queued for the model keep their place
+					routes[key].queue = prev.queue
+				}
+			}
+			break
+		}
+	}
+	for key, route := range d.routes {
+		if _, ok := routes[key]; !ok {
+			log.WithField("model", route.model).Info("Discovered model is no longer available.")
+		}
+	}
+	d.routes = routes
+	d.lastRefresh = time.Now()
+}
+
+func validateWildcard(pattern ModelID) error {
+	if strings.TrimSpace(pattern.String()) != pattern.String() || strings.ContainsAny(pattern.String(), " \t") {
+		return fmt.Errorf("invalid model pattern: %s", pattern)
+	}
+	return nil
+}
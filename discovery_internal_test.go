@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/slawo/gollamas/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMatchWildcard(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		expected      bool
+	}{
+		{"*", "llama3.2:latest", true},
+		{"*", "", true},
+		{"llama*", "llama3.2:latest", true},
+		{"llama*", "tinyllama:latest", false},
+		{"*llama*", "tinyllama:latest", true},
+		{"*:14b", "deepseek-r1:14b", true},
+		{"*:14b", "deepseek-r1:14b-q4", false},
+		{"qwen*coder*", "qwen2.5-coder:14b", true},
+		{"qwen*coder*", "qwen2.5:14b", false},
+		{"a*a", "a", false},
+		{"a*a", "aa", true},
+		{"hf.co/*", "hf.co/bartowski/model:q4", true},
+	} {
+		assert.Equal(t, tc.expected, matchWildcard(tc.pattern, tc.name), "%s %s", tc.pattern, tc.name)
+	}
+}
+
+func TestDiscoveryRefreshesOnUnknownModel(t *testing.T) {
+	defer func(d time.Duration) { discoveryMinRefresh = d }(discoveryMinRefresh)
+	discoveryMinRefresh = 0
+
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := NewRouter(
+		map[ConnectionID]IOllamaClient{"c1": c1},
+		map[ModelID]ModelConfig{"*": {ConnectionID: "c1"}},
+		WithDiscoveryInterval(Duration(time.Hour)),
+	)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	ctx := context.Background()
+	c1.On("List", mock.Anything).Return(&api.ListResponse{}, nil).Once()
+	r.discovery.refresh(ctx)
+	c1.On("List", mock.Anything).Return(&api.ListResponse{Models: []api.ListModelResponse{{Model: "smollm2:latest"}}}, nil)
+
+	// the request does not wait for the refresh, the model is found once the refresh ends
+	_, err = r.Show(ctx, &api.ShowRequest{Model: "smollm2"})
+	assert.EqualError(t, err, "gollamas router is missing a valid route to model smollm2")
+	assert.Eventually(t, func() bool { return r.discovery.lookup("smollm2") != nil }, time.Second, time.Millisecond)
+	req := &api.ShowRequest{Model: "smollm2:latest"}
+	c1.On("Show", ctx, req).Once().Return(&api.ShowResponse{}, nil)
+	_, err = r.Show(ctx, &api.ShowRequest{Model: "smollm2"})
+	assert.NoError(t, err)
+
+	c1.AssertExpectations(t)
+}
+
+func TestDiscoveryKeepsModelsOfFailingConnections(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := NewRouter(
+		map[ConnectionID]IOllamaClient{"c1": c1},
+		map[ModelID]ModelConfig{"*": {ConnectionID: "c1"}},
+		WithDiscoveryInterval(Duration(time.Hour)),
+	)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	ctx := context.Background()
+	c1.On("List", mock.Anything).Return(&api.ListResponse{Models: []api.ListModelResponse{{Model: "smollm2:latest"}}}, nil).Once()
+	r.discovery.refresh(ctx)
+	route := r.discovery.lookup("smollm2")
+	assert.NotNil(t, route)
+
+	c1.On("List", mock.Anything).Return(nil, api.StatusError{StatusCode: http.StatusBadGateway})
+	r.discovery.refresh(ctx)
+	assert.Same(t, route, r.discovery.lookup("smollm2"))
+}
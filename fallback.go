@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ollama/ollama/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// ModelHeader is the response header naming the model which answered the request.
+const ModelHeader = "X-Gollamas-Model"
+
+type servedModelKey struct{}
+
+// servedModel records the model which answered a request.
+type servedModel struct {
+	name atomic.Pointer[string]
+}
+
+// withServedModel returns a context in which the clients can report the model answering the request.
+func withServedModel(ctx context.Context) context.Context {
+	return context.WithValue(ctx, servedModelKey{}, &servedModel{})
+}
+
+// reportModel records the model a request is sent to, the last one reported answered the request.
+func reportModel(ctx context.Context, model string) {
+	if sm, ok := ctx.Value(servedModelKey{}).(*servedModel); ok {
+		sm.name.Store(&model)
+	}
+}
+
+// setModelHeader sets the response header naming the model which answered the request, if it was reported.
+func setModelHeader(c *gin.Context) {
+	sm, ok := c.Request.Context().Value(servedModelKey{}).(*servedModel)
+	if !ok {
+		return
+	}
+	if name := sm.name.Load(); name != nil {
+		c.Header(ModelHeader, *name)
+	}
+}
+
+// canFallback reports whether a request which failed with err can be sent to a fallback model,
+// that is when the connections are unavailable or when the model is missing from them.
+func canFallback(ctx context.Context, err error) bool {
+	if isRetryable(ctx, err) {
+		return true
+	}
+	var se api.StatusError
+	return errors.As(err, &se) && se.StatusCode == http.StatusNotFound
+}
+
+// modelCall sends a request for the model of the route to a connection, it returns the number of tokens used.
+type modelCall[T any] func(route *modelRoute, cl *connection, forwarded *atomic.Bool) (T, int, error)
+
+// callModels checks the limits of the client and sends the request to the route and, when it fails before anything
+// has been forwarded to the caller, to the fallback models of the route in order. The fallbacks of the fallback models
+// are not used, and neither are the ones the API key is not allowed to use or which are over the limits of the client.
+// The per model limits count the tokens of the model which answered.
+func callModels[T any](ctx context.Context, r *Router, route *modelRoute, call modelCall[T]) (T, error) {
+	done, err := r.admit(ctx, route)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	var tokens int
+	served := route.model
+	defer func() { done(tokens, served) }()
+
+	res, forwarded, err := callModel(ctx, route, call, &tokens)
+	for _, rt := range route.fallbacks {
+		if err == nil || forwarded || ctx.Err() != nil || !canFallback(ctx, err) {
+			break
+		}
+		logger := log.WithField("model_id", route.model).WithField("fallback_model_id", rt.model)
+		if err := r.authorize(ctx, rt.model.String()); err != nil {
+			logger.Info("Skipping a fallback model the api key is not allowed to use.")
+			continue
+		}
+		fallbackDone, limitErr := r.admitModel(ctx, rt)
+		if limitErr != nil {
+			logger.Info("Skipping a fallback model over the limits of the client.")
+			continue
+		}
+		logger.WithError(err).Warn("Request failed, falling back to another model.")
+		served = rt.model
+		res, forwarded, err = callModel(ctx, rt, call, &tokens)
+		fallbackDone(tokens, rt.model)
+	}
+	return res, err
+}
+
+// callModel sends the request to the connections of the route, it reports whether a response was forwarded to the caller.
+func callModel[T any](ctx context.Context, route *modelRoute, call modelCall[T], tokens *int) (T, bool, error) {
+	reportModel(ctx, route.model.String())
+	var forwarded atomic.Bool
+	res, err := queueRoute(ctx, route, func() (T, error) {
+		return callRoute(ctx, route, func(cl *connection, f *atomic.Bool) (T, error) {
+			requestInfoFromContext(ctx).attempt(route.model, cl.id)
+			res, n, err := call(route, cl, f)
+			*tokens = n
+			if f.Load() {
+				forwarded.Store(true)
+			}
+			return res, err
+		})
+	})
+	return res, forwarded.Load(), err
+}
+
+// setFallbacks resolves the fallback models of the routes, which are either concrete models or aliases.
+func (r *Router) setFallbacks(wildcards []*wildcardRoute) error {
+	for id, mc := range r.modelCfg {
+		var fallbacks []*modelRoute
+		for _, name := range mc.Fallbacks {
+			target, ok := r.all2ModelID[name]
+			if !ok {
+				target, ok = r.alias2model[name]
+			}
+			if !ok {
+				return fmt.Errorf("model %s falls back to unknown model %s", id, name)
+			}
+			if target == id {
+				return fmt.Errorf("model %s cannot fall back to itself", id)
+			}
+			fallbacks = append(fallbacks, r.routes[target])
+		}
+		if len(fallbacks) == 0 {
+			continue
+		}
+		if route, ok := r.routes[id]; ok {
+			route.fallbacks = fallbacks
+		}
+		for _, w := range wildcards {
+			if w.pattern == id {
+				w.fallbacks = fallbacks
+			}
+		}
+	}
+	return nil
+}
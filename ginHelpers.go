@@ -7,10 +7,14 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/ollama/ollama/api"
+	log "github.com/sirupsen/logrus"
 )
 
 func handleStreamRequest[T any, R any, F ~func(R) error](c *gin.Context, fn func(context.Context, *T, F) error) {
@@ -18,26 +22,69 @@ func handleStreamRequest[T any, R any, F ~func(R) error](c *gin.Context, fn func
 	if !BindRequest(c, &req) {
 		return
 	}
+	b, err := extractBoolPointerFromRequest(&req)
+	if err != nil {
+		abortGinError(c, err)
+		return
+	}
+	clientCtx := c.Request.Context()
+	ctx, cancel := context.WithCancel(withServedModel(clientCtx))
+	c.Request = c.Request.WithContext(ctx)
+	requestInfoFromContext(ctx).streamed(b == nil || *b)
 	ch := make(chan any)
 	go func() {
 		defer func(ch chan any) {
 			close(ch)
 		}(ch)
-		fn(c.Request.Context(), &req, func(pr R) error {
-			ch <- pr
-			return nil
-		})
+		// the upstream request is canceled once nobody reads the responses anymore
+		if err := fn(ctx, &req, func(pr R) error {
+			select {
+			case ch <- pr:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}); err != nil {
+			select {
+			case ch <- streamError{err}:
+			case <-ctx.Done():
+			}
+		}
 	}()
-	b, err := extractBoolPointerFromRequest(&req)
-	if err != nil {
-		abortGinError(c, err)
-		return
-	}
+	defer func() {
+		// the upstream request ends before the handler returns so that it is fully accounted for
+		cancel()
+		for range ch {
+		}
+	}()
+	var gone bool
 	if b != nil && !*b {
 		waitForStream(c, ch)
+	} else {
+		gone = streamResponse(c, ch)
+	}
+	if gone || clientCtx.Err() != nil {
+		requestInfoFromContext(ctx).cancel()
+		log.WithField("request_id", requestIDFromContext(ctx)).WithField("route", c.FullPath()).Info("Client disconnected, canceled the upstream request.")
+	}
+}
+
+// statusClientClosedRequest is the status logged for the requests whose client disconnected before the response.
+const statusClientClosedRequest = 499
+
+// abortStreamError returns the error which ended a stream before any response was sent.
+func abortStreamError(c *gin.Context, err error) {
+	// the context of the stream is only canceled before the end of the handler when the client is gone
+	if c.Request.Context().Err() != nil {
+		c.AbortWithStatus(statusClientClosedRequest)
 		return
 	}
-	streamResponse(c, ch)
+	abortGinError(c, err)
+}
+
+// streamError is the error which ended a stream, it is passed on as the last value of the stream.
+type streamError struct {
+	err error
 }
 
 // shamelessly copied from https://raw.githubusercontent.com/ollama/ollama/refs/tags/v0.5.11/server/routes.go
@@ -45,8 +92,12 @@ func waitForStream(c *gin.Context, ch chan interface{}) {
 	c.Header("Content-Type", "application/json")
 	for resp := range ch {
 		switch r := resp.(type) {
+		case streamError:
+			abortStreamError(c, r.err)
+			return
 		case api.ChatResponse:
 			if r.Done {
+				setModelHeader(c)
 				c.JSON(http.StatusOK, r)
 				return
 			}
@@ -57,6 +108,7 @@ func waitForStream(c *gin.Context, ch chan interface{}) {
 			}
 		case api.GenerateResponse:
 			if r.Done {
+				setModelHeader(c)
 				c.JSON(http.StatusOK, r)
 				return
 			}
@@ -77,17 +129,34 @@ func waitForStream(c *gin.Context, ch chan interface{}) {
 			return
 		}
 	}
-	c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected end of progress response"})
+	abortStreamError(c, NewHttpError(http.StatusInternalServerError, "unexpected end of progress response"))
 }
 
 // shamelessly copied from https://raw.githubusercontent.com/ollama/ollama/refs/tags/v0.5.11/server/routes.go
-func streamResponse(c *gin.Context, ch chan any) {
+// streamResponse reports whether the client disconnected before the end of the stream.
+func streamResponse(c *gin.Context, ch chan any) bool {
 	c.Header("Content-Type", "application/x-ndjson")
-	c.Stream(func(w io.Writer) bool {
+	first := true
+	return c.Stream(func(w io.Writer) bool {
 		val, ok := <-ch
 		if !ok {
 			return false
 		}
+		if se, ok := val.(streamError); ok {
+			if first {
+				// nothing was sent yet, the error is returned with its status code
+				c.Writer.Header().Del("Content-Type")
+				abortStreamError(c, se.err)
+				return false
+			}
+			// the status code is already sent, the error ends the stream like ollama does
+			val = gin.H{"error": errorMessage(se.err)}
+		}
+		if first {
+			// the model is reported before the first response is passed on
+			setModelHeader(c)
+			first = false
+		}
 
 		bts, err := json.Marshal(val)
 		if err != nil {
@@ -107,10 +176,33 @@ func streamResponse(c *gin.Context, ch chan any) {
 }
 
 func abortGinError(c *gin.Context, err error) {
+	var ra interface{ RetryAfter() time.Duration }
+	if errors.As(err, &ra) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(ra.RetryAfter().Seconds()))))
+	}
 	var httpErr *HttpError
 	if errors.As(err, &httpErr) {
 		c.AbortWithStatusJSON(httpErr.StatusCode(), gin.H{"error": httpErr.Error()})
 		return
 	}
+	// the errors of the connections are passed on with the status code returned by ollama
+	var se api.StatusError
+	if errors.As(err, &se) && se.StatusCode >= http.StatusBadRequest {
+		c.AbortWithStatusJSON(se.StatusCode, gin.H{"error": errorMessage(err)})
+		return
+	}
 	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 }
+
+// errorMessage returns the message of an error, without the status ollama prefixes its errors with.
+func errorMessage(err error) string {
+	var httpErr *HttpError
+	if errors.As(err, &httpErr) {
+		return httpErr.Error()
+	}
+	var se api.StatusError
+	if errors.As(err, &se) && se.ErrorMessage != "" {
+		return se.ErrorMessage
+	}
+	return err.Error()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHealthCheckTimeout = 5 * time.Second
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 3
+)
+
+// HealthCheckConfig configures the active health checks of the connections.
+// Health checks are disabled when Interval is zero.
+type HealthCheckConfig struct {
+	Interval Duration `json:"interval,omitempty" yaml:"interval,omitempty" toml:"interval,omitempty"`
+	// Timeout bounds each probe, defaults to 5s.
+	Timeout Duration `json:"timeout,omitempty" yaml:"timeout,omitempty" toml:"timeout,omitempty"`
+	// HealthyThreshold is the number of consecutive successful probes after which an unhealthy connection is used again, defaults to 2.
+	HealthyThreshold int `json:"healthy_threshold,omitempty" yaml:"healthy_threshold,omitempty" toml:"healthy_threshold,omitempty"`
+	// UnhealthyThreshold is the number of consecutive failed probes after which a connection is ejected, defaults to 3.
+	UnhealthyThreshold int `json:"unhealthy_threshold,omitempty" yaml:"unhealthy_threshold,omitempty" toml:"unhealthy_threshold,omitempty"`
+	// CheckVersion also queries /api/version, which fails when the server is up but ollama is not answering properly.
+	CheckVersion bool `json:"check_version,omitempty" yaml:"check_version,omitempty" toml:"check_version,omitempty"`
+}
+
+func (hc HealthCheckConfig) validate() error {
+	if hc.Interval < 0 {
+		return fmt.Errorf("invalid health check interval: %s", hc.Interval)
+	}
+	if hc.Timeout < 0 {
+		return fmt.Errorf("invalid health check timeout: %s", hc.Timeout)
+	}
+	if hc.HealthyThreshold < 0 {
+		return fmt.Errorf("invalid health check healthy threshold: %d", hc.HealthyThreshold)
+	}
+	if hc.UnhealthyThreshold < 0 {
+		return fmt.Errorf("invalid health check unhealthy threshold: %d", hc.UnhealthyThreshold)
+	}
+	return nil
+}
+
+func (hc HealthCheckConfig) withDefaults() HealthCheckConfig {
+	if hc.Timeout == 0 {
+		hc.Timeout = Duration(defaultHealthCheckTimeout)
+	}
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = defaultHealthyThreshold
+	}
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	return hc
+}
+
+// ConnectionHealth is the health state of a connection as reported by the health endpoint.
+type ConnectionHealth struct {
+	ConnectionID         ConnectionID `json:"connection_id"`
+	Healthy              bool         `json:"healthy"`
+	ConsecutiveFailures  int          `json:"consecutive_failures"`
+	ConsecutiveSuccesses int          `json:"consecutive_successes"`
+	LastCheck            *time.Time   `json:"last_check,omitempty"`
+	LastError            string       `json:"last_error,omitempty"`
+	InFlight             int64        `json:"in_flight"`
+	// Circuit is the state of the circuit breaker of the connection: closed, open or half-open.
+	Circuit string `json:"circuit"`
+	// Queue is the state of the queue of the connection, when its requests are limited.
+	Queue *QueueState `json:"queue,omitempty"`
+}
+
+type HealthResponse struct {
+	Connections []ConnectionHealth `json:"connections"`
+	Models      []WarmState        `json:"models,omitempty"`
+	Queues      []QueueState       `json:"queues,omitempty"`
+}
+
+// healthChecker probes the connections on an interval and ejects the ones failing repeatedly.
+type healthChecker struct {
+	cfg   HealthCheckConfig
+	conns []*connection
+	loop  *loop
+}
+
+func newHealthChecker(cfg HealthCheckConfig, conns []*connection) *healthChecker {
+	return &healthChecker{
+		cfg:   cfg.withDefaults(),
+		conns: conns,
+	}
+}
+
+func (hc *healthChecker) start() {
+	hc.loop = startLoop(time.Duration(hc.cfg.Interval), hc.checkAll)
+}
+
+func (hc *healthChecker) stop() {
+	hc.loop.stop()
+}
+
+func (hc *healthChecker) checkAll(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, c := range hc.conns {
+		wg.Add(1)
+		go func(c *connection) {
+			defer wg.Done()
+			err := hc.probe(ctx, c)
+			if ctx.Err() != nil {
+				// the checker is stopping, the result says nothing about the connection
+				return
+			}
+			c.recordCheck(err, time.Now(), hc.cfg.HealthyThreshold, hc.cfg.UnhealthyThreshold)
+		}(c)
+	}
+	wg.Wait()
+}
+
+func (hc *healthChecker) probe(ctx context.Context, c *connection) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(hc.cfg.Timeout))
+	defer cancel()
+	if err := c.Heartbeat(ctx); err != nil {
+		return err
+	}
+	if hc.cfg.CheckVersion {
+		if _, err := c.Version(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordCheck updates the health state of the connection with the result of a probe.
+func (c *connection) recordCheck(err error, at time.Time, healthyThreshold, unhealthyThreshold int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.health.LastCheck = &at
+	if err != nil {
+		c.health.LastError = err.Error()
+		c.health.ConsecutiveFailures++
+		c.health.ConsecutiveSuccesses = 0
+		if !c.unhealthy.Load() && c.health.ConsecutiveFailures >= unhealthyThreshold {
+			c.unhealthy.Store(true)
+			log.WithField("connection_id", c.id).WithField("failures", c.health.ConsecutiveFailures).WithError(err).Warn("Connection is unhealthy.")
+		} else {
+			log.WithField("connection_id", c.id).WithError(err).Debug("Health check failed.")
+		}
+		return
+	}
+	c.health.LastError = ""
+	c.health.ConsecutiveSuccesses++
+	c.health.ConsecutiveFailures = 0
+	if c.unhealthy.Load() && c.health.ConsecutiveSuccesses >= healthyThreshold {
+		c.unhealthy.Store(false)
+		log.WithField("connection_id", c.id).Info("Connection is healthy again.")
+		if c.onRecover != nil {
+			c.onRecover()
+		}
+	}
+}
+
+func (c *connection) Health() ConnectionHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.health
+	h.ConnectionID = c.id
+	h.Healthy = c.Healthy()
+	h.InFlight = c.InFlight()
+	h.Circuit = c.breaker.State().String()
+	if c.queue != nil {
+		qs := c.queue.State()
+		h.Queue = &qs
+	}
+	return h
+}
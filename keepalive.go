@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ollama/ollama/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// KeepAliveConfig sets how long the models stay loaded after the requests forwarded to the connections,
+// a negative duration keeps the models loaded and zero unloads them straight away.
+type KeepAliveConfig struct {
+	// Default is used for the requests which do not set keep_alive.
+	Default *Duration `json:"default,omitempty" yaml:"default,omitempty" toml:"default,omitempty"`
+	// Override replaces the keep_alive of every request.
+	Override *Duration `json:"override,omitempty" yaml:"override,omitempty" toml:"override,omitempty"`
+}
+
+func (kc KeepAliveConfig) IsZero() bool {
+	return kc.Default == nil && kc.Override == nil
+}
+
+// merge fills the settings missing from the configuration with the ones of a less specific configuration.
+func (kc KeepAliveConfig) merge(def KeepAliveConfig) KeepAliveConfig {
+	if kc.Default == nil {
+		kc.Default = def.Default
+	}
+	if kc.Override == nil {
+		kc.Override = def.Override
+	}
+	return kc
+}
+
+// apply returns the keep_alive forwarded for a request which sent requested.
+func (kc KeepAliveConfig) apply(requested *api.Duration) *api.Duration {
+	switch {
+	case kc.Override != nil:
+		return &api.Duration{Duration: time.Duration(*kc.Override)}
+	case requested == nil && kc.Default != nil:
+		return &api.Duration{Duration: time.Duration(*kc.Default)}
+	}
+	return requested
+}
+
+// keepAlive returns the keep_alive of a request for the model sent to the connection,
+// the settings of the model take precedence over the ones of the connection and then the global ones.
+func (r *Router) keepAlive(route *modelRoute, cl *connection, requested *api.Duration) *api.Duration {
+	kc := route.keepAlive.merge(cl.keepAlive).merge(r.defaultKeepAlive)
+	res := kc.apply(requested)
+	if res != requested {
+		log.WithField("model_id", route.model).WithField("connection_id", cl.id).WithField("keep_alive", res.Duration).Debug("Routing: set keep alive.")
+	}
+	return res
+}
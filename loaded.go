@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+const (
+	defaultPreferLoadedInterval = 30 * time.Second
+	// defaultKeepAlive is how long ollama keeps a model loaded after a request which does not set keep_alive.
+	defaultKeepAlive = 5 * time.Minute
+)
+
+// residency keeps track of the models loaded in memory on each connection,
+// refreshed from /api/ps and updated from the requests served in between.
+type residency struct {
+	mu     sync.RWMutex
+	loaded map[ConnectionID]map[string]time.Time
+	now    func() time.Time
+}
+
+func newResidency() *residency {
+	return &residency{
+		loaded: map[ConnectionID]map[string]time.Time{},
+		now:    time.Now,
+	}
+}
+
+// update replaces the models loaded on the connection with the ones listed by /api/ps.
+func (rs *residency) update(cid ConnectionID, models []api.ProcessModelResponse) {
+	if rs == nil {
+		return
+	}
+	loaded := make(map[string]time.Time, len(models))
+	for _, m := range models {
+		expires := m.ExpiresAt
+		if expires.IsZero() {
+			expires = rs.now().Add(defaultKeepAlive)
+		}
+		loaded[modelKey(m.Model)] = expires
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.loaded[cid] = loaded
+}
+
+// served records that the model served a request on the connection, it stays loaded for the keep alive of the request.
+func (rs *residency) served(cid ConnectionID, model ModelID, keepAlive *api.Duration) {
+	if rs == nil {
+		return
+	}
+	ttl := defaultKeepAlive
+	if keepAlive != nil {
+		ttl = keepAlive.Duration
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	key := modelKey(model.String())
+	switch {
+	case ttl == 0:
+		// the model is unloaded straight away
+		delete(rs.loaded[cid], key)
+		return
+	case ttl < 0:
+		// the model stays loaded until the server needs the memory, until the next refresh tells otherwise
+		ttl = time.Duration(1<<63 - 1)
+	}
+	if rs.loaded[cid] == nil {
+		rs.loaded[cid] = map[string]time.Time{}
+	}
+	expires := rs.now().Add(ttl)
+	if expires.After(rs.loaded[cid][key]) {
+		rs.loaded[cid][key] = expires
+	}
+}
+
+// isLoaded reports whether the model is currently loaded on the connection.
+func (rs *residency) isLoaded(cid ConnectionID, model ModelID) bool {
+	if rs == nil {
+		return false
+	}
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	expires, ok := rs.loaded[cid][modelKey(model.String())]
+	return ok && rs.now().Before(expires)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResidency(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rs := newResidency()
+	rs.now = func() time.Time { return now }
+
+	rs.update("c1", []api.ProcessModelResponse{
+		{Model: "llama3.2:latest", ExpiresAt: now.Add(time.Minute)},
+		{Model: "qwen2.5:7b", ExpiresAt: now.Add(-time.Second)},
+	})
+	assert.True(t, rs.isLoaded("c1", "llama3.2"))
+	assert.True(t, rs.isLoaded("c1", "llama3.2:latest"))
+	assert.False(t, rs.isLoaded("c1", "qwen2.5:7b"), "expired")
+	assert.False(t, rs.isLoaded("c2", "llama3.2"))
+
+	// served requests keep the model loaded for their keep alive
+	rs.served("c2", "llama3.2", nil)
+	assert.True(t, rs.isLoaded("c2", "llama3.2"))
+	rs.served("c2", "qwen2.5:7b", &api.Duration{Duration: time.Second})
+	now = now.Add(2 * time.Second)
+	assert.False(t, rs.isLoaded("c2", "qwen2.5:7b"))
+	assert.True(t, rs.isLoaded("c2", "llama3.2"))
+	rs.served("c2", "mistral", &api.Duration{Duration: -1})
+	now = now.Add(24 * time.Hour)
+	assert.True(t, rs.isLoaded("c2", "mistral"))
+	rs.served("c2", "mistral", &api.Duration{})
+	assert.False(t, rs.isLoaded("c2", "mistral"), "unloaded")
+
+	// the refresh replaces the models of the connection
+	rs.update("c1", nil)
+	assert.False(t, rs.isLoaded("c1", "llama3.2"))
+
+	var disabled *residency
+	disabled.served("c1", "llama3.2", nil)
+	assert.False(t, disabled.isLoaded("c1", "llama3.2"))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// loop runs a background task right away and then on each interval, until stopped.
+type loop struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func startLoop(interval time.Duration, fn func(ctx context.Context)) *loop {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &loop{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(l.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			fn(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return l
+}
+
+// stop cancels the task and waits for it to return.
+func (l *loop) stop() {
+	if l == nil {
+		return
+	}
+	l.cancel()
+	<-l.done
+}
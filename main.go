@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v3"
@@ -44,6 +48,16 @@ func runCli(appName string) error {
 		Action:  runGollamasCli,
 		Usage:   "A router for golama models",
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   `loads the connections, models and aliases from a yaml, toml or json file, flags and environment variables take precedence over the file. ex: --config /etc/gollamas/config.yaml`,
+				Sources: cli.EnvVars("GOLLAMAS_CONFIG"),
+			},
+			&cli.BoolFlag{
+				Name:    "watch-config",
+				Usage:   `reloads the config file whenever it changes, the configuration is also reloaded on SIGHUP`,
+				Sources: cli.EnvVars("GOLLAMAS_WATCH_CONFIG"),
+			},
 			&cli.StringFlag{
 				Name:    "listen",
 				Value:   "localhost:11434",
@@ -51,6 +65,46 @@ func runCli(appName string) error {
 				Aliases: []string{"a", "addr", "address"},
 				Sources: cli.EnvVars("GOLLAMAS_LISTEN", "LISTEN"),
 			},
+			&cli.StringFlag{
+				Name:    "metrics-listen",
+				Usage:   `address of a separate listener serving the prometheus metrics on /metrics without authentication, the metrics are served on the main listener as well. ex: --metrics-listen :9090`,
+				Sources: cli.EnvVars("GOLLAMAS_METRICS_LISTEN"),
+			},
+			&cli.DurationFlag{
+				Name:    "shutdown-delay",
+				Usage:   `keeps serving the requests for this long once the router reports it is not ready on SIGTERM or SIGINT, while the load balancers stop sending it requests, disabled by default`,
+				Sources: cli.EnvVars("GOLLAMAS_SHUTDOWN_DELAY"),
+			},
+			&cli.DurationFlag{
+				Name:    "drain-timeout",
+				Usage:   `maximum wait for the requests in flight once the router stops accepting requests, the requests still in flight are canceled after it (default: 20s)`,
+				Sources: cli.EnvVars("GOLLAMAS_DRAIN_TIMEOUT"),
+			},
+			&cli.StringFlag{
+				Name:    "otlp-endpoint",
+				Usage:   `url of the OTLP/HTTP endpoint to which the traces are exported, the traces are not exported when empty. ex: --otlp-endpoint http://localhost:4318`,
+				Sources: cli.EnvVars("GOLLAMAS_OTLP_ENDPOINT"),
+			},
+			&cli.FloatFlag{
+				Name:    "trace-sample-ratio",
+				Usage:   `share of the traces started by the router which are exported, between 0 and 1, defaults to 1. The traces started by the clients follow their sampling decision`,
+				Sources: cli.EnvVars("GOLLAMAS_TRACE_SAMPLE_RATIO"),
+			},
+			&cli.StringFlag{
+				Name:    "tls-cert",
+				Usage:   `PEM encoded certificate chain served by the listener, enables TLS with --tls-key. The certificates are reloaded when their files change`,
+				Sources: cli.EnvVars("GOLLAMAS_TLS_CERT"),
+			},
+			&cli.StringFlag{
+				Name:    "tls-key",
+				Usage:   `PEM encoded private key of the --tls-cert certificate`,
+				Sources: cli.EnvVars("GOLLAMAS_TLS_KEY"),
+			},
+			&cli.StringFlag{
+				Name:    "tls-client-ca",
+				Usage:   `PEM encoded CA certificates enabling mutual TLS, the clients must present a certificate signed by one of them, except on /, /healthz and /readyz`,
+				Sources: cli.EnvVars("GOLLAMAS_TLS_CLIENT_CA"),
+			},
 			&cli.StringFlag{
 				Name:  "level",
 				Value: log.ErrorLevel.String(),
@@ -100,6 +154,146 @@ func runCli(appName string) error {
 				Usage:   `exposes aliases in the router`,
 				Sources: cli.EnvVars("GOLLAMAS_LIST_ALIASES", "LIST_ALIASES"),
 			},
+			&cli.StringFlag{
+				Name:    "balancer",
+				Usage:   fmt.Sprintf(`default strategy used to pick a connection for models served by several connections, can be any of "%s" (default: "%s"). ex: --proxy llama3.2=c1 --proxy llama3.2=c2 --balancer least-outstanding`, strings.Join(BalancerNames(), `", "`), RoundRobinBalancer),
+				Sources: cli.EnvVars("GOLLAMAS_BALANCER"),
+			},
+			&cli.DurationFlag{
+				Name:    "health-check-interval",
+				Usage:   `probes each connection on the given interval, unhealthy connections are skipped for models served by several connections, disabled when empty. ex: --health-check-interval 10s`,
+				Sources: cli.EnvVars("GOLLAMAS_HEALTH_CHECK_INTERVAL"),
+			},
+			&cli.DurationFlag{
+				Name:    "health-check-timeout",
+				Usage:   `timeout of each health check probe (default: 5s)`,
+				Sources: cli.EnvVars("GOLLAMAS_HEALTH_CHECK_TIMEOUT"),
+			},
+			&cli.IntFlag{
+				Name:    "health-check-healthy-threshold",
+				Usage:   fmt.Sprintf(`number of consecutive successful probes after which an unhealthy connection is used again (default: %d)`, defaultHealthyThreshold),
+				Sources: cli.EnvVars("GOLLAMAS_HEALTH_CHECK_HEALTHY_THRESHOLD"),
+			},
+			&cli.IntFlag{
+				Name:    "health-check-unhealthy-threshold",
+				Usage:   fmt.Sprintf(`number of consecutive failed probes after which a connection is marked unhealthy (default: %d)`, defaultUnhealthyThreshold),
+				Sources: cli.EnvVars("GOLLAMAS_HEALTH_CHECK_UNHEALTHY_THRESHOLD"),
+			},
+			&cli.BoolFlag{
+				Name:    "health-check-version",
+				Usage:   `also queries /api/version when probing connections`,
+				Sources: cli.EnvVars("GOLLAMAS_HEALTH_CHECK_VERSION"),
+			},
+			&cli.IntFlag{
+				Name:    "retry-max-attempts",
+				Usage:   `maximum number of connections tried for a request when a model is served by several connections, requests are never retried once a response has been streamed back. ex: --retry-max-attempts 3`,
+				Sources: cli.EnvVars("GOLLAMAS_RETRY_MAX_ATTEMPTS"),
+			},
+			&cli.DurationFlag{
+				Name:    "retry-backoff",
+				Usage:   fmt.Sprintf(`wait before the first retry, doubled on each retry (default: %s)`, defaultRetryBackoff),
+				Sources: cli.EnvVars("GOLLAMAS_RETRY_BACKOFF"),
+			},
+			&cli.FloatFlag{
+				Name:    "circuit-breaker-failure-ratio",
+				Usage:   `opens the circuit breaker of a connection when the ratio of failed or slow requests reaches this value, requests to the connection then fail fast or go to the other connections of the model, disabled when empty. ex: --circuit-breaker-failure-ratio 0.5`,
+				Sources: cli.EnvVars("GOLLAMAS_CIRCUIT_BREAKER_FAILURE_RATIO"),
+			},
+			&cli.DurationFlag{
+				Name:    "circuit-breaker-open-duration",
+				Usage:   fmt.Sprintf(`how long a circuit breaker stays open before probe requests are sent to the connection (default: %s)`, defaultBreakerOpenDuration),
+				Sources: cli.EnvVars("GOLLAMAS_CIRCUIT_BREAKER_OPEN_DURATION"),
+			},
+			&cli.DurationFlag{
+				Name:    "circuit-breaker-slow-call-duration",
+				Usage:   `counts the requests waiting longer than this for their first response as failures, disabled when empty. ex: --circuit-breaker-slow-call-duration 30s`,
+				Sources: cli.EnvVars("GOLLAMAS_CIRCUIT_BREAKER_SLOW_CALL_DURATION"),
+			},
+			&cli.DurationFlag{
+				Name:    "discovery-interval",
+				Usage:   fmt.Sprintf(`interval at which the models matching wildcard routes such as --proxy '*=c1' or --proxy 'llama*=c2' are refreshed (default: %s)`, defaultDiscoveryInterval),
+				Sources: cli.EnvVars("GOLLAMAS_DISCOVERY_INTERVAL"),
+			},
+			&cli.BoolFlag{
+				Name:    "prefer-loaded",
+				Usage:   `routes the requests for a model served by several connections to the connections which already have it loaded, as listed by /api/ps`,
+				Sources: cli.EnvVars("GOLLAMAS_PREFER_LOADED"),
+			},
+			&cli.DurationFlag{
+				Name:    "prefer-loaded-interval",
+				Usage:   fmt.Sprintf(`interval at which the models loaded on each connection are refreshed when --prefer-loaded is set (default: %s)`, defaultPreferLoadedInterval),
+				Sources: cli.EnvVars("GOLLAMAS_PREFER_LOADED_INTERVAL"),
+			},
+			&cli.DurationFlag{
+				Name:    "keep-warm-interval",
+				Usage:   fmt.Sprintf(`interval at which the models with keep_warm set in the config file are checked and pinged before they expire (default: %s)`, defaultKeepWarmInterval),
+				Sources: cli.EnvVars("GOLLAMAS_KEEP_WARM_INTERVAL"),
+			},
+			&cli.DurationFlag{
+				Name:    "keep-alive",
+				Usage:   `keep_alive of the requests which do not set one, a negative value keeps the models loaded. ex: --keep-alive 1h`,
+				Sources: cli.EnvVars("GOLLAMAS_KEEP_ALIVE"),
+			},
+			&cli.DurationFlag{
+				Name:    "keep-alive-override",
+				Usage:   `replaces the keep_alive of every request, a negative value keeps the models loaded. ex: --keep-alive-override -1s`,
+				Sources: cli.EnvVars("GOLLAMAS_KEEP_ALIVE_OVERRIDE"),
+			},
+			&cli.StringFlag{
+				Name:    "api-keys-file",
+				Usage:   `loads the api keys accepted by the router, and the models each of them may use, from the api_keys section of a yaml, toml or json file, requests are authenticated when keys are set. ex: --api-keys-file /etc/gollamas/keys.yaml`,
+				Sources: cli.EnvVars("GOLLAMAS_API_KEYS_FILE"),
+			},
+			&cli.IntFlag{
+				Name:    "rate-limit-requests-per-minute",
+				Usage:   `maximum number of requests per minute of each client, identified by its api key or else its ip address, disabled when empty. ex: --rate-limit-requests-per-minute 60`,
+				Sources: cli.EnvVars("GOLLAMAS_RATE_LIMIT_REQUESTS_PER_MINUTE"),
+			},
+			&cli.IntFlag{
+				Name:    "rate-limit-concurrency",
+				Usage:   `maximum number of requests of each client in flight at once, disabled when empty. ex: --rate-limit-concurrency 4`,
+				Sources: cli.EnvVars("GOLLAMAS_RATE_LIMIT_CONCURRENCY"),
+			},
+			&cli.IntFlag{
+				Name:    "rate-limit-tokens-per-day",
+				Usage:   `maximum number of prompt and generated tokens of each client per day, disabled when empty. ex: --rate-limit-tokens-per-day 1000000`,
+				Sources: cli.EnvVars("GOLLAMAS_RATE_LIMIT_TOKENS_PER_DAY"),
+			},
+			&cli.IntFlag{
+				Name:    "rate-limit-tokens-per-month",
+				Usage:   `maximum number of prompt and generated tokens of each client per month, disabled when empty. ex: --rate-limit-tokens-per-month 20000000`,
+				Sources: cli.EnvVars("GOLLAMAS_RATE_LIMIT_TOKENS_PER_MONTH"),
+			},
+			&cli.IntFlag{
+				Name:    "queue-concurrency",
+				Usage:   `maximum number of requests in flight to each connection, the other requests wait in a queue, disabled when empty. ex: --queue-concurrency 4`,
+				Sources: cli.EnvVars("GOLLAMAS_QUEUE_CONCURRENCY"),
+			},
+			&cli.IntFlag{
+				Name:    "queue-max-depth",
+				Usage:   `maximum number of requests waiting in the queue of each connection, the requests over it are rejected with 503, 0 rejects them right away, not bounded when empty. ex: --queue-max-depth 32`,
+				Sources: cli.EnvVars("GOLLAMAS_QUEUE_MAX_DEPTH"),
+			},
+			&cli.DurationFlag{
+				Name:    "queue-max-wait",
+				Usage:   `how long a request waits in the queue of a connection before it is rejected with 503, requests wait as long as their client when empty. ex: --queue-max-wait 30s`,
+				Sources: cli.EnvVars("GOLLAMAS_QUEUE_MAX_WAIT"),
+			},
+			&cli.IntFlag{
+				Name:    "ready-min-connections",
+				Usage:   fmt.Sprintf(`number of connections which must be reachable for /readyz to report the router ready (default: %d)`, defaultReadyMinConnections),
+				Sources: cli.EnvVars("GOLLAMAS_READY_MIN_CONNECTIONS"),
+			},
+			&cli.StringFlag{
+				Name:    "ready-required-models",
+				Usage:   `models which must be available on a reachable connection for /readyz to report the router ready. ex: --ready-required-models 'llama3.2,deepseek-r1:14b'`,
+				Sources: cli.EnvVars("GOLLAMAS_READY_REQUIRED_MODELS"),
+			},
+			&cli.DurationFlag{
+				Name:    "ready-cache-ttl",
+				Usage:   `how long /readyz reuses the checks of the connections (default: 5s)`,
+				Sources: cli.EnvVars("GOLLAMAS_READY_CACHE_TTL"),
+			},
 		},
 		Commands: []*cli.Command{
 			getVersionCommand(),
@@ -129,20 +323,28 @@ func initConnectionsConfig(ss []string) (map[ConnectionID]ConnectionConfig, erro
 		if len(v) != 2 {
 			return nil, fmt.Errorf("invalid connection string: %s", s)
 		}
-		if v[0] == "" {
-			return nil, fmt.Errorf("empty connection id in %s", s)
-		}
-		if v[1] == "" {
-			return nil, fmt.Errorf("empty connection destination in %s", s)
-		}
-		res[ConnectionID(v[0])] = ConnectionConfig{
-			ConnectionID: ConnectionID(v[0]),
-			Url:          v[1],
+		c, err := newConnectionConfig(s, v[0], v[1])
+		if err != nil {
+			return nil, err
 		}
+		res[c.ConnectionID] = c
 	}
 	return res, nil
 }
 
+func newConnectionConfig(s, id, dest string) (ConnectionConfig, error) {
+	if id == "" {
+		return ConnectionConfig{}, fmt.Errorf("empty connection id in %s", s)
+	}
+	if dest == "" {
+		return ConnectionConfig{}, fmt.Errorf("empty connection destination in %s", s)
+	}
+	return ConnectionConfig{
+		ConnectionID: ConnectionID(id),
+		Url:          dest,
+	}, nil
+}
+
 func initProxyConfig(ss []string) (map[ModelID]ModelConfig, error) {
 	res := map[ModelID]ModelConfig{}
 	log.WithField("strings", ss).Trace("Initialize proxy configuration.")
@@ -154,19 +356,32 @@ func initProxyConfig(ss []string) (map[ModelID]ModelConfig, error) {
 		if len(v) != 2 {
 			return nil, fmt.Errorf("invalid proxy string: %s", s)
 		}
-		if v[0] == "" {
-			return nil, fmt.Errorf("empty proxy model in %s", s)
+		id, mc, err := newProxyConfig(s, v[0], v[1])
+		if err != nil {
+			return nil, err
 		}
-		if v[1] == "" {
-			return nil, fmt.Errorf("empty proxy destination in %s", s)
-		}
-		res[ModelID(v[0])] = ModelConfig{
-			ConnectionID: ConnectionID(v[1]),
+		// a model given several destinations is served by all of them
+		if prev, ok := res[id]; ok {
+			prev.Connections = append(prev.Connections, mc.ConnectionID)
+			mc = prev
 		}
+		res[id] = mc
 	}
 	return res, nil
 }
 
+func newProxyConfig(s, model, dest string) (ModelID, ModelConfig, error) {
+	if model == "" {
+		return "", ModelConfig{}, fmt.Errorf("empty proxy model in %s", s)
+	}
+	if dest == "" {
+		return "", ModelConfig{}, fmt.Errorf("empty proxy destination in %s", s)
+	}
+	return ModelID(model), ModelConfig{
+		ConnectionID: ConnectionID(dest),
+	}, nil
+}
+
 func initAliasesMap(ss []string) (map[ModelID]ModelID, error) {
 	aliases := map[ModelID]ModelID{}
 	log.WithField("aliases", aliases).Trace("Initialize aliases.")
@@ -178,17 +393,24 @@ func initAliasesMap(ss []string) (map[ModelID]ModelID, error) {
 		if len(v) != 2 {
 			return nil, fmt.Errorf("invalid alias string: %s", s)
 		}
-		if v[0] == "" {
-			return nil, fmt.Errorf("empty alias name in: %s", s)
-		}
-		if v[1] == "" {
-			return nil, fmt.Errorf("empty alias model in: %s", s)
+		if err := validateAlias(s, v[0], v[1]); err != nil {
+			return nil, err
 		}
 		aliases[ModelID(v[0])] = ModelID(v[1])
 	}
 	return aliases, nil
 }
 
+func validateAlias(s, alias, model string) error {
+	if alias == "" {
+		return fmt.Errorf("empty alias name in: %s", s)
+	}
+	if model == "" {
+		return fmt.Errorf("empty alias model in: %s", s)
+	}
+	return nil
+}
+
 func runGollamasCli(ctx context.Context, cli *cli.Command) error {
 	if err := initErrorLevel(cli.String("level")); err != nil {
 		return err
@@ -200,7 +422,9 @@ func runGollamasCli(ctx context.Context, cli *cli.Command) error {
 	if err != nil {
 		return fmt.Errorf("could not initialize gollamas config: %w", err)
 	}
-	return runGollamas(*cfg)
+	return runGollamas(ctx, *cfg, func() (*GollamasConfig, error) {
+		return getGollamasConfig(cli)
+	})
 }
 
 func getAliasesMap(cli *cli.Command) (map[ModelID]ModelID, error) {
@@ -211,6 +435,16 @@ func getAliasesMap(cli *cli.Command) (map[ModelID]ModelID, error) {
 	return initAliasesMap(p)
 }
 
+func getRequiredModels(cli *cli.Command) []ModelID {
+	var models []ModelID
+	for _, m := range strings.Split(cli.String("ready-required-models"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			models = append(models, ModelID(m))
+		}
+	}
+	return models
+}
+
 func getConnectionsConfig(cli *cli.Command) (map[ConnectionID]ConnectionConfig, error) {
 	p := append([]string{}, cli.StringSlice("connection")...)
 	if cli.String("connections") != "" {
@@ -228,6 +462,10 @@ func getProxyConfig(cli *cli.Command) (map[ModelID]ModelConfig, error) {
 }
 
 func getGollamasConfig(cli *cli.Command) (*GollamasConfig, error) {
+	cf, err := getConfigFile(cli)
+	if err != nil {
+		return nil, err
+	}
 	aliases, err := getAliasesMap(cli)
 	if err != nil {
 		return nil, err
@@ -240,24 +478,118 @@ func getGollamasConfig(cli *cli.Command) (*GollamasConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &GollamasConfig{
-		Listen:      cli.String("listen"),
-		Models:      pConf,
-		Aliases:     aliases,
-		ListAliases: cli.Bool("list-aliases"),
-		Connections: cmap,
-	}, nil
+	cfg := &GollamasConfig{
+		ConfigFile:    cli.String("config"),
+		WatchConfig:   cli.Bool("watch-config"),
+		Listen:        cli.String("listen"),
+		MetricsListen: cli.String("metrics-listen"),
+		Models:        pConf,
+		Aliases:       aliases,
+		ListAliases:   cli.Bool("list-aliases"),
+		Connections:   cmap,
+		Balancer:      cli.String("balancer"),
+		HealthCheck: HealthCheckConfig{
+			Interval:           Duration(cli.Duration("health-check-interval")),
+			Timeout:            Duration(cli.Duration("health-check-timeout")),
+			HealthyThreshold:   cli.Int("health-check-healthy-threshold"),
+			UnhealthyThreshold: cli.Int("health-check-unhealthy-threshold"),
+			CheckVersion:       cli.Bool("health-check-version"),
+		},
+		Retry: RetryConfig{
+			MaxAttempts: cli.Int("retry-max-attempts"),
+			Backoff:     Duration(cli.Duration("retry-backoff")),
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			FailureRatio:     cli.Float("circuit-breaker-failure-ratio"),
+			OpenDuration:     Duration(cli.Duration("circuit-breaker-open-duration")),
+			SlowCallDuration: Duration(cli.Duration("circuit-breaker-slow-call-duration")),
+		},
+		DiscoveryInterval:    Duration(cli.Duration("discovery-interval")),
+		PreferLoaded:         cli.Bool("prefer-loaded"),
+		PreferLoadedInterval: Duration(cli.Duration("prefer-loaded-interval")),
+		KeepWarmInterval:     Duration(cli.Duration("keep-warm-interval")),
+		KeepAlive: KeepAliveConfig{
+			Default:  optionalDuration(cli, "keep-alive"),
+			Override: optionalDuration(cli, "keep-alive-override"),
+		},
+		APIKeysFile: cli.String("api-keys-file"),
+		RateLimit: RateLimitConfig{
+			RequestsPerMinute: cli.Int("rate-limit-requests-per-minute"),
+			Concurrency:       cli.Int("rate-limit-concurrency"),
+			TokensPerDay:      cli.Int("rate-limit-tokens-per-day"),
+			TokensPerMonth:    cli.Int("rate-limit-tokens-per-month"),
+		},
+		Queue: QueueConfig{
+			Concurrency: cli.Int("queue-concurrency"),
+			MaxDepth:    optionalInt(cli, "queue-max-depth"),
+			MaxWait:     Duration(cli.Duration("queue-max-wait")),
+		},
+		Readiness: ReadinessConfig{
+			MinConnections: cli.Int("ready-min-connections"),
+			RequiredModels: getRequiredModels(cli),
+			CacheTTL:       Duration(cli.Duration("ready-cache-ttl")),
+		},
+		Shutdown: ShutdownConfig{
+			Delay:        Duration(cli.Duration("shutdown-delay")),
+			DrainTimeout: Duration(cli.Duration("drain-timeout")),
+		},
+		Tracing: TracingConfig{
+			OTLPEndpoint: cli.String("otlp-endpoint"),
+			SampleRatio:  cli.Float("trace-sample-ratio"),
+		},
+		TLS: TLSConfig{
+			CertFile:     cli.String("tls-cert"),
+			KeyFile:      cli.String("tls-key"),
+			ClientCAFile: cli.String("tls-client-ca"),
+		},
+	}
+	if cf == nil {
+		return cfg, nil
+	}
+	return cf.overlay(cli, cfg)
 }
 
 type GollamasConfig struct {
-	Listen      string
-	Connections map[ConnectionID]ConnectionConfig
-	Models      map[ModelID]ModelConfig
-	Aliases     map[ModelID]ModelID
-	ListAliases bool
+	Listen               string                            `json:"listen" yaml:"listen" toml:"listen"`
+	MetricsListen        string                            `json:"metrics_listen" yaml:"metrics_listen" toml:"metrics_listen"`
+	Connections          map[ConnectionID]ConnectionConfig `json:"connections" yaml:"connections" toml:"connections"`
+	Models               map[ModelID]ModelConfig           `json:"models" yaml:"models" toml:"models"`
+	Aliases              map[ModelID]ModelID               `json:"aliases" yaml:"aliases" toml:"aliases"`
+	Presets              map[ModelID]PresetConfig          `json:"presets" yaml:"presets" toml:"presets"`
+	ListAliases          bool                              `json:"list_aliases" yaml:"list_aliases" toml:"list_aliases"`
+	Balancer             string                            `json:"balancer" yaml:"balancer" toml:"balancer"`
+	HealthCheck          HealthCheckConfig                 `json:"health_check" yaml:"health_check" toml:"health_check"`
+	Retry                RetryConfig                       `json:"retry" yaml:"retry" toml:"retry"`
+	CircuitBreaker       CircuitBreakerConfig              `json:"circuit_breaker" yaml:"circuit_breaker" toml:"circuit_breaker"`
+	DiscoveryInterval    Duration                          `json:"discovery_interval" yaml:"discovery_interval" toml:"discovery_interval"`
+	PreferLoaded         bool                              `json:"prefer_loaded" yaml:"prefer_loaded" toml:"prefer_loaded"`
+	PreferLoadedInterval Duration                          `json:"prefer_loaded_interval" yaml:"prefer_loaded_interval" toml:"prefer_loaded_interval"`
+	KeepWarmInterval     Duration                          `json:"keep_warm_interval" yaml:"keep_warm_interval" toml:"keep_warm_interval"`
+	KeepAlive            KeepAliveConfig                   `json:"keep_alive" yaml:"keep_alive" toml:"keep_alive"`
+	Options              OptionsPolicy                     `json:"options" yaml:"options" toml:"options"`
+	APIKeys              []APIKeyConfig                    `json:"api_keys" yaml:"api_keys" toml:"api_keys"`
+	RateLimit            RateLimitConfig                   `json:"rate_limit" yaml:"rate_limit" toml:"rate_limit"`
+	Queue                QueueConfig                       `json:"queue" yaml:"queue" toml:"queue"`
+	Readiness            ReadinessConfig                   `json:"readiness" yaml:"readiness" toml:"readiness"`
+	Shutdown             ShutdownConfig                    `json:"shutdown" yaml:"shutdown" toml:"shutdown"`
+	Tracing              TracingConfig                     `json:"tracing" yaml:"tracing" toml:"tracing"`
+	TLS                  TLSConfig                         `json:"tls" yaml:"tls" toml:"tls"`
+	APIKeysFile          string                            `json:"api_keys_file" yaml:"api_keys_file" toml:"api_keys_file"`
+	ConfigFile           string                            `json:"-" yaml:"-" toml:"-"`
+	WatchConfig          bool                              `json:"-" yaml:"-" toml:"-"`
 }
 
 func InitService(cfg GollamasConfig) (*Service, error) {
+	r, err := InitRouter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewService(r)
+}
+
+// InitRouter validates the configuration and builds the router with its connections.
+func InitRouter(cfg GollamasConfig) (*Router, error) {
 	cconf, pconf, err := reconcileConnectionsAndProxyConfigs(cfg.Connections, cfg.Models)
 	if err != nil {
 		return nil, err
@@ -270,26 +602,134 @@ func InitService(cfg GollamasConfig) (*Service, error) {
 
 	ropts := initRouterAliasOpts(cfg.Aliases)
 	ropts = append(ropts, WithExposeAliases(cfg.ListAliases))
-
-	r, err := NewRouter(cmap, pconf, ropts...)
-	if err != nil {
-		return nil, err
+	ropts = append(ropts, WithPresets(cfg.Presets))
+	ropts = append(ropts, WithAPIKeys(cfg.APIKeys))
+	if cfg.APIKeysFile != "" {
+		keys, err := loadAPIKeysFile(cfg.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		ropts = append(ropts, WithAPIKeys(keys))
+	}
+	if cfg.Balancer != "" {
+		ropts = append(ropts, WithBalancer(cfg.Balancer))
+	}
+	weights := map[ConnectionID]int{}
+	keepAlive := map[ConnectionID]KeepAliveConfig{}
+	queues := map[ConnectionID]QueueConfig{}
+	for id, c := range cconf {
+		if c.Weight != 0 {
+			weights[id] = c.Weight
+		}
+		if !c.KeepAlive.IsZero() {
+			keepAlive[id] = c.KeepAlive
+		}
+		if !c.Queue.IsZero() {
+			queues[id] = c.Queue
+		}
 	}
+	ropts = append(ropts, WithConnectionWeights(weights))
+	ropts = append(ropts, WithConnectionKeepAlive(keepAlive))
+	ropts = append(ropts, WithKeepAlive(cfg.KeepAlive))
+	ropts = append(ropts, WithOptionsPolicy(cfg.Options))
+	ropts = append(ropts, WithHealthCheck(cfg.HealthCheck))
+	ropts = append(ropts, WithRetry(cfg.Retry))
+	ropts = append(ropts, WithCircuitBreaker(cfg.CircuitBreaker))
+	ropts = append(ropts, WithDiscoveryInterval(cfg.DiscoveryInterval))
+	ropts = append(ropts, WithPreferLoaded(cfg.PreferLoaded, cfg.PreferLoadedInterval))
+	ropts = append(ropts, WithKeepWarmInterval(cfg.KeepWarmInterval))
+	ropts = append(ropts, WithRateLimit(cfg.RateLimit))
+	ropts = append(ropts, WithQueue(cfg.Queue))
+	ropts = append(ropts, WithReadiness(cfg.Readiness))
+	ropts = append(ropts, WithConnectionQueues(queues))
 
-	return NewService(r)
+	return NewRouter(cmap, pconf, ropts...)
 }
 
 var runGollamas = RunGollamas
 
-func RunGollamas(cfg GollamasConfig) error {
+// RunGollamas starts the router, when load is set the configuration is reloaded on SIGHUP
+// and, if enabled, whenever the config file changes.
+func RunGollamas(ctx context.Context, cfg GollamasConfig, load ConfigLoader) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go func() {
+		// a second signal stops the router without waiting for the requests in flight
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := cfg.Shutdown.validate(); err != nil {
+		return err
+	}
+	if err := cfg.TLS.validate(); err != nil {
+		return err
+	}
+	shutdownTracing, err := initTracing(ctx, cfg.Tracing)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.WithError(err).Error("Could not flush the traces.")
+		}
+	}()
+
 	s, err := InitService(cfg)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		// stops the reloads, then the background work of the router, which may have been replaced by a reload since
+		stop()
+		if c, ok := s.Client().(io.Closer); ok {
+			_ = c.Close()
+		}
+	}()
+
+	if load != nil {
+		rl := newReloader(s, cfg, load)
+		if err := rl.watch(ctx); err != nil {
+			return err
+		}
+	}
 
 	rs := GenerateRoutes(s)
 	addr := cfg.Listen
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: rs}
+	if cfg.TLS.enabled() {
+		cr, err := newCertReloader(cfg.TLS)
+		if err != nil {
+			_ = l.Close()
+			return err
+		}
+		if err := cr.watch(ctx); err != nil {
+			_ = l.Close()
+			return err
+		}
+		srv.TLSConfig = cr.TLSConfig()
+		s.SetRequireClientCertificate(cfg.TLS.ClientCAFile != "")
+	}
+
+	var aux []*http.Server
+	if cfg.MetricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", s.MetricsServer())
+		metrics := &http.Server{Addr: cfg.MetricsListen, Handler: mux}
+		aux = append(aux, metrics)
+		go func() {
+			log.Printf("Serving metrics on %s", cfg.MetricsListen)
+			if err := metrics.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.WithError(err).Error("Metrics listener stopped.")
+			}
+		}()
+	}
 
-	log.Printf("Starting server on %s", addr)
-	return http.ListenAndServe(addr, rs)
+	log.WithField("tls", cfg.TLS.enabled()).WithField("mtls", cfg.TLS.ClientCAFile != "").Printf("Starting server on %s", addr)
+	return serve(ctx, s, srv, l, cfg.Shutdown, aux...)
 }
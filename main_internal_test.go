@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -16,7 +17,7 @@ func mockRunGollamas(m *mock.Mock, cfg GollamasConfig) error {
 func prepareTestOsArgs(t *testing.T, args ...string) *mock.Mock {
 	saveRunGollamas := runGollamas
 	m := mock.Mock{}
-	runGollamas = func(cfg GollamasConfig) error {
+	runGollamas = func(ctx context.Context, cfg GollamasConfig, load ConfigLoader) error {
 		return mockRunGollamas(&m, cfg)
 	}
 	t.Cleanup(func() {
@@ -106,6 +107,22 @@ func TestRunCliConfig(t *testing.T) {
 				ListAliases: false,
 			},
 		},
+		"WithRepeatedProxy": {
+			args: []string{
+				"gollamas", "--listen", "0.0.0.0:11434",
+				"--proxy", "model1=http://server1", "--proxy", "model1=c2", "--balancer", "least-outstanding",
+			},
+			config: &GollamasConfig{
+				Listen:      "0.0.0.0:11434",
+				Connections: map[ConnectionID]ConnectionConfig{},
+				Models: map[ModelID]ModelConfig{
+					"model1": {ConnectionID: "http://server1", Connections: []ConnectionID{"c2"}},
+				},
+				Aliases:     map[ModelID]ModelID{},
+				ListAliases: false,
+				Balancer:    "least-outstanding",
+			},
+		},
 		"WithProxies": {
 			args: []string{
 				"gollamas", "--listen", "0.0.0.0:11434",
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const metricsNamespace = "gollamas"
+
+// requestLabels label the metrics of the requests served by the router.
+var requestLabels = []string{"route", "requested_model", "model", "alias", "connection_id"}
+
+// serviceMetrics counts the requests served by a service, each service has metrics of its own.
+type serviceMetrics struct {
+	registry         *prometheus.Registry
+	requestsTotal    *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	timeToFirstToken *prometheus.HistogramVec
+	tokensPerSecond  *prometheus.HistogramVec
+	tokensTotal      *prometheus.CounterVec
+	requestsCanceled *prometheus.CounterVec
+	requestsInFlight *prometheus.GaugeVec
+	upstreamRequests *prometheus.CounterVec
+	upstreamErrors   *prometheus.CounterVec
+	queueWait        *prometheus.HistogramVec
+}
+
+// errorReason labels the errors of the connections.
+func errorReason(err error) string {
+	var se api.StatusError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &se):
+		return strconv.Itoa(se.StatusCode)
+	default:
+		return "error"
+	}
+}
+
+// observe records the metrics of a request once it is served.
+func (m *serviceMetrics) observe(ri *requestInfo, route string, status int) {
+	info := ri.snapshot()
+	labels := []string{route, info.requestedModel, info.model.String(), info.alias.String(), info.connection.String()}
+	m.requestsTotal.WithLabelValues(append(labels, strconv.Itoa(status))...).Inc()
+	m.requestDuration.WithLabelValues(labels...).Observe(time.Since(info.start).Seconds())
+	if !info.firstResponse.IsZero() {
+		m.timeToFirstToken.WithLabelValues(labels...).Observe(info.firstResponse.Sub(info.start).Seconds())
+	}
+	if info.evalTokens > 0 && info.evalDuration > 0 {
+		m.tokensPerSecond.WithLabelValues(labels...).Observe(float64(info.evalTokens) / info.evalDuration.Seconds())
+	}
+	if info.canceled {
+		m.requestsCanceled.WithLabelValues(labels...).Inc()
+	}
+	if info.promptTokens > 0 {
+		m.tokensTotal.WithLabelValues(append(labels, "prompt")...).Add(float64(info.promptTokens))
+	}
+	if info.evalTokens > 0 {
+		m.tokensTotal.WithLabelValues(append(labels, "eval")...).Add(float64(info.evalTokens))
+	}
+}
+
+// upstream records a request sent to a connection in the metrics of the service which received the request,
+// the requests of the router itself are not counted.
+func (ri *requestInfo) upstream(cid ConnectionID, model string, err error) {
+	if ri == nil || ri.metrics == nil {
+		return
+	}
+	ri.metrics.upstreamRequests.WithLabelValues(cid.String(), model).Inc()
+	if err != nil {
+		ri.metrics.upstreamErrors.WithLabelValues(cid.String(), model, errorReason(err)).Inc()
+	}
+}
+
+// queued records the wait of a request let through by the queue of a connection or of a model.
+func (ri *requestInfo) queued(kind, id string, wait time.Duration) {
+	if ri == nil || ri.metrics == nil {
+		return
+	}
+	if kind == "connection" {
+		ri.metrics.queueWait.WithLabelValues(id, "").Observe(wait.Seconds())
+	} else {
+		ri.metrics.queueWait.WithLabelValues("", id).Observe(wait.Seconds())
+	}
+}
+
+var (
+	connectionUpDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "connection", "up"),
+		"Whether the connection passes its health checks, reported once the connection has been checked.", []string{"connection_id"}, nil)
+	connectionLastCheckDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "connection", "last_check_timestamp_seconds"),
+		"Time of the last health check of the connection.", []string{"connection_id"}, nil)
+	connectionInFlightDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "connection", "in_flight"),
+		"Requests in flight to the connection.", []string{"connection_id"}, nil)
+	connectionCircuitDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "connection", "circuit_state"),
+		"State of the circuit breaker of the connection, 1 for the current state.", []string{"connection_id", "state"}, nil)
+	queueDepthDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "queue", "depth"),
+		"Requests waiting in the queue of the connection or model.", []string{"connection_id", "model"}, nil)
+	queueInFlightDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "queue", "in_flight"),
+		"Requests let through by the queue of the connection or model.", []string{"connection_id", "model"}, nil)
+	queueRejectedDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "queue", "rejected_total"),
+		"Requests rejected by the queue of the connection or model.", []string{"connection_id", "model"}, nil)
+)
+
+// stateCollector publishes the state of the connections and queues of the current router of the service.
+type stateCollector struct {
+	s *Service
+}
+
+func (sc *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectionUpDesc
+	ch <- connectionLastCheckDesc
+	ch <- connectionInFlightDesc
+	ch <- connectionCircuitDesc
+	ch <- queueDepthDesc
+	ch <- queueInFlightDesc
+	ch <- queueRejectedDesc
+}
+
+func (sc *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	hr, ok := sc.s.Client().(interface{ Health() []ConnectionHealth })
+	if !ok {
+		return
+	}
+	for _, h := range hr.Health() {
+		cid := h.ConnectionID.String()
+		if h.LastCheck != nil {
+			up := 0.0
+			if h.Healthy {
+				up = 1
+			}
+			ch <- prometheus.MustNewConstMetric(connectionUpDesc, prometheus.GaugeValue, up, cid)
+			ch <- prometheus.MustNewConstMetric(connectionLastCheckDesc, prometheus.GaugeValue, float64(h.LastCheck.UnixMilli())/1000, cid)
+		}
+		ch <- prometheus.MustNewConstMetric(connectionInFlightDesc, prometheus.GaugeValue, float64(h.InFlight), cid)
+		for _, state := range []breakerState{breakerClosed, breakerOpen, breakerHalfOpen} {
+			v := 0.0
+			if h.Circuit == state.String() {
+				v = 1
+			}
+			ch <- prometheus.MustNewConstMetric(connectionCircuitDesc, prometheus.GaugeValue, v, cid, state.String())
+		}
+		if h.Queue != nil {
+			collectQueue(ch, *h.Queue, cid)
+		}
+	}
+	if qr, ok := hr.(interface{ Queues() []QueueState }); ok {
+		for _, q := range qr.Queues() {
+			collectQueue(ch, q, "")
+		}
+	}
+}
+
+func collectQueue(ch chan<- prometheus.Metric, q QueueState, cid string) {
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(q.Depth), cid, q.Model.String())
+	ch <- prometheus.MustNewConstMetric(queueInFlightDesc, prometheus.GaugeValue, float64(q.InFlight), cid, q.Model.String())
+	ch <- prometheus.MustNewConstMetric(queueRejectedDesc, prometheus.CounterValue, float64(q.Rejected), cid, q.Model.String())
+}
+
+// newServiceMetrics gathers the metrics of the requests and the state of the router of the service,
+// the requests and connections of the previous routers are counted on after a reload.
+func newServiceMetrics(s *Service) *serviceMetrics {
+	m := &serviceMetrics{
+		registry: prometheus.NewRegistry(),
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Requests served, by status code.",
+		}, append(requestLabels, "status")),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Duration of the requests, until the end of the response.",
+			Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, requestLabels),
+		timeToFirstToken: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "time_to_first_token_seconds",
+			Help:      "Time until the first response of the chat and generate requests.",
+			Buckets:   []float64{.05, .1, .25, .5, 1, 2, 5, 10, 20, 30, 60},
+		}, requestLabels),
+		tokensPerSecond: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "tokens_per_second",
+			Help:      "Generation speed of the chat and generate requests, from eval_count and eval_duration.",
+			Buckets:   []float64{1, 5, 10, 20, 30, 50, 75, 100, 150, 200, 500},
+		}, requestLabels),
+		tokensTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tokens_total",
+			Help:      "Tokens used by the requests, by type: prompt or eval.",
+		}, append(requestLabels, "type")),
+		requestsCanceled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_canceled_total",
+			Help:      "Requests canceled because the client disconnected before the end of the response.",
+		}, requestLabels),
+		requestsInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_in_flight",
+			Help:      "Requests being served.",
+		}, []string{"route"}),
+		upstreamRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_requests_total",
+			Help:      "Requests sent to the connections.",
+		}, []string{"connection_id", "model"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_errors_total",
+			Help:      "Requests sent to the connections which failed, by reason: the status code of the connection, canceled, timeout or error.",
+		}, []string{"connection_id", "model", "reason"}),
+		queueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_wait_seconds",
+			Help:      "Wait of the requests let through by the queues of the connections and models.",
+			Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"connection_id", "model"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requestsTotal,
+		m.requestDuration,
+		m.timeToFirstToken,
+		m.tokensPerSecond,
+		m.tokensTotal,
+		m.requestsCanceled,
+		m.requestsInFlight,
+		m.upstreamRequests,
+		m.upstreamErrors,
+		m.queueWait,
+		&stateCollector{s: s},
+	)
+	return m
+}
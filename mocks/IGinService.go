@@ -57,16 +57,36 @@ func (_m *IGinService) HeadBlobHandler(c *gin.Context) {
 	_m.Called(c)
 }
 
+// HealthHandler provides a mock function with given fields: c
+func (_m *IGinService) HealthHandler(c *gin.Context) {
+	_m.Called(c)
+}
+
 // HomeHandler provides a mock function with given fields: c
 func (_m *IGinService) HomeHandler(c *gin.Context) {
 	_m.Called(c)
 }
 
+// LimitsHandler provides a mock function with given fields: c
+func (_m *IGinService) LimitsHandler(c *gin.Context) {
+	_m.Called(c)
+}
+
 // ListHandler provides a mock function with given fields: c
 func (_m *IGinService) ListHandler(c *gin.Context) {
 	_m.Called(c)
 }
 
+// LiveHandler provides a mock function with given fields: c
+func (_m *IGinService) LiveHandler(c *gin.Context) {
+	_m.Called(c)
+}
+
+// MetricsHandler provides a mock function with given fields: c
+func (_m *IGinService) MetricsHandler(c *gin.Context) {
+	_m.Called(c)
+}
+
 // PsHandler provides a mock function with given fields: c
 func (_m *IGinService) PsHandler(c *gin.Context) {
 	_m.Called(c)
@@ -82,6 +102,11 @@ func (_m *IGinService) PushHandler(c *gin.Context) {
 	_m.Called(c)
 }
 
+// ReadyHandler provides a mock function with given fields: c
+func (_m *IGinService) ReadyHandler(c *gin.Context) {
+	_m.Called(c)
+}
+
 // ShowHandler provides a mock function with given fields: c
 func (_m *IGinService) ShowHandler(c *gin.Context) {
 	_m.Called(c)
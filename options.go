@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// OptionsPolicy sets the options of the requests, ie: num_ctx or temperature.
+// Defaults are applied first, then the values are clamped to their ranges and finally the forced values are set.
+type OptionsPolicy struct {
+	// Defaults are used for the options missing from the request.
+	Defaults map[string]any `json:"defaults,omitempty" yaml:"defaults,omitempty" toml:"defaults,omitempty"`
+	// Force replaces the options sent by the client.
+	Force map[string]any `json:"force,omitempty" yaml:"force,omitempty" toml:"force,omitempty"`
+	// Min and Max clamp the numeric options sent by the client.
+	Min map[string]float64 `json:"min,omitempty" yaml:"min,omitempty" toml:"min,omitempty"`
+	Max map[string]float64 `json:"max,omitempty" yaml:"max,omitempty" toml:"max,omitempty"`
+}
+
+func (op OptionsPolicy) IsZero() bool {
+	return len(op.Defaults) == 0 && len(op.Force) == 0 && len(op.Min) == 0 && len(op.Max) == 0
+}
+
+// optionKinds are the kinds of the options supported by ollama, by name.
+var optionKinds = func() map[string]reflect.Kind {
+	res := map[string]reflect.Kind{}
+	for _, f := range reflect.VisibleFields(reflect.TypeOf(api.Options{})) {
+		t := f.Type
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" && t.Kind() != reflect.Struct {
+			res[name] = t.Kind()
+		}
+	}
+	return res
+}()
+
+func (op OptionsPolicy) validate() error {
+	for _, m := range []map[string]any{op.Defaults, op.Force} {
+		for _, k := range slices.Sorted(maps.Keys(m)) {
+			if err := validateOption(k, m[k]); err != nil {
+				return err
+			}
+		}
+	}
+	for _, m := range []map[string]float64{op.Min, op.Max} {
+		for _, k := range slices.Sorted(maps.Keys(m)) {
+			if err := validateOption(k, m[k]); err != nil {
+				return err
+			}
+		}
+	}
+	for k, lo := range op.Min {
+		if hi, ok := op.Max[k]; ok && lo > hi {
+			return fmt.Errorf("invalid range for option %s: min %v is greater than max %v", k, lo, hi)
+		}
+	}
+	return nil
+}
+
+func validateOption(name string, v any) error {
+	kind, ok := optionKinds[name]
+	if !ok {
+		return fmt.Errorf("unknown option: %s", name)
+	}
+	switch kind {
+	case reflect.Int, reflect.Float32:
+		if _, ok := toFloat(v); !ok {
+			return fmt.Errorf("invalid value for option %s: %v, expected a number", name, v)
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("invalid value for option %s: %v, expected a boolean", name, v)
+		}
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("invalid value for option %s: %v, expected a string", name, v)
+		}
+	}
+	return nil
+}
+
+// merge fills the options missing from the policy with the ones of a less specific policy.
+func (op OptionsPolicy) merge(def OptionsPolicy) OptionsPolicy {
+	return OptionsPolicy{
+		Defaults: mergeOptions(op.Defaults, def.Defaults),
+		Force:    mergeOptions(op.Force, def.Force),
+		Min:      mergeOptions(op.Min, def.Min),
+		Max:      mergeOptions(op.Max, def.Max),
+	}
+}
+
+func mergeOptions[V any](m, def map[string]V) map[string]V {
+	if len(def) == 0 {
+		return m
+	}
+	res := maps.Clone(def)
+	maps.Copy(res, m)
+	return res
+}
+
+// apply returns the options forwarded for a request which sent opts.
+func (op OptionsPolicy) apply(opts map[string]any) map[string]any {
+	if op.IsZero() {
+		return opts
+	}
+	res := maps.Clone(opts)
+	if res == nil {
+		res = map[string]any{}
+	}
+	for k, v := range op.Defaults {
+		if _, ok := res[k]; !ok {
+			res[k] = v
+		}
+	}
+	for k, v := range res {
+		f, ok := toFloat(v)
+		if !ok {
+			continue
+		}
+		if lo, ok := op.Min[k]; ok && f < lo {
+			res[k] = lo
+		} else if hi, ok := op.Max[k]; ok && f > hi {
+			res[k] = hi
+		}
+	}
+	maps.Copy(res, op.Force)
+	if len(res) == 0 {
+		return opts
+	}
+	return res
+}
+
+// applyOptions returns the options of a request for the model and logs them.
+func (mr *modelRoute) applyOptions(opts map[string]any) map[string]any {
+	if mr.options.IsZero() {
+		return opts
+	}
+	res := mr.options.apply(opts)
+	log.WithField("model_id", mr.model).WithField("options", res).Debug("Routing: effective options.")
+	return res
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	}
+	return 0, false
+}
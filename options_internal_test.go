@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptionsPolicyApply(t *testing.T) {
+	policy := OptionsPolicy{
+		Defaults: map[string]any{"num_ctx": 8192, "temperature": 0.7},
+		Force:    map[string]any{"num_predict": 1024},
+		Min:      map[string]float64{"num_ctx": 2048},
+		Max:      map[string]float64{"num_ctx": 32768, "num_predict": 512},
+	}
+	for name, tc := range map[string]struct {
+		opts     map[string]any
+		expected map[string]any
+	}{
+		"Defaults": {
+			opts:     nil,
+			expected: map[string]any{"num_ctx": 8192, "temperature": 0.7, "num_predict": 1024},
+		},
+		"KeepsRequestValues": {
+			opts:     map[string]any{"num_ctx": float64(4096), "temperature": float64(0), "seed": float64(42)},
+			expected: map[string]any{"num_ctx": float64(4096), "temperature": float64(0), "seed": float64(42), "num_predict": 1024},
+		},
+		"ClampsToMin": {
+			opts:     map[string]any{"num_ctx": float64(512)},
+			expected: map[string]any{"num_ctx": float64(2048), "temperature": 0.7, "num_predict": 1024},
+		},
+		"ClampsToMax": {
+			opts:     map[string]any{"num_ctx": float64(131072)},
+			expected: map[string]any{"num_ctx": float64(32768), "temperature": 0.7, "num_predict": 1024},
+		},
+		"ForcesAfterClamping": {
+			opts:     map[string]any{"num_predict": float64(-1)},
+			expected: map[string]any{"num_ctx": 8192, "temperature": 0.7, "num_predict": 1024},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, policy.apply(tc.opts))
+		})
+	}
+
+	opts := map[string]any{"num_ctx": float64(512)}
+	policy.apply(opts)
+	assert.Equal(t, map[string]any{"num_ctx": float64(512)}, opts, "the options of the request are not modified")
+	assert.Nil(t, OptionsPolicy{}.apply(nil))
+}
+
+func TestOptionsPolicyMerge(t *testing.T) {
+	model := OptionsPolicy{Defaults: map[string]any{"num_ctx": 4096}, Max: map[string]float64{"num_ctx": 8192}}
+	global := OptionsPolicy{Defaults: map[string]any{"num_ctx": 2048, "temperature": 0.2}, Min: map[string]float64{"num_ctx": 1024}}
+	assert.Equal(t, OptionsPolicy{
+		Defaults: map[string]any{"num_ctx": 4096, "temperature": 0.2},
+		Min:      map[string]float64{"num_ctx": 1024},
+		Max:      map[string]float64{"num_ctx": 8192},
+	}, model.merge(global))
+}
+
+func TestOptionsPolicyValidate(t *testing.T) {
+	for _, tc := range []struct {
+		policy OptionsPolicy
+		err    string
+	}{
+		{OptionsPolicy{Defaults: map[string]any{"num_ctx": int64(8192), "stop": []any{"\n"}, "use_mmap": true}}, ""},
+		{OptionsPolicy{Defaults: map[string]any{"num_context": 8192}}, "unknown option: num_context"},
+		{OptionsPolicy{Force: map[string]any{"num_ctx": "8k"}}, "invalid value for option num_ctx: 8k, expected a number"},
+		{OptionsPolicy{Force: map[string]any{"use_mmap": 1}}, "invalid value for option use_mmap: 1, expected a boolean"},
+		{OptionsPolicy{Min: map[string]float64{"use_mmap": 1}}, "invalid value for option use_mmap: 1, expected a boolean"},
+		{OptionsPolicy{Min: map[string]float64{"num_ctx": 8192}, Max: map[string]float64{"num_ctx": 2048}}, "invalid range for option num_ctx: min 8192 is greater than max 2048"},
+	} {
+		err := tc.policy.validate()
+		if tc.err == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// PresetConfig is a virtual model serving a model with a system prompt and options of its own.
+type PresetConfig struct {
+	Model ModelID `json:"model" yaml:"model" toml:"model"`
+	// System is the system prompt placed before the system prompt of the requests.
+	System string `json:"system,omitempty" yaml:"system,omitempty" toml:"system,omitempty"`
+	// Template is the prompt template of the generate requests which do not set one.
+	Template string `json:"template,omitempty" yaml:"template,omitempty" toml:"template,omitempty"`
+	// Options replace the options sent by the client, ie: temperature or num_ctx.
+	Options map[string]any `json:"options,omitempty" yaml:"options,omitempty" toml:"options,omitempty"`
+}
+
+func (pc PresetConfig) validate() error {
+	if pc.Model == "" {
+		return errors.New("empty preset model")
+	}
+	return OptionsPolicy{Force: pc.Options}.validate()
+}
+
+// preset is a preset resolved to the model it serves.
+type preset struct {
+	name     ModelID
+	model    ModelID
+	system   string
+	template string
+	options  OptionsPolicy
+}
+
+// modelName returns the name of the model served for the requested name.
+func (p *preset) modelName(requested string) string {
+	if p == nil {
+		return requested
+	}
+	return p.model.String()
+}
+
+// messages places the system prompt of the preset before the messages of the request.
+func (p *preset) messages(msgs []api.Message) []api.Message {
+	if p == nil || p.system == "" {
+		return msgs
+	}
+	return append([]api.Message{{Role: "system", Content: p.system}}, msgs...)
+}
+
+// systemPrompt places the system prompt of the preset before the system prompt of the request.
+func (p *preset) systemPrompt(system string) string {
+	if p == nil || p.system == "" {
+		return system
+	}
+	if system == "" {
+		return p.system
+	}
+	return p.system + "\n\n" + system
+}
+
+// promptTemplate returns the template of the preset when the request does not set one.
+func (p *preset) promptTemplate(template string) string {
+	if p == nil || template != "" {
+		return template
+	}
+	return p.template
+}
+
+func (p *preset) applyOptions(opts map[string]any) map[string]any {
+	if p == nil {
+		return opts
+	}
+	return p.options.apply(opts)
+}
+
+func (r *Router) setPresets(presets map[ModelID]PresetConfig) error {
+	if len(presets) == 0 {
+		return nil
+	}
+	r.presets = map[ModelID]*preset{}
+	r.model2presets = map[ModelID][]ModelID{}
+	for _, name := range slices.Sorted(maps.Keys(presets)) {
+		if err := r.addPreset(name, presets[name]); err != nil {
+			return newConfigEntryError(presetsSection, name.String(), err)
+		}
+	}
+	return nil
+}
+
+func (r *Router) addPreset(name ModelID, pc PresetConfig) error {
+	if err := pc.validate(); err != nil {
+		return fmt.Errorf("invalid preset %s: %w", name, err)
+	}
+	if !model.ParseName(name.String()).IsValid() {
+		return fmt.Errorf("invalid preset name: %s", name)
+	}
+	if _, ok := r.modelCfg[name]; ok {
+		return fmt.Errorf("preset %s refers to an existing concrete model name", name)
+	}
+	if _, ok := r.all2ModelID[ModelID(modelKey(name.String()))]; ok {
+		return fmt.Errorf("preset %s refers to an existing concrete model name", name)
+	}
+	if _, ok := r.alias2model[name]; ok {
+		return fmt.Errorf("preset %s refers to an existing alias", name)
+	}
+	target, ok := r.all2ModelID[pc.Model]
+	if !ok {
+		target, ok = r.alias2model[pc.Model]
+	}
+	if !ok {
+		return fmt.Errorf("preset %s points to unknown model %s", name, pc.Model)
+	}
+	p := &preset{
+		name:     name,
+		model:    target,
+		system:   pc.System,
+		template: pc.Template,
+		options:  OptionsPolicy{Force: pc.Options},
+	}
+	r.presets[name] = p
+	r.presets[ModelID(modelKey(name.String()))] = p
+	r.model2presets[target] = append(r.model2presets[target], name)
+	return nil
+}
+
+// lookupPreset returns the preset with the given name, or nil when the name is not a preset.
+func (r *Router) lookupPreset(name string) *preset {
+	p := r.presets[ModelID(name)]
+	if p != nil {
+		log.WithField("preset", p.name).WithField("model_id", p.model).Trace("Routing: selected preset.")
+	}
+	return p
+}
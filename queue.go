@@ -0,0 +1,234 @@
+package main
+
+import (
+	"cmp"
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QueueConfig limits the requests in flight to a connection or to a model, the requests over the limit wait their turn in a queue.
+// The requests are not limited when Concurrency is zero.
+type QueueConfig struct {
+	// Concurrency is the maximum number of requests in flight.
+	Concurrency int `json:"concurrency,omitempty" yaml:"concurrency,omitempty" toml:"concurrency,omitempty"`
+	// MaxDepth is the maximum number of requests waiting in the queue, the requests over the limit are rejected right away when zero.
+	// The queue is not bounded when it is not set, the requests then wait as long as MaxWait and their client allow.
+	MaxDepth *int `json:"max_depth,omitempty" yaml:"max_depth,omitempty" toml:"max_depth,omitempty"`
+	// MaxWait is how long a request waits in the queue before it is rejected, requests wait as long as their client when empty.
+	MaxWait Duration `json:"max_wait,omitempty" yaml:"max_wait,omitempty" toml:"max_wait,omitempty"`
+}
+
+func (qc QueueConfig) IsZero() bool {
+	return qc == QueueConfig{}
+}
+
+func (qc QueueConfig) validate() error {
+	if qc.Concurrency < 0 {
+		return fmt.Errorf("invalid queue concurrency: %d", qc.Concurrency)
+	}
+	if qc.MaxDepth != nil && *qc.MaxDepth < 0 {
+		return fmt.Errorf("invalid queue max depth: %d", *qc.MaxDepth)
+	}
+	if qc.MaxWait < 0 {
+		return fmt.Errorf("invalid queue max wait: %s", qc.MaxWait)
+	}
+	return nil
+}
+
+// merge fills the settings missing from the connection configuration with the default ones.
+func (qc QueueConfig) merge(def QueueConfig) QueueConfig {
+	return QueueConfig{
+		Concurrency: cmp.Or(qc.Concurrency, def.Concurrency),
+		MaxDepth:    cmp.Or(qc.MaxDepth, def.MaxDepth),
+		MaxWait:     cmp.Or(qc.MaxWait, def.MaxWait),
+	}
+}
+
+// QueueState is the state of the queue of a connection or of a model as reported by the health endpoint.
+type QueueState struct {
+	Model       ModelID `json:"model,omitempty"`
+	Concurrency int     `json:"concurrency"`
+	InFlight    int     `json:"in_flight"`
+	Depth       int     `json:"depth"`
+	// Waited is the number of requests which waited in the queue, AverageWait and MaxWait are their wait times.
+	Waited      int64    `json:"waited"`
+	AverageWait Duration `json:"average_wait"`
+	MaxWait     Duration `json:"max_wait"`
+	// Rejected is the number of requests rejected because the queue was full or because they waited too long.
+	Rejected int64 `json:"rejected"`
+}
+
+// requestQueue lets a limited number of requests through and queues the others in order.
+type requestQueue struct {
+	kind string // connection or model
+	id   string
+	cfg  QueueConfig
+
+	mu       sync.Mutex
+	inFlight int
+	waiting  list.List // of chan struct{}, closed when the request is let through
+	waited   int64
+	waitSum  time.Duration
+	waitMax  time.Duration
+	rejected int64
+}
+
+// newRequestQueue returns nil when the requests are not limited.
+func newRequestQueue(kind, id string, cfg QueueConfig) *requestQueue {
+	if cfg.Concurrency == 0 {
+		return nil
+	}
+	return &requestQueue{
+		kind: kind,
+		id:   id,
+		cfg:  cfg,
+	}
+}
+
+func (q *requestQueue) logger() *log.Entry {
+	return log.WithField(q.kind+"_id", q.id)
+}
+
+// acquire waits for the turn of the request, release must be called once the request is over.
+// A request leaves the queue when its context is done.
+func (q *requestQueue) acquire(ctx context.Context) (release func(), err error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	q.mu.Lock()
+	if q.inFlight < q.cfg.Concurrency {
+		q.inFlight++
+		q.mu.Unlock()
+		return q.release, nil
+	}
+	if q.cfg.MaxDepth != nil && q.waiting.Len() >= *q.cfg.MaxDepth {
+		q.rejected++
+		q.mu.Unlock()
+		q.logger().Info("Request rejected, the queue is full.")
+		return nil, NewHttpErrorf(http.StatusServiceUnavailable, "gollamas: too many requests queued for %s %s", q.kind, q.id)
+	}
+	ready := make(chan struct{})
+	e := q.waiting.PushBack(ready)
+	q.mu.Unlock()
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if q.cfg.MaxWait > 0 {
+		t := time.NewTimer(time.Duration(q.cfg.MaxWait))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ready:
+		q.record(ctx, time.Since(start))
+		return q.release, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = NewHttpErrorf(http.StatusServiceUnavailable, "gollamas: request waited too long in the queue of %s %s", q.kind, q.id)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-ready:
+		// the turn of the request came while it was leaving, it goes to the next request
+		q.releaseLocked()
+	default:
+		q.waiting.Remove(e)
+	}
+	if ctx.Err() == nil {
+		q.rejected++
+		q.logger().WithField("wait", time.Since(start)).Info("Request rejected, it waited too long in the queue.")
+	} else {
+		q.logger().WithError(err).Debug("Request left the queue.")
+	}
+	return nil, err
+}
+
+func (q *requestQueue) record(ctx context.Context, wait time.Duration) {
+	q.mu.Lock()
+	q.waited++
+	q.waitSum += wait
+	q.waitMax = max(q.waitMax, wait)
+	q.mu.Unlock()
+	requestInfoFromContext(ctx).queued(q.kind, q.id, wait)
+}
+
+// release lets the next request in the queue through.
+func (q *requestQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked()
+}
+
+func (q *requestQueue) releaseLocked() {
+	if e := q.waiting.Front(); e != nil {
+		// the slot of the request goes to the next one
+		q.waiting.Remove(e)
+		close(e.Value.(chan struct{}))
+		return
+	}
+	q.inFlight--
+}
+
+func (q *requestQueue) State() QueueState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := QueueState{
+		Concurrency: q.cfg.Concurrency,
+		InFlight:    q.inFlight,
+		Depth:       q.waiting.Len(),
+		Waited:      q.waited,
+		MaxWait:     Duration(q.waitMax),
+		Rejected:    q.rejected,
+	}
+	if q.waited > 0 {
+		s.AverageWait = Duration(q.waitSum / time.Duration(q.waited))
+	}
+	return s
+}
+
+// queueRoute sends the request once the queue of the model of the route lets it through.
+func queueRoute[T any](ctx context.Context, route *modelRoute, call func() (T, error)) (T, error) {
+	release, err := route.queue.acquire(ctx)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	defer release()
+	return call()
+}
+
+// Queues returns the state of the queues of the models, sorted by model.
+func (r *Router) Queues() []QueueState {
+	var res []QueueState
+	add := func(route *modelRoute) {
+		if route.queue != nil {
+			s := route.queue.State()
+			s.Model = route.model
+			res = append(res, s)
+		}
+	}
+	for _, route := range r.routes {
+		add(route)
+	}
+	if r.discovery != nil {
+		r.discovery.mu.RLock()
+		for _, route := range r.discovery.routes {
+			add(route)
+		}
+		r.discovery.mu.RUnlock()
+	}
+	slices.SortFunc(res, func(a, b QueueState) int {
+		return cmp.Compare(a.Model, b.Model)
+	})
+	return res
+}
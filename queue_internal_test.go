@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func maxDepth(n int) *int {
+	return &n
+}
+
+// acquireAsync queues a request and waits until it is in the queue.
+func acquireAsync(t *testing.T, ctx context.Context, q *requestQueue) <-chan error {
+	depth := q.State().Depth
+	ch := make(chan error, 1)
+	go func() {
+		release, err := q.acquire(ctx)
+		if err == nil {
+			defer release()
+		}
+		ch <- err
+	}()
+	assert.Eventually(t, func() bool { return q.State().Depth == depth+1 }, time.Second, time.Millisecond)
+	return ch
+}
+
+func TestRequestQueueFIFO(t *testing.T) {
+	q := newRequestQueue("connection", "c1", QueueConfig{Concurrency: 1, MaxDepth: maxDepth(2)})
+	release, err := q.acquire(context.Background())
+	assert.NoError(t, err)
+
+	order := make(chan int, 2)
+	hold := make(chan struct{})
+	for i := range 2 {
+		depth := q.State().Depth
+		go func() {
+			release, err := q.acquire(context.Background())
+			assert.NoError(t, err)
+			order <- i
+			<-hold
+			release()
+		}()
+		assert.Eventually(t, func() bool { return q.State().Depth == depth+1 }, time.Second, time.Millisecond)
+	}
+	_, err = q.acquire(context.Background())
+	assert.EqualError(t, err, "gollamas: too many requests queued for connection c1")
+	var he *HttpError
+	assert.ErrorAs(t, err, &he)
+	assert.Equal(t, http.StatusServiceUnavailable, he.StatusCode())
+
+	release()
+	assert.Equal(t, 0, <-order)
+	close(hold)
+	assert.Equal(t, 1, <-order)
+	assert.Eventually(t, func() bool { return q.State().InFlight == 0 }, time.Second, time.Millisecond)
+
+	s := q.State()
+	assert.Equal(t, 0, s.Depth)
+	assert.Equal(t, int64(2), s.Waited)
+	assert.Equal(t, int64(1), s.Rejected)
+	assert.Greater(t, s.MaxWait, Duration(0))
+	assert.LessOrEqual(t, s.AverageWait, s.MaxWait)
+}
+
+func TestRequestQueueMaxWait(t *testing.T) {
+	q := newRequestQueue("model", "llama3.2", QueueConfig{Concurrency: 1, MaxDepth: maxDepth(1), MaxWait: Duration(10 * time.Millisecond)})
+	release, err := q.acquire(context.Background())
+	assert.NoError(t, err)
+	defer release()
+
+	_, err = q.acquire(context.Background())
+	assert.EqualError(t, err, "gollamas: request waited too long in the queue of model llama3.2")
+	s := q.State()
+	assert.Equal(t, 0, s.Depth)
+	assert.Equal(t, 1, s.InFlight)
+	assert.Equal(t, int64(1), s.Rejected)
+}
+
+func TestRequestQueueRemovesCanceledRequests(t *testing.T) {
+	q := newRequestQueue("connection", "c1", QueueConfig{Concurrency: 1, MaxDepth: maxDepth(1)})
+	release, err := q.acquire(context.Background())
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := acquireAsync(t, ctx, q)
+	cancel()
+	assert.ErrorIs(t, <-ch, context.Canceled)
+	assert.Equal(t, 0, q.State().Depth)
+	assert.Equal(t, int64(0), q.State().Rejected)
+
+	// the place of the canceled request is free again
+	ch = acquireAsync(t, context.Background(), q)
+	release()
+	assert.NoError(t, <-ch)
+	assert.Eventually(t, func() bool { return q.State().InFlight == 0 }, time.Second, time.Millisecond)
+}
+
+func TestRequestQueueMaxDepth(t *testing.T) {
+	// the queue is not bounded without a max depth
+	q := newRequestQueue("connection", "c1", QueueConfig{Concurrency: 1})
+	release, err := q.acquire(context.Background())
+	assert.NoError(t, err)
+	var queued []<-chan error
+	for range 3 {
+		queued = append(queued, acquireAsync(t, context.Background(), q))
+	}
+	release()
+	for _, ch := range queued {
+		assert.NoError(t, <-ch)
+	}
+
+	// and the requests over the concurrency are rejected right away with a max depth of zero
+	q = newRequestQueue("connection", "c1", QueueConfig{Concurrency: 1, MaxDepth: maxDepth(0)})
+	release, err = q.acquire(context.Background())
+	assert.NoError(t, err)
+	defer release()
+	_, err = q.acquire(context.Background())
+	assert.EqualError(t, err, "gollamas: too many requests queued for connection c1")
+}
+
+func TestQueueConfigMerge(t *testing.T) {
+	def := QueueConfig{Concurrency: 4, MaxDepth: maxDepth(32), MaxWait: Duration(time.Minute)}
+	assert.Equal(t, def, QueueConfig{}.merge(def))
+	// a connection can reject the requests right away while the others queue them
+	assert.Equal(t, QueueConfig{Concurrency: 1, MaxDepth: maxDepth(0), MaxWait: Duration(time.Minute)}, QueueConfig{Concurrency: 1, MaxDepth: maxDepth(0)}.merge(def))
+	assert.Equal(t, QueueConfig{Concurrency: 4}, QueueConfig{}.merge(QueueConfig{Concurrency: 4}))
+}
+
+func TestRequestQueueNotLimited(t *testing.T) {
+	q := newRequestQueue("connection", "c1", QueueConfig{MaxDepth: maxDepth(1)})
+	assert.Nil(t, q)
+	release, err := q.acquire(context.Background())
+	assert.NoError(t, err)
+	release()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// limiterPruneInterval is the interval at which the state of the idle clients is dropped.
+const limiterPruneInterval = time.Minute
+
+// RateLimitConfig limits the requests of each client, identified by its API key or else by its IP address.
+// Zero values disable the corresponding limit.
+type RateLimitConfig struct {
+	RequestsPerMinute int `json:"requests_per_minute,omitempty" yaml:"requests_per_minute,omitempty" toml:"requests_per_minute,omitempty"`
+	// Concurrency is the maximum number of requests of a client in flight at once.
+	Concurrency int `json:"concurrency,omitempty" yaml:"concurrency,omitempty" toml:"concurrency,omitempty"`
+	// TokensPerDay and TokensPerMonth are quotas of prompt and generated tokens, reset at midnight UTC.
+	TokensPerDay   int `json:"tokens_per_day,omitempty" yaml:"tokens_per_day,omitempty" toml:"tokens_per_day,omitempty"`
+	TokensPerMonth int `json:"tokens_per_month,omitempty" yaml:"tokens_per_month,omitempty" toml:"tokens_per_month,omitempty"`
+}
+
+func (rc RateLimitConfig) IsZero() bool {
+	return rc == RateLimitConfig{}
+}
+
+func (rc RateLimitConfig) validate() error {
+	if rc.RequestsPerMinute < 0 {
+		return fmt.Errorf("invalid rate limit requests per minute: %d", rc.RequestsPerMinute)
+	}
+	if rc.Concurrency < 0 {
+		return fmt.Errorf("invalid rate limit concurrency: %d", rc.Concurrency)
+	}
+	if rc.TokensPerDay < 0 {
+		return fmt.Errorf("invalid rate limit tokens per day: %d", rc.TokensPerDay)
+	}
+	if rc.TokensPerMonth < 0 {
+		return fmt.Errorf("invalid rate limit tokens per month: %d", rc.TokensPerMonth)
+	}
+	return nil
+}
+
+// LimitState is the state of the limits of a client, for all the models or for a single model.
+type LimitState struct {
+	Client string  `json:"client"`
+	Model  ModelID `json:"model,omitempty"`
+	// Requests is the number of requests the client can send right away, when the requests per minute are limited.
+	Requests        *int `json:"requests,omitempty"`
+	InFlight        int  `json:"in_flight"`
+	TokensToday     int  `json:"tokens_today"`
+	TokensThisMonth int  `json:"tokens_this_month"`
+}
+
+// rateLimitError rejects a request over the limits of its client.
+type rateLimitError struct {
+	err        *HttpError
+	retryAfter time.Duration
+}
+
+func newRateLimitError(retryAfter time.Duration, message string, opts ...any) *rateLimitError {
+	return &rateLimitError{
+		err:        NewHttpErrorf(http.StatusTooManyRequests, message, opts...),
+		retryAfter: retryAfter,
+	}
+}
+
+func (e *rateLimitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rateLimitError) Unwrap() error {
+	return e.err
+}
+
+// RetryAfter is the wait before the client can send requests again.
+func (e *rateLimitError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+type clientIPCtxKey struct{}
+
+// WithClientIP returns a context carrying the IP address of the client, used to limit the clients without API keys.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPCtxKey{}, ip)
+}
+
+// clientFromContext identifies the client of a request, the requests of the router itself have no client.
+func clientFromContext(ctx context.Context) string {
+	if k := apiKeyFromContext(ctx); k != nil {
+		return "key:" + k.name
+	}
+	if p := principalFromContext(ctx); p != "" {
+		return "cert:" + p
+	}
+	if ip, _ := ctx.Value(clientIPCtxKey{}).(string); ip != "" {
+		return "ip:" + ip
+	}
+	return ""
+}
+
+type limitKey struct {
+	client string
+	model  ModelID // empty for the limits covering all the models
+}
+
+// clientLimit counts the requests and tokens of a client.
+type clientLimit struct {
+	requests    float64 // requests available, refilled over time, negative when not limited
+	refilled    time.Time
+	inFlight    int
+	day         time.Time
+	dayTokens   int
+	month       time.Time
+	monthTokens int
+}
+
+// rateLimiter enforces the limits of the clients, for all the models and for each model.
+type rateLimiter struct {
+	mu      sync.Mutex
+	clients map[limitKey]*clientLimit
+	pruned  time.Time
+	now     func() time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		clients: map[limitKey]*clientLimit{},
+		now:     time.Now,
+	}
+}
+
+// admit checks the limits of the client for the model and counts the request when it is allowed,
+// done must be called once the request is over with the number of tokens it used and the model which answered,
+// the tokens only count against the limits of the model when it answered.
+func (l *rateLimiter) admit(client string, model ModelID, global, perModel RateLimitConfig) (done func(tokens int, served ModelID), err error) {
+	if client == "" || (global.IsZero() && perModel.IsZero()) {
+		return func(int, ModelID) {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.prune(now)
+	type limit struct {
+		model ModelID
+		cfg   RateLimitConfig
+		cl    *clientLimit
+	}
+	var limits []limit
+	for _, k := range []struct {
+		model ModelID
+		cfg   RateLimitConfig
+	}{{"", global}, {model, perModel}} {
+		if k.cfg.IsZero() {
+			continue
+		}
+		cl := l.get(limitKey{client, k.model}, k.cfg, now)
+		if err := cl.check(k.cfg, now); err != nil {
+			return nil, err
+		}
+		limits = append(limits, limit{k.model, k.cfg, cl})
+	}
+	for _, lm := range limits {
+		if lm.cfg.RequestsPerMinute > 0 {
+			lm.cl.requests--
+		}
+		lm.cl.inFlight++
+	}
+	var once sync.Once
+	return func(tokens int, served ModelID) {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			now := l.now()
+			for _, lm := range limits {
+				lm.cl.inFlight--
+				if lm.model == "" || lm.model == served {
+					lm.cl.count(tokens, now)
+				}
+			}
+		})
+	}, nil
+}
+
+func (l *rateLimiter) get(k limitKey, cfg RateLimitConfig, now time.Time) *clientLimit {
+	cl, ok := l.clients[k]
+	if !ok {
+		cl = &clientLimit{
+			requests: float64(cfg.RequestsPerMinute),
+			refilled: now,
+		}
+		l.clients[k] = cl
+	}
+	cl.refill(cfg, now)
+	return cl
+}
+
+// prune drops the state of the clients which are back to their initial state.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < limiterPruneInterval {
+		return
+	}
+	l.pruned = now
+	for k, cl := range l.clients {
+		cl.reset(now)
+		if cl.inFlight == 0 && cl.dayTokens == 0 && cl.monthTokens == 0 && now.Sub(cl.refilled) >= time.Minute {
+			delete(l.clients, k)
+		}
+	}
+}
+
+func (l *rateLimiter) state() []LimitState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	res := make([]LimitState, 0, len(l.clients))
+	for k, cl := range l.clients {
+		cl.reset(now)
+		s := LimitState{
+			Client:          k.client,
+			Model:           k.model,
+			InFlight:        cl.inFlight,
+			TokensToday:     cl.dayTokens,
+			TokensThisMonth: cl.monthTokens,
+		}
+		if cl.requests >= 0 {
+			n := int(cl.requests)
+			s.Requests = &n
+		}
+		res = append(res, s)
+	}
+	slices.SortFunc(res, func(a, b LimitState) int {
+		return cmp.Or(cmp.Compare(a.Client, b.Client), cmp.Compare(a.Model, b.Model))
+	})
+	return res
+}
+
+func (cl *clientLimit) refill(cfg RateLimitConfig, now time.Time) {
+	if cfg.RequestsPerMinute == 0 {
+		cl.requests = -1
+		return
+	}
+	rate := float64(cfg.RequestsPerMinute) / float64(time.Minute)
+	cl.requests = min(max(cl.requests, 0)+float64(now.Sub(cl.refilled))*rate, float64(cfg.RequestsPerMinute))
+	cl.refilled = now
+}
+
+// reset starts the token quotas over at the beginning of each day and month.
+func (cl *clientLimit) reset(now time.Time) {
+	now = now.UTC()
+	if day := now.Truncate(24 * time.Hour); !cl.day.Equal(day) {
+		cl.day, cl.dayTokens = day, 0
+	}
+	if month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC); !cl.month.Equal(month) {
+		cl.month, cl.monthTokens = month, 0
+	}
+}
+
+func (cl *clientLimit) check(cfg RateLimitConfig, now time.Time) error {
+	cl.reset(now)
+	if cfg.TokensPerDay > 0 && cl.dayTokens >= cfg.TokensPerDay {
+		return newRateLimitError(cl.day.Add(24*time.Hour).Sub(now), "gollamas: daily token quota exceeded")
+	}
+	if cfg.TokensPerMonth > 0 && cl.monthTokens >= cfg.TokensPerMonth {
+		return newRateLimitError(cl.month.AddDate(0, 1, 0).Sub(now), "gollamas: monthly token quota exceeded")
+	}
+	if cfg.Concurrency > 0 && cl.inFlight >= cfg.Concurrency {
+		return newRateLimitError(time.Second, "gollamas: too many concurrent requests")
+	}
+	if cfg.RequestsPerMinute > 0 && cl.requests < 1 {
+		rate := float64(cfg.RequestsPerMinute) / float64(time.Minute)
+		return newRateLimitError(time.Duration(math.Ceil((1-cl.requests)/rate)), "gollamas: too many requests")
+	}
+	return nil
+}
+
+func (cl *clientLimit) count(tokens int, now time.Time) {
+	cl.reset(now)
+	cl.dayTokens += tokens
+	cl.monthTokens += tokens
+}
+
+// admit checks the limits of the client of the request for the model of the route.
+func (r *Router) admit(ctx context.Context, route *modelRoute) (func(tokens int, served ModelID), error) {
+	done, err := r.limiter.admit(clientFromContext(ctx), route.model, r.rateLimit, route.rateLimit)
+	if err != nil {
+		log.WithField("client", clientFromContext(ctx)).WithField("model_id", route.model).WithError(err).Info("Request over the limits of the client.")
+	}
+	return done, err
+}
+
+// admitModel checks the limits of the client of the request for the model of the route only,
+// for the fallback models of a request which has already been counted by the global limits.
+func (r *Router) admitModel(ctx context.Context, route *modelRoute) (func(tokens int, served ModelID), error) {
+	return r.limiter.admit(clientFromContext(ctx), route.model, RateLimitConfig{}, route.rateLimit)
+}
+
+// Limits reports the state of the limits of the clients, only to the admin API keys when the requests are authenticated.
+func (r *Router) Limits(ctx context.Context) ([]LimitState, error) {
+	if err := r.AuthorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+	return r.limiter.state(), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRateLimiter(now *time.Time) *rateLimiter {
+	l := newRateLimiter()
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func retryAfter(t *testing.T, err error) time.Duration {
+	var rle *rateLimitError
+	if !errors.As(err, &rle) {
+		t.Fatalf("expected a rate limit error, got %v", err)
+	}
+	return rle.RetryAfter()
+}
+
+func TestRateLimiterRequestsPerMinute(t *testing.T) {
+	now := time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC)
+	l := newTestRateLimiter(&now)
+	cfg := RateLimitConfig{RequestsPerMinute: 2}
+
+	for range 2 {
+		done, err := l.admit("ip:10.0.0.1", "llama3.2", cfg, RateLimitConfig{})
+		assert.NoError(t, err)
+		done(0, "llama3.2")
+	}
+	_, err := l.admit("ip:10.0.0.1", "llama3.2", cfg, RateLimitConfig{})
+	assert.EqualError(t, err, "gollamas: too many requests")
+	assert.Equal(t, 30*time.Second, retryAfter(t, err))
+
+	// other clients have limits of their own
+	_, err = l.admit("ip:10.0.0.2", "llama3.2", cfg, RateLimitConfig{})
+	assert.NoError(t, err)
+
+	now = now.Add(30 * time.Second)
+	_, err = l.admit("ip:10.0.0.1", "llama3.2", cfg, RateLimitConfig{})
+	assert.NoError(t, err)
+}
+
+func TestRateLimiterConcurrency(t *testing.T) {
+	now := time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC)
+	l := newTestRateLimiter(&now)
+	cfg := RateLimitConfig{Concurrency: 1}
+
+	done, err := l.admit("key:ci", "llama3.2", cfg, RateLimitConfig{})
+	assert.NoError(t, err)
+	_, err = l.admit("key:ci", "llama3.2", cfg, RateLimitConfig{})
+	assert.EqualError(t, err, "gollamas: too many concurrent requests")
+	assert.Equal(t, time.Second, retryAfter(t, err))
+	done(0, "llama3.2")
+	// done is idempotent
+	done(0, "llama3.2")
+	done, err = l.admit("key:ci", "llama3.2", cfg, RateLimitConfig{})
+	assert.NoError(t, err)
+	done(0, "llama3.2")
+}
+
+func TestRateLimiterTokenQuotas(t *testing.T) {
+	now := time.Date(2025, 6, 30, 22, 0, 0, 0, time.UTC)
+	l := newTestRateLimiter(&now)
+	perModel := RateLimitConfig{TokensPerDay: 100}
+	global := RateLimitConfig{TokensPerMonth: 150}
+
+	done, err := l.admit("key:ci", "llama3.2", global, perModel)
+	assert.NoError(t, err)
+	done(120, "llama3.2")
+	_, err = l.admit("key:ci", "llama3.2", global, perModel)
+	assert.EqualError(t, err, "gollamas: daily token quota exceeded")
+	assert.Equal(t, 2*time.Hour, retryAfter(t, err))
+
+	// the daily quota only covers the model
+	done, err = l.admit("key:ci", "qwen2.5-coder:14b", global, RateLimitConfig{})
+	assert.NoError(t, err)
+	done(40, "qwen2.5-coder:14b")
+	_, err = l.admit("key:ci", "qwen2.5-coder:14b", global, RateLimitConfig{})
+	assert.EqualError(t, err, "gollamas: monthly token quota exceeded")
+	assert.Equal(t, 2*time.Hour, retryAfter(t, err))
+
+	assert.Equal(t, []LimitState{
+		{Client: "key:ci", InFlight: 0, TokensToday: 160, TokensThisMonth: 160},
+		{Client: "key:ci", Model: "llama3.2", InFlight: 0, TokensToday: 120, TokensThisMonth: 120},
+	}, l.state())
+
+	// the quotas start over at midnight UTC
+	now = now.Add(2 * time.Hour)
+	done, err = l.admit("key:ci", "llama3.2", global, perModel)
+	assert.NoError(t, err)
+	done(0, "llama3.2")
+
+	// idle clients are dropped
+	now = now.Add(2 * limiterPruneInterval)
+	_, err = l.admit("key:admin", "llama3.2", global, perModel)
+	assert.NoError(t, err)
+	assert.Len(t, l.state(), 2)
+}
+
+func TestRateLimiterIgnoresRequestsWithoutClient(t *testing.T) {
+	now := time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC)
+	l := newTestRateLimiter(&now)
+	for range 3 {
+		_, err := l.admit("", "llama3.2", RateLimitConfig{Concurrency: 1}, RateLimitConfig{})
+		assert.NoError(t, err)
+	}
+	assert.Empty(t, l.state())
+}
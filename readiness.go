@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+const (
+	defaultReadyMinConnections = 1
+	defaultReadinessCacheTTL   = 5 * time.Second
+)
+
+// ReadinessConfig sets when the router reports it is ready to serve requests.
+type ReadinessConfig struct {
+	// MinConnections is the number of connections which must be reachable, defaults to 1.
+	MinConnections int `json:"min_connections,omitempty" yaml:"min_connections,omitempty" toml:"min_connections,omitempty"`
+	// RequiredModels must each be listed by one of the reachable connections of their route.
+	RequiredModels []ModelID `json:"required_models,omitempty" yaml:"required_models,omitempty" toml:"required_models,omitempty"`
+	// CacheTTL is how long the checks of the connections are reused, defaults to 5s.
+	CacheTTL Duration `json:"cache_ttl,omitempty" yaml:"cache_ttl,omitempty" toml:"cache_ttl,omitempty"`
+}
+
+func (rc ReadinessConfig) IsZero() bool {
+	return rc.MinConnections == 0 && len(rc.RequiredModels) == 0 && rc.CacheTTL == 0
+}
+
+func (rc ReadinessConfig) validate() error {
+	if rc.MinConnections < 0 {
+		return fmt.Errorf("invalid readiness min connections: %d", rc.MinConnections)
+	}
+	if slices.Contains(rc.RequiredModels, "") {
+		return fmt.Errorf("invalid readiness required models: empty model name")
+	}
+	if rc.CacheTTL < 0 {
+		return fmt.Errorf("invalid readiness cache ttl: %s", rc.CacheTTL)
+	}
+	return nil
+}
+
+func (rc ReadinessConfig) withDefaults() ReadinessConfig {
+	if rc.MinConnections == 0 {
+		rc.MinConnections = defaultReadyMinConnections
+	}
+	if rc.CacheTTL == 0 {
+		rc.CacheTTL = Duration(defaultReadinessCacheTTL)
+	}
+	return rc
+}
+
+// ConnectionReadiness is the result of the last check of a connection.
+type ConnectionReadiness struct {
+	ConnectionID ConnectionID `json:"connection_id"`
+	Reachable    bool         `json:"reachable"`
+	LastCheck    time.Time    `json:"last_check"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// ModelReadiness reports whether a required model is served by one of its connections.
+type ModelReadiness struct {
+	Model       ModelID        `json:"model"`
+	Available   bool           `json:"available"`
+	Connections []ConnectionID `json:"connections,omitempty"`
+	Error       string         `json:"error,omitempty"`
+}
+
+// ReadyResponse is the readiness of the router.
+type ReadyResponse struct {
+	Ready       bool                  `json:"ready"`
+	Reason      string                `json:"reason,omitempty"`
+	Connections []ConnectionReadiness `json:"connections,omitempty"`
+	Models      []ModelReadiness      `json:"models,omitempty"`
+}
+
+// connectionCheck is the cached result of the check of a connection.
+type connectionCheck struct {
+	ConnectionReadiness
+	models []api.ListModelResponse // only listed when models are required
+}
+
+// readinessChecker checks the connections when the readiness is requested,
+// the results are cached so that frequent probes do not reach the connections.
+type readinessChecker struct {
+	cfg     ReadinessConfig
+	timeout time.Duration
+	conns   map[ConnectionID]*connection
+	mu      sync.Mutex // held during the checks so that concurrent probes share them
+	checked time.Time
+	checks  map[ConnectionID]connectionCheck
+}
+
+func newReadinessChecker(cfg ReadinessConfig, timeout time.Duration, conns map[ConnectionID]*connection) *readinessChecker {
+	return &readinessChecker{
+		cfg:     cfg.withDefaults(),
+		timeout: timeout,
+		conns:   conns,
+	}
+}
+
+// check returns the checks of the connections, they are checked again once the cached ones expire.
+func (rc *readinessChecker) check(ctx context.Context) map[ConnectionID]connectionCheck {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.checks != nil && time.Since(rc.checked) < time.Duration(rc.cfg.CacheTTL) {
+		return rc.checks
+	}
+	// the checks are cached, they do not end with the request which started them
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rc.timeout)
+	defer cancel()
+	checks := make(map[ConnectionID]connectionCheck, len(rc.conns))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for cid, c := range rc.conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cc := connectionCheck{ConnectionReadiness: ConnectionReadiness{ConnectionID: cid}}
+			var err error
+			if len(rc.cfg.RequiredModels) > 0 {
+				var lr *api.ListResponse
+				if lr, err = c.IOllamaClient.List(ctx); err == nil && lr != nil {
+					cc.models = lr.Models
+				}
+			} else {
+				err = c.Heartbeat(ctx)
+			}
+			cc.LastCheck = time.Now()
+			cc.Reachable = err == nil
+			if err != nil {
+				cc.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			checks[cid] = cc
+		}()
+	}
+	wg.Wait()
+	rc.checks, rc.checked = checks, time.Now()
+	return checks
+}
+
+// listsModel reports whether the models listed by a connection include the model, ollama names models without tag as latest.
+func listsModel(models []api.ListModelResponse, model ModelID) bool {
+	name := withLatestTag(model.String())
+	return slices.ContainsFunc(models, func(m api.ListModelResponse) bool {
+		return withLatestTag(m.Model) == name || withLatestTag(m.Name) == name
+	})
+}
+
+func withLatestTag(name string) string {
+	if strings.Contains(name, ":") {
+		return name
+	}
+	return name + ":latest"
+}
+
+// Ready reports whether enough connections are reachable and the required models are available.
+func (r *Router) Ready(ctx context.Context) ReadyResponse {
+	cfg := r.readiness.cfg
+	checks := r.readiness.check(ctx)
+	res := ReadyResponse{Ready: true}
+	reachable := 0
+	for _, cid := range slices.Sorted(maps.Keys(checks)) {
+		res.Connections = append(res.Connections, checks[cid].ConnectionReadiness)
+		if checks[cid].Reachable {
+			reachable++
+		}
+	}
+	var reasons []string
+	if reachable < cfg.MinConnections {
+		reasons = append(reasons, fmt.Sprintf("%d of %d connections reachable, %d required", reachable, len(checks), cfg.MinConnections))
+	}
+	for _, name := range cfg.RequiredModels {
+		mr := ModelReadiness{Model: name}
+		route, _, err := r.getRouteAndModelByModelName(ctx, r.lookupPreset(name.String()).modelName(name.String()))
+		if err != nil {
+			mr.Error = err.Error()
+		} else {
+			for _, b := range route.backends {
+				if cc := checks[b.id]; cc.Reachable && listsModel(cc.models, route.model) {
+					mr.Connections = append(mr.Connections, b.id)
+				}
+			}
+			mr.Available = len(mr.Connections) > 0
+		}
+		if !mr.Available {
+			reasons = append(reasons, fmt.Sprintf("model %s is not available", name))
+		}
+		res.Models = append(res.Models, mr)
+	}
+	if len(reasons) > 0 {
+		res.Ready = false
+		res.Reason = strings.Join(reasons, ", ")
+	}
+	return res
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigLoader provides a fresh configuration each time the router is reloaded.
+type ConfigLoader func() (*GollamasConfig, error)
+
+// reloadDebounce groups the bursts of events editors emit when saving a file.
+var reloadDebounce = 250 * time.Millisecond
+
+type reloader struct {
+	mu   sync.Mutex
+	s    *Service
+	cfg  GollamasConfig
+	load ConfigLoader
+}
+
+func newReloader(s *Service, cfg GollamasConfig, load ConfigLoader) *reloader {
+	return &reloader{
+		s:    s,
+		cfg:  cfg,
+		load: load,
+	}
+}
+
+// Reload loads the configuration and swaps the router of the service.
+// On failure the current router keeps serving requests.
+func (rl *reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	log.Info("Reloading configuration.")
+	cfg, err := rl.load()
+	if err != nil {
+		log.WithError(err).Error("Failed to reload configuration, keeping the current configuration.")
+		return err
+	}
+	r, err := InitRouter(*cfg)
+	if err != nil {
+		log.WithError(err).Error("Failed to reload configuration, keeping the current configuration.")
+		return err
+	}
+	if cfg.Listen != rl.cfg.Listen {
+		log.WithField("listen", rl.cfg.Listen).WithField("new_listen", cfg.Listen).Warn("Changing the listen address requires a restart.")
+	}
+	if cfg.MetricsListen != rl.cfg.MetricsListen {
+		log.WithField("metrics_listen", rl.cfg.MetricsListen).WithField("new_metrics_listen", cfg.MetricsListen).Warn("Changing the metrics listen address requires a restart.")
+	}
+	if cfg.Shutdown != rl.cfg.Shutdown {
+		log.WithField("shutdown", rl.cfg.Shutdown).WithField("new_shutdown", cfg.Shutdown).Warn("Changing the shutdown configuration requires a restart.")
+	}
+	if cfg.Tracing != rl.cfg.Tracing {
+		log.WithField("tracing", rl.cfg.Tracing).WithField("new_tracing", cfg.Tracing).Warn("Changing the tracing configuration requires a restart.")
+	}
+	if cfg.TLS != rl.cfg.TLS {
+		log.WithField("tls", rl.cfg.TLS).WithField("new_tls", cfg.TLS).Warn("Changing the tls configuration requires a restart.")
+	}
+	old := rl.s.Client()
+	// the clients keep their requests and tokens counted across reloads
+	if o, ok := old.(*Router); ok {
+		r.limiter = o.limiter
+	}
+	if err := rl.s.SetClient(r); err != nil {
+		return err
+	}
+	// stops the background work of the previous router, its requests in flight carry on
+	if c, ok := old.(io.Closer); ok {
+		_ = c.Close()
+	}
+	rl.cfg = *cfg
+	log.Info("Configuration reloaded.")
+	return nil
+}
+
+// watch triggers a reload on SIGHUP and, when enabled, on changes to the config file, until ctx is done.
+func (rl *reloader) watch(ctx context.Context) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	path := filepath.Clean(rl.cfg.ConfigFile)
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	var w *fsnotify.Watcher
+	if rl.cfg.WatchConfig && rl.cfg.ConfigFile != "" {
+		var err error
+		w, err = fsnotify.NewWatcher()
+		if err != nil {
+			signal.Stop(sig)
+			return err
+		}
+		// editors often replace the file, watching the directory catches renames and re-creations
+		if err := w.Add(filepath.Dir(path)); err != nil {
+			signal.Stop(sig)
+			_ = w.Close()
+			return err
+		}
+		events, errs = w.Events, w.Errors
+	}
+
+	go func() {
+		defer signal.Stop(sig)
+		if w != nil {
+			defer w.Close()
+		}
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sig:
+				log.Info("Received SIGHUP.")
+				_ = rl.Reload()
+			case e := <-events:
+				if filepath.Clean(e.Name) != path || e.Op == fsnotify.Chmod {
+					continue
+				}
+				log.WithField("path", e.Name).WithField("op", e.Op.String()).Debug("Config file changed.")
+				debounce = time.After(reloadDebounce)
+			case err := <-errs:
+				log.WithError(err).Error("Failed to watch config file.")
+			case <-debounce:
+				debounce = nil
+				_ = rl.Reload()
+			}
+		}
+	}()
+	return nil
+}
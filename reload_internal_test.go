@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReloadConfig(url string) *GollamasConfig {
+	return &GollamasConfig{
+		Connections: map[ConnectionID]ConnectionConfig{"c1": {Url: url}},
+		Models:      map[ModelID]ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+	}
+}
+
+func TestReloaderReload(t *testing.T) {
+	s, err := InitService(*newTestReloadConfig("http://server1:11434"))
+	assert.NoError(t, err)
+	old := s.Client()
+
+	rl := newReloader(s, *newTestReloadConfig("http://server1:11434"), func() (*GollamasConfig, error) {
+		return newTestReloadConfig("http://server2:11434"), nil
+	})
+	assert.NoError(t, rl.Reload())
+	assert.NotSame(t, old, s.Client())
+	assert.Equal(t, "http://server2:11434", rl.cfg.Connections["c1"].Url)
+	assert.Same(t, old.(*Router).limiter, s.Client().(*Router).limiter)
+}
+
+func TestReloaderReloadKeepsConfigOnError(t *testing.T) {
+	s, err := InitService(*newTestReloadConfig("http://server1:11434"))
+	assert.NoError(t, err)
+	old := s.Client()
+
+	rl := newReloader(s, *newTestReloadConfig("http://server1:11434"), func() (*GollamasConfig, error) {
+		return nil, errors.New("could not read config file")
+	})
+	assert.EqualError(t, rl.Reload(), "could not read config file")
+	assert.Same(t, old, s.Client())
+
+	rl.load = func() (*GollamasConfig, error) {
+		cfg := newTestReloadConfig("http://server2:11434")
+		cfg.Models["tinyllama"] = ModelConfig{ConnectionID: "unknown"}
+		return cfg, nil
+	}
+	assert.EqualError(t, rl.Reload(), "invalid connection id: unknown, invalid url scheme")
+	assert.Same(t, old, s.Client())
+	assert.Equal(t, "http://server1:11434", rl.cfg.Connections["c1"].Url)
+}
+
+func TestReloaderWatchConfigFile(t *testing.T) {
+	saveDebounce := reloadDebounce
+	reloadDebounce = 10 * time.Millisecond
+	t.Cleanup(func() { reloadDebounce = saveDebounce })
+
+	p := writeTestConfigFile(t, "config.yaml", "connections:\n  c1:\n    url: http://server1:11434\nmodels:\n  llama3.2:\n    connection: c1\n")
+	load := func() (*GollamasConfig, error) {
+		f, err := loadConfigFile(p)
+		if err != nil {
+			return nil, err
+		}
+		return &f.config, nil
+	}
+	cfg, err := load()
+	assert.NoError(t, err)
+	cfg.ConfigFile = p
+	cfg.WatchConfig = true
+	s, err := InitService(*cfg)
+	assert.NoError(t, err)
+	old := s.Client()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rl := newReloader(s, *cfg, load)
+	assert.NoError(t, rl.watch(ctx))
+
+	assert.NoError(t, os.WriteFile(p, []byte("connections:\n  c1:\n    url: http://server2:11434\nmodels:\n  llama3.2:\n    connection: c1\n"), 0o600))
+	assert.Eventually(t, func() bool {
+		return s.Client() != old
+	}, 5*time.Second, 10*time.Millisecond)
+}
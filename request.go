@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+type requestInfoKey struct{}
+
+// requestInfo collects what is learnt about a request while it is routed and served,
+// ie: the model and connection which answered it and the tokens it used.
+type requestInfo struct {
+	start   time.Time
+	metrics *serviceMetrics // the metrics of the service which received the request
+
+	mu             sync.Mutex
+	requestedModel string
+	alias          ModelID // the alias or preset the request went through
+	model          ModelID
+	connection     ConnectionID
+	stream         bool
+	canceled       bool // the client disconnected before the end of the response
+	firstResponse  time.Time
+	promptTokens   int
+	evalTokens     int
+	evalDuration   time.Duration
+}
+
+// withRequestInfo returns a context in which the router records what it learns about the request.
+func withRequestInfo(ctx context.Context, m *serviceMetrics) (context.Context, *requestInfo) {
+	ri := &requestInfo{start: time.Now(), metrics: m}
+	return context.WithValue(ctx, requestInfoKey{}, ri), ri
+}
+
+// requestInfoFromContext returns nil for the requests of the router itself, the methods of requestInfo accept nil.
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	ri, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return ri
+}
+
+// routed records the model requested by the client once it is known to the router.
+func (ri *requestInfo) routed(requested string, alias ModelID) {
+	if ri == nil {
+		return
+	}
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.requestedModel, ri.alias = requested, alias
+}
+
+// attempt records the model and connection the request is sent to, the last attempt answers the request.
+func (ri *requestInfo) attempt(model ModelID, cid ConnectionID) {
+	if ri == nil {
+		return
+	}
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.model, ri.connection = model, cid
+}
+
+// streamed records whether the response is streamed.
+func (ri *requestInfo) streamed(stream bool) {
+	if ri == nil {
+		return
+	}
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.stream = stream
+}
+
+// cancel records that the client disconnected before the end of the response.
+func (ri *requestInfo) cancel() {
+	if ri == nil {
+		return
+	}
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.canceled = true
+}
+
+// respond records the first response of the upstream.
+func (ri *requestInfo) respond() {
+	if ri == nil {
+		return
+	}
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	if ri.firstResponse.IsZero() {
+		ri.firstResponse = time.Now()
+	}
+}
+
+// done records the tokens reported by the final response of the upstream.
+func (ri *requestInfo) done(m api.Metrics) {
+	if ri == nil {
+		return
+	}
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.promptTokens, ri.evalTokens, ri.evalDuration = m.PromptEvalCount, m.EvalCount, m.EvalDuration
+}
+
+// snapshot returns a copy of the information, which is safe to read.
+func (ri *requestInfo) snapshot() requestInfo {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	return requestInfo{
+		start:          ri.start,
+		requestedModel: ri.requestedModel,
+		alias:          ri.alias,
+		model:          ri.model,
+		connection:     ri.connection,
+		stream:         ri.stream,
+		canceled:       ri.canceled,
+		firstResponse:  ri.firstResponse,
+		promptTokens:   ri.promptTokens,
+		evalTokens:     ri.evalTokens,
+		evalDuration:   ri.evalDuration,
+	}
+}
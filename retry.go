@@ -0,0 +1,162 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultRetryMaxBackoff = 2 * time.Second
+	defaultRetryBudget     = 0.2
+	// retryBudgetBurst is the number of retries available before the budget starts to be enforced.
+	retryBudgetBurst = 10
+)
+
+// RetryConfig configures the retries of failed requests on the other connections serving a model.
+// Retries are disabled when MaxAttempts is lower than 2.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of connections tried for a request, including the first one.
+	MaxAttempts int `json:"max_attempts,omitempty" yaml:"max_attempts,omitempty" toml:"max_attempts,omitempty"`
+	// Backoff is the wait before the first retry, doubled on each retry, defaults to 100ms.
+	Backoff    Duration `json:"backoff,omitempty" yaml:"backoff,omitempty" toml:"backoff,omitempty"`
+	MaxBackoff Duration `json:"max_backoff,omitempty" yaml:"max_backoff,omitempty" toml:"max_backoff,omitempty"`
+	// Budget is the ratio of retries to requests allowed for a model, defaults to 0.2.
+	Budget float64 `json:"budget,omitempty" yaml:"budget,omitempty" toml:"budget,omitempty"`
+}
+
+func (rc RetryConfig) validate() error {
+	if rc.MaxAttempts < 0 {
+		return fmt.Errorf("invalid retry max attempts: %d", rc.MaxAttempts)
+	}
+	if rc.Backoff < 0 {
+		return fmt.Errorf("invalid retry backoff: %s", rc.Backoff)
+	}
+	if rc.MaxBackoff < 0 {
+		return fmt.Errorf("invalid retry max backoff: %s", rc.MaxBackoff)
+	}
+	if rc.Budget < 0 {
+		return fmt.Errorf("invalid retry budget: %v", rc.Budget)
+	}
+	return nil
+}
+
+// merge fills the settings missing from the model configuration with the default ones.
+func (rc RetryConfig) merge(def RetryConfig) RetryConfig {
+	return RetryConfig{
+		MaxAttempts: cmp.Or(rc.MaxAttempts, def.MaxAttempts),
+		Backoff:     cmp.Or(rc.Backoff, def.Backoff, Duration(defaultRetryBackoff)),
+		MaxBackoff:  cmp.Or(rc.MaxBackoff, def.MaxBackoff, Duration(defaultRetryMaxBackoff)),
+		Budget:      cmp.Or(rc.Budget, def.Budget, defaultRetryBudget),
+	}
+}
+
+func (rc RetryConfig) backoff(retry int) time.Duration {
+	d := time.Duration(rc.Backoff)
+	for i := 1; i < retry && d < time.Duration(rc.MaxBackoff); i++ {
+		d *= 2
+	}
+	return min(d, time.Duration(rc.MaxBackoff))
+}
+
+// retryBudget limits the retries to a share of the requests so that retries do not overload the connections left.
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{
+		ratio:  ratio,
+		tokens: retryBudgetBurst,
+	}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.ratio, retryBudgetBurst)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// isRetryable reports whether the request failed because of the connection rather than because of the request itself.
+// The requests ended by their own context are not, while the timeouts of the connections, which are also deadline errors, are.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var be *breakerOpenError
+	if errors.As(err, &be) {
+		return true
+	}
+	var he *HttpError
+	if errors.As(err, &he) {
+		// the errors of the router itself, ie: the queues which are full, are answered as is
+		return false
+	}
+	var se api.StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= http.StatusInternalServerError || se.StatusCode == http.StatusTooManyRequests
+	}
+	var ue *url.Error
+	var ne net.Error
+	return errors.As(err, &ue) || errors.As(err, &ne) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// routeCall sends a request to a connection, forwarded is set once a response has been passed on to the caller.
+type routeCall[T any] func(cl *connection, forwarded *atomic.Bool) (T, error)
+
+// callRoute sends the request to a connection of the route and, when the retry policy allows it,
+// retries on the other connections as long as nothing has been forwarded to the caller.
+func callRoute[T any](ctx context.Context, route *modelRoute, call routeCall[T]) (T, error) {
+	route.budget.deposit()
+	var tried []*connection
+	for attempt := 1; ; attempt++ {
+		cl := route.pick(tried...)
+		tried = append(tried, cl)
+		var forwarded atomic.Bool
+		res, err := call(cl, &forwarded)
+		if err == nil || forwarded.Load() || !isRetryable(ctx, err) {
+			return res, err
+		}
+		logger := log.WithField("model_id", route.model).WithField("connection_id", cl.id).WithField("attempt", attempt).WithError(err)
+		if attempt >= route.retry.MaxAttempts || !route.hasUntried(tried) {
+			return res, err
+		}
+		if !route.budget.withdraw() {
+			logger.Warn("Retry budget exhausted, not retrying.")
+			return res, err
+		}
+		logger.Info("Request failed, retrying on another connection.")
+		select {
+		case <-ctx.Done():
+			return res, err
+		case <-time.After(route.retry.backoff(attempt)):
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryConfigBackoff(t *testing.T) {
+	rc := RetryConfig{Backoff: Duration(100 * time.Millisecond), MaxBackoff: Duration(time.Second)}
+	assert.Equal(t, 100*time.Millisecond, rc.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, rc.backoff(2))
+	assert.Equal(t, 400*time.Millisecond, rc.backoff(3))
+	assert.Equal(t, 800*time.Millisecond, rc.backoff(4))
+	assert.Equal(t, time.Second, rc.backoff(5))
+	assert.Equal(t, time.Second, rc.backoff(50))
+}
+
+func TestRetryConfigMerge(t *testing.T) {
+	assert.Equal(t, RetryConfig{
+		MaxAttempts: 2,
+		Backoff:     Duration(defaultRetryBackoff),
+		MaxBackoff:  Duration(time.Second),
+		Budget:      defaultRetryBudget,
+	}, RetryConfig{MaxAttempts: 2}.merge(RetryConfig{MaxAttempts: 3, MaxBackoff: Duration(time.Second)}))
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(0.5)
+	for range retryBudgetBurst {
+		assert.True(t, b.withdraw())
+	}
+	assert.False(t, b.withdraw())
+	b.deposit()
+	assert.False(t, b.withdraw())
+	b.deposit()
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+}
+
+func TestIsRetryable(t *testing.T) {
+	ctx := context.Background()
+	for err, expected := range map[error]bool{
+		&url.Error{Op: "Post", URL: "http://server1", Err: errors.New("connection refused")}: true,
+		fmt.Errorf("wrapped: %w", io.ErrUnexpectedEOF):                                       true,
+		api.StatusError{StatusCode: http.StatusServiceUnavailable}:                           true,
+		api.StatusError{StatusCode: http.StatusTooManyRequests}:                              true,
+		api.StatusError{StatusCode: http.StatusNotFound}:                                     false,
+		&url.Error{Op: "Post", URL: "http://server1", Err: context.DeadlineExceeded}:         true,
+		&url.Error{Op: "Post", URL: "http://server1", Err: context.Canceled}:                 false,
+		errors.New("some error"):                                                             false,
+		(&circuitBreaker{id: "c1", state: breakerOpen}).openError():                          true,
+		NewHttpError(http.StatusServiceUnavailable, "gollamas: too many requests queued"):    false,
+	} {
+		assert.Equal(t, expected, isRetryable(ctx, err), err.Error())
+	}
+
+	// the requests ended by their own context are not retried
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.False(t, isRetryable(canceled, &url.Error{Op: "Post", URL: "http://server1", Err: context.Canceled}))
+	expired, cancel := context.WithDeadline(ctx, time.Now())
+	defer cancel()
+	assert.False(t, isRetryable(expired, &url.Error{Op: "Post", URL: "http://server1", Err: context.DeadlineExceeded}))
+}
@@ -3,14 +3,18 @@ package main
 import (
 	"cmp"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"net/url"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/types/model"
@@ -36,7 +40,39 @@ func (mid *ModelID) String() string {
 }
 
 type ModelConfig struct {
-	ConnectionID ConnectionID
+	ConnectionID ConnectionID   `json:"connection" yaml:"connection" toml:"connection"`
+	Connections  []ConnectionID `json:"connections,omitempty" yaml:"connections,omitempty" toml:"connections,omitempty"`
+	Balancer     string         `json:"balancer,omitempty" yaml:"balancer,omitempty" toml:"balancer,omitempty"`
+	// Retry overrides the default retry policy for the model.
+	Retry *RetryConfig `json:"retry,omitempty" yaml:"retry,omitempty" toml:"retry,omitempty"`
+	// Preload loads the model on each of its connections at startup and when a connection recovers.
+	Preload bool `json:"preload,omitempty" yaml:"preload,omitempty" toml:"preload,omitempty"`
+	// KeepWarm preloads the model and pings it before it expires so that it is never unloaded.
+	KeepWarm bool `json:"keep_warm,omitempty" yaml:"keep_warm,omitempty" toml:"keep_warm,omitempty"`
+	// KeepAlive sets the keep_alive of the requests for the model.
+	KeepAlive KeepAliveConfig `json:"keep_alive,omitempty" yaml:"keep_alive,omitempty" toml:"keep_alive,omitempty"`
+	// Options overrides the default options policy for the model, option by option.
+	Options OptionsPolicy `json:"options,omitempty" yaml:"options,omitempty" toml:"options,omitempty"`
+	// Fallbacks are the models, or aliases, tried in order when the model cannot answer a request.
+	Fallbacks []ModelID `json:"fallbacks,omitempty" yaml:"fallbacks,omitempty" toml:"fallbacks,omitempty"`
+	// RateLimit limits the requests of each client for the model, on top of the limits covering all the models.
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty" toml:"rate_limit,omitempty"`
+	// Queue limits the requests in flight for the model across all its connections.
+	Queue *QueueConfig `json:"queue,omitempty" yaml:"queue,omitempty" toml:"queue,omitempty"`
+}
+
+// ConnectionIDs lists the connections serving the model, ConnectionID first, without duplicates.
+func (mc ModelConfig) ConnectionIDs() []ConnectionID {
+	var res []ConnectionID
+	if mc.ConnectionID != "" {
+		res = append(res, mc.ConnectionID)
+	}
+	for _, cid := range mc.Connections {
+		if !slices.Contains(res, cid) {
+			res = append(res, cid)
+		}
+	}
+	return res
 }
 
 // NewRouter creates a new router
@@ -47,70 +83,364 @@ func NewRouter(cmap map[ConnectionID]IOllamaClient, mconf map[ModelID]ModelConfi
 	if len(cmap) == 0 {
 		return nil, errors.New("empty ollama client map")
 	}
-	clids := make(map[ConnectionID]IOllamaClient, len(cmap))
+	opt := RouterOptions{ExposeAliases: true, Balancer: RoundRobinBalancer}
+	for _, o := range opts {
+		if err := o.ApplyTo(&opt); err != nil {
+			return nil, fmt.Errorf("failed to apply options: %w", err)
+		}
+	}
+	clids := make(map[ConnectionID]*connection, len(cmap))
 	all2ModelID := map[ModelID]ModelID{}
 	cids2models := map[ConnectionID][]ModelID{}
+	routes := map[ModelID]*modelRoute{}
+	var wildcards []*wildcardRoute
+	var warm []*warmTarget
+	var rs *residency
+	if opt.PreferLoaded {
+		rs = newResidency()
+	}
 
 	for id, cl := range cmap {
 		if cl == nil {
 			return nil, fmt.Errorf("nil client for connection id %s", id)
 		}
-		clids[id] = cl
+		clids[id] = newConnection(id, cl, opt.Weights[id])
+		clids[id].keepAlive = opt.ConnectionKeepAlive[id]
+		if opt.CircuitBreaker.FailureRatio > 0 {
+			clids[id].breaker = newCircuitBreaker(id, opt.CircuitBreaker)
+		}
+		clids[id].queue = newRequestQueue("connection", id.String(), opt.ConnectionQueues[id].merge(opt.Queue))
 		cids2models[id] = []ModelID{}
 	}
 	for id, mc := range mconf {
-		cid := mc.ConnectionID.String()
-		if strings.TrimSpace(cid) == "" {
+		cids := mc.ConnectionIDs()
+		if len(cids) == 0 {
 			return nil, fmt.Errorf("empty connection id for model %s", id)
 		}
-		if _, ok := clids[mc.ConnectionID]; !ok {
-			return nil, fmt.Errorf("unknown connection id for model %s", id)
+		route := &modelRoute{model: id, residency: rs, keepAlive: mc.KeepAlive}
+		for _, cid := range cids {
+			if strings.TrimSpace(cid.String()) == "" {
+				return nil, fmt.Errorf("empty connection id for model %s", id)
+			}
+			cl, ok := clids[cid]
+			if !ok {
+				return nil, fmt.Errorf("unknown connection id for model %s", id)
+			}
+			if !id.IsWildcard() {
+				cids2models[cid] = append(cids2models[cid], id)
+			}
+			route.backends = append(route.backends, cl)
 		}
-		cids2models[mc.ConnectionID] = append(cids2models[mc.ConnectionID], id)
 		name := model.ParseName(id.String())
-		if !name.IsValid() {
+		if id.IsWildcard() {
+			if err := validateWildcard(id); err != nil {
+				return nil, err
+			}
+			if mc.Preload || mc.KeepWarm {
+				return nil, fmt.Errorf("model pattern %s cannot be preloaded", id)
+			}
+		} else if !name.IsValid() {
 			return nil, fmt.Errorf("invalid model name: %s", id)
 		}
+		balancer := cmp.Or(mc.Balancer, opt.Balancer)
+		b, err := NewBalancer(balancer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid balancer for model %s: %w", id, err)
+		}
+		route.balancer = b
+		if mc.Retry != nil {
+			if err := mc.Retry.validate(); err != nil {
+				return nil, fmt.Errorf("invalid retry policy for model %s: %w", id, err)
+			}
+			route.retry = mc.Retry.merge(opt.Retry)
+		} else {
+			route.retry = RetryConfig{}.merge(opt.Retry)
+		}
+		if err := mc.Options.validate(); err != nil {
+			return nil, fmt.Errorf("invalid options policy for model %s: %w", id, err)
+		}
+		route.options = mc.Options.merge(opt.Options)
+		if mc.RateLimit != nil {
+			if err := mc.RateLimit.validate(); err != nil {
+				return nil, fmt.Errorf("invalid rate limit for model %s: %w", id, err)
+			}
+			route.rateLimit = *mc.RateLimit
+		}
+		var queue QueueConfig
+		if mc.Queue != nil {
+			if err := mc.Queue.validate(); err != nil {
+				return nil, fmt.Errorf("invalid queue for model %s: %w", id, err)
+			}
+			queue = *mc.Queue
+		}
+		if id.IsWildcard() {
+			wildcards = append(wildcards, &wildcardRoute{
+				pattern:   id,
+				backends:  route.backends,
+				balancer:  balancer,
+				retry:     route.retry,
+				residency: rs,
+				keepAlive: mc.KeepAlive,
+				options:   route.options,
+				rateLimit: route.rateLimit,
+				queue:     queue,
+			})
+			continue
+		}
+		route.queue = newRequestQueue("model", id.String(), queue)
+		route.budget = newRetryBudget(route.retry.Budget)
+		routes[id] = route
+		if mc.Preload || mc.KeepWarm {
+			for _, b := range route.backends {
+				keepAlive := mc.KeepAlive.merge(b.keepAlive).merge(opt.KeepAlive).apply(nil)
+				warm = append(warm, newWarmTarget(id, b, mc.KeepWarm, keepAlive))
+			}
+		}
 		all2ModelID[id] = id
 		all2ModelID[ModelID(name.DisplayShortest())] = id
 	}
-	opt := RouterOptions{ExposeAliases: true}
-	for _, o := range opts {
-		if err := o.ApplyTo(&opt); err != nil {
-			return nil, fmt.Errorf("failed to apply options: %w", err)
-		}
-	}
 	r := &Router{
-		cmap:          clids,
-		modelCfg:      mconf,
-		cids2models:   cids2models,
-		all2ModelID:   all2ModelID,
-		exposeAliases: opt.ExposeAliases,
+		cmap:             clids,
+		modelCfg:         mconf,
+		routes:           routes,
+		cids2models:      cids2models,
+		all2ModelID:      all2ModelID,
+		exposeAliases:    opt.ExposeAliases,
+		residency:        rs,
+		defaultKeepAlive: opt.KeepAlive,
+		limiter:          newRateLimiter(),
+		rateLimit:        opt.RateLimit,
+		readiness:        newReadinessChecker(opt.Readiness, time.Duration(opt.HealthCheck.withDefaults().Timeout), clids),
 	}
 	if err := r.setAliases(opt.Aliases); err != nil {
 		return nil, err
 	}
+	if err := r.setPresets(opt.Presets); err != nil {
+		return nil, err
+	}
+	if err := r.setFallbacks(wildcards); err != nil {
+		return nil, err
+	}
+	if err := r.setAPIKeys(opt.APIKeys); err != nil {
+		return nil, err
+	}
+	if len(wildcards) > 0 {
+		r.discovery = newDiscovery(wildcards, time.Duration(opt.DiscoveryInterval))
+		r.discovery.start()
+	}
+	if len(warm) > 0 {
+		// models are loaded again on the connections which recover
+		for _, c := range clids {
+			var targets []*warmTarget
+			for _, t := range warm {
+				if t.conn == c {
+					targets = append(targets, t)
+				}
+			}
+			if len(targets) > 0 {
+				c.onRecover = func() {
+					for _, t := range targets {
+						t.wakeUp()
+					}
+				}
+			}
+		}
+		r.warmer = newWarmer(warm, cmp.Or(time.Duration(opt.KeepWarmInterval), defaultKeepWarmInterval))
+		r.warmer.start()
+	}
+	if opt.HealthCheck.Interval > 0 {
+		r.health = newHealthChecker(opt.HealthCheck, slices.Collect(maps.Values(clids)))
+		r.health.start()
+	}
+	if rs != nil && len(clids) > 1 {
+		r.residencyLoop = startLoop(cmp.Or(time.Duration(opt.PreferLoadedInterval), defaultPreferLoadedInterval), func(ctx context.Context) {
+			// the running models of each connection are recorded by ListRunning
+			_, _ = r.ListRunning(ctx)
+		})
+	}
 	return r, nil
 }
 
+// modelRoute holds the connections serving a model and the strategy used to pick one of them.
+type modelRoute struct {
+	model     ModelID
+	backends  []*connection
+	balancer  Balancer
+	retry     RetryConfig
+	budget    *retryBudget
+	residency *residency // nil unless the connections with the model loaded are preferred
+	keepAlive KeepAliveConfig
+	options   OptionsPolicy
+	fallbacks []*modelRoute
+	rateLimit RateLimitConfig
+	queue     *requestQueue // nil when the requests for the model are not limited
+}
+
+// pick selects the connection serving the next request, skipping the connections already tried.
+func (mr *modelRoute) pick(tried ...*connection) *connection {
+	available := mr.loaded(mr.available(tried))
+	var cl *connection
+	if len(available) == 1 {
+		cl = available[0]
+	} else {
+		backends := make([]Backend, len(available))
+		for i, b := range available {
+			backends[i] = b
+		}
+		cl = available[mr.balancer.Pick(backends)]
+	}
+	log.WithField("model_id", mr.model).WithField("connection_id", cl.id).Trace("Routing: selected connection.")
+	return cl
+}
+
+// available skips the connections already tried and the unavailable ones,
+// unless none of the connections left are available.
+func (mr *modelRoute) available(tried []*connection) []*connection {
+	if len(mr.backends) == 1 {
+		return mr.backends
+	}
+	var candidates, available []*connection
+	for _, b := range mr.backends {
+		if slices.Contains(tried, b) {
+			continue
+		}
+		candidates = append(candidates, b)
+		if b.Available() {
+			available = append(available, b)
+		}
+	}
+	if len(available) > 0 {
+		return available
+	}
+	if len(candidates) > 0 {
+		return candidates
+	}
+	return mr.backends
+}
+
+// loaded keeps the connections on which the model is loaded, when there are any,
+// so that requests do not wait for the model to be loaded on another connection.
+func (mr *modelRoute) loaded(available []*connection) []*connection {
+	if mr.residency == nil || len(available) == 1 {
+		return available
+	}
+	var loaded []*connection
+	for _, b := range available {
+		if mr.residency.isLoaded(b.id, mr.model) {
+			loaded = append(loaded, b)
+		}
+	}
+	if len(loaded) == 0 {
+		return available
+	}
+	log.WithField("model_id", mr.model).WithField("connections", len(loaded)).Trace("Routing: model is loaded.")
+	return loaded
+}
+
+func (mr *modelRoute) hasUntried(tried []*connection) bool {
+	for _, b := range mr.backends {
+		if !slices.Contains(tried, b) {
+			return true
+		}
+	}
+	return false
+}
+
 // Router is a router that routes requests to the appropriate client
 type Router struct {
 	modelCfg      map[ModelID]ModelConfig
-	cmap          map[ConnectionID]IOllamaClient
+	cmap          map[ConnectionID]*connection
+	routes        map[ModelID]*modelRoute
 	cids2models   map[ConnectionID][]ModelID
 	all2ModelID   map[ModelID]ModelID // this is a temporary map of all possible names with the id of the connection
 	alias2model   map[ModelID]ModelID
 	model2aliases map[ModelID][]ModelID
+	presets       map[ModelID]*preset
+	model2presets map[ModelID][]ModelID
 	exposeAliases bool
+	health        *healthChecker
+	discovery     *discovery // nil without wildcard routes
+	residency     *residency // nil unless the connections with the model loaded are preferred
+	residencyLoop *loop
+	warmer        *warmer                       // nil without preloaded models
+	apiKeys       map[[sha256.Size]byte]*apiKey // nil when the requests are not authenticated
+	certKeys      map[string]*apiKey            // the keys by the identity of their client certificate
+	limiter       *rateLimiter
+	// rateLimit limits the requests of each client for all the models.
+	rateLimit RateLimitConfig
+	// defaultKeepAlive is the keep alive policy of the models and connections which do not set one.
+	defaultKeepAlive KeepAliveConfig
+	readiness        *readinessChecker
+}
+
+// Close stops the background health checks, model discovery, refresh of the loaded models
+// and preloading of the models of the router. Requests in flight are not interrupted.
+func (r *Router) Close() error {
+	if r.warmer != nil {
+		r.warmer.stop()
+	}
+	if r.health != nil {
+		r.health.stop()
+	}
+	if r.discovery != nil {
+		r.discovery.stop()
+	}
+	r.residencyLoop.stop()
+	return nil
+}
+
+// Health returns the health state of each connection, sorted by connection id.
+func (r *Router) Health() []ConnectionHealth {
+	res := make([]ConnectionHealth, 0, len(r.cmap))
+	for _, cid := range slices.Sorted(maps.Keys(r.cmap)) {
+		res = append(res, r.cmap[cid].Health())
+	}
+	return res
+}
+
+// Warm returns the state of the preloaded models on each of their connections, sorted by model and connection id.
+func (r *Router) Warm() []WarmState {
+	if r.warmer == nil {
+		return nil
+	}
+	res := make([]WarmState, 0, len(r.warmer.targets))
+	for _, t := range r.warmer.targets {
+		res = append(res, t.State())
+	}
+	slices.SortFunc(res, func(a, b WarmState) int {
+		return cmp.Or(cmp.Compare(a.Model, b.Model), cmp.Compare(a.ConnectionID, b.ConnectionID))
+	})
+	return res
 }
 
 func (r *Router) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
-	cl, m, err := r.getClientAndModelByModelName(req.Model)
+	p, route, err := r.routeModel(ctx, req.Model)
 	if err != nil {
 		return err
 	}
-	req.Model = m.String()
-	return cl.Chat(ctx, req, fn)
+	req.Messages = p.messages(req.Messages)
+	options, requested := req.Options, req.KeepAlive
+	_, err = callModels(ctx, r, route, func(route *modelRoute, cl *connection, forwarded *atomic.Bool) (any, int, error) {
+		var tokens int
+		req.Model = route.model.String()
+		req.Options = route.applyOptions(p.applyOptions(options))
+		req.KeepAlive = r.keepAlive(route, cl, requested)
+		err := cl.Chat(ctx, req, func(resp api.ChatResponse) error {
+			forwarded.Store(true)
+			if resp.Done {
+				tokens = resp.PromptEvalCount + resp.EvalCount
+			} else {
+				// each chunk holds a token, so the interrupted streams are counted too
+				tokens++
+			}
+			return fn(resp)
+		})
+		if err == nil {
+			r.residency.served(cl.id, route.model, req.KeepAlive)
+		}
+		return nil, tokens, err
+	})
+	return err
 }
 
 func (r *Router) Copy(ctx context.Context, req *api.CopyRequest) error {
@@ -130,30 +460,74 @@ func (r *Router) Delete(ctx context.Context, req *api.DeleteRequest) error {
 }
 
 func (r *Router) Embed(ctx context.Context, req *api.EmbedRequest) (*api.EmbedResponse, error) {
-	cl, m, err := r.getClientAndModelByModelName(req.Model)
+	p, route, err := r.routeModel(ctx, req.Model)
 	if err != nil {
 		return nil, err
 	}
-	req.Model = m.String()
-	return cl.Embed(ctx, req)
+	options, requested := req.Options, req.KeepAlive
+	return callModels(ctx, r, route, func(route *modelRoute, cl *connection, _ *atomic.Bool) (*api.EmbedResponse, int, error) {
+		var tokens int
+		req.Model = route.model.String()
+		req.Options = route.applyOptions(p.applyOptions(options))
+		req.KeepAlive = r.keepAlive(route, cl, requested)
+		res, err := cl.Embed(ctx, req)
+		if err == nil && res != nil {
+			tokens = res.PromptEvalCount
+		}
+		if err == nil {
+			r.residency.served(cl.id, route.model, req.KeepAlive)
+		}
+		return res, tokens, err
+	})
 }
 
 func (r *Router) Embeddings(ctx context.Context, req *api.EmbeddingRequest) (*api.EmbeddingResponse, error) {
-	cl, m, err := r.getClientAndModelByModelName(req.Model)
+	p, route, err := r.routeModel(ctx, req.Model)
 	if err != nil {
 		return nil, err
 	}
-	req.Model = m.String()
-	return cl.Embeddings(ctx, req)
+	options, requested := req.Options, req.KeepAlive
+	return callModels(ctx, r, route, func(route *modelRoute, cl *connection, _ *atomic.Bool) (*api.EmbeddingResponse, int, error) {
+		req.Model = route.model.String()
+		req.Options = route.applyOptions(p.applyOptions(options))
+		req.KeepAlive = r.keepAlive(route, cl, requested)
+		res, err := cl.Embeddings(ctx, req)
+		if err == nil {
+			r.residency.served(cl.id, route.model, req.KeepAlive)
+		}
+		return res, 0, err
+	})
 }
 
 func (r *Router) Generate(ctx context.Context, req *api.GenerateRequest, fn api.GenerateResponseFunc) error {
-	cl, m, err := r.getClientAndModelByModelName(req.Model)
+	p, route, err := r.routeModel(ctx, req.Model)
 	if err != nil {
 		return err
 	}
-	req.Model = m.String()
-	return cl.Generate(ctx, req, fn)
+	req.System = p.systemPrompt(req.System)
+	req.Template = p.promptTemplate(req.Template)
+	options, requested := req.Options, req.KeepAlive
+	_, err = callModels(ctx, r, route, func(route *modelRoute, cl *connection, forwarded *atomic.Bool) (any, int, error) {
+		var tokens int
+		req.Model = route.model.String()
+		req.Options = route.applyOptions(p.applyOptions(options))
+		req.KeepAlive = r.keepAlive(route, cl, requested)
+		err := cl.Generate(ctx, req, func(resp api.GenerateResponse) error {
+			forwarded.Store(true)
+			if resp.Done {
+				tokens = resp.PromptEvalCount + resp.EvalCount
+			} else {
+				// each chunk holds a token, so the interrupted streams are counted too
+				tokens++
+			}
+			return fn(resp)
+		})
+		if err == nil {
+			r.residency.served(cl.id, route.model, req.KeepAlive)
+		}
+		return nil, tokens, err
+	})
+	return err
 }
 
 func (r *Router) Heartbeat(ctx context.Context) error {
@@ -177,7 +551,9 @@ func (r *Router) Heartbeat(ctx context.Context) error {
 	}()
 	var err error
 	for r := range ch {
-		errors.Join(err, r.err)
+		if r.err != nil {
+			err = errors.Join(err, fmt.Errorf("connection %s: %w", r.cid, r.err))
+		}
 	}
 	return err
 }
@@ -194,8 +570,9 @@ func (r *Router) List(ctx context.Context) (*api.ListResponse, error) {
 				log.WithField("connection_id", cid).WithError(err).Errorf("Failed to retrieve models.")
 			}
 			if v != nil {
+				// the response of the connection is left untouched, it may be shared with other callers
 				ids := r.cids2models[cid]
-				v.Models = r.filterListToMapedModels(v.Models, ids...)
+				v = &api.ListResponse{Models: r.filterListToMapedModels(cid, v.Models, ids...)}
 			}
 			ch <- v
 		}(cid, v)
@@ -214,10 +591,34 @@ func (r *Router) List(ctx context.Context) (*api.ListResponse, error) {
 		// most recently modified first
 		return cmp.Compare(j.ModifiedAt.Unix(), i.ModifiedAt.Unix())
 	})
+	// models served by several connections are listed once, with their most recent version
+	res.Models = dedupeModels(res.Models, func(m api.ListModelResponse) string { return m.Model }, func(a, b api.ListModelResponse) bool {
+		return a.ModifiedAt.After(b.ModifiedAt)
+	})
+	res.Models = allowedModels(ctx, r, res.Models, func(m api.ListModelResponse) string { return m.Model })
 	return &res, nil
 }
 
-func (r *Router) filterListToMapedModels(orig []api.ListModelResponse, ids ...ModelID) []api.ListModelResponse {
+// dedupeModels keeps the first entry of each model, unless a later entry is better.
+func dedupeModels[T any](models []T, key func(T) string, better func(a, b T) bool) []T {
+	if len(models) == 0 {
+		return models
+	}
+	res := make([]T, 0, len(models))
+	idx := map[string]int{}
+	for _, m := range models {
+		i, ok := idx[key(m)]
+		if !ok {
+			idx[key(m)] = len(res)
+			res = append(res, m)
+		} else if better(m, res[i]) {
+			res[i] = m
+		}
+	}
+	return res
+}
+
+func (r *Router) filterListToMapedModels(cid ConnectionID, orig []api.ListModelResponse, ids ...ModelID) []api.ListModelResponse {
 	idsmap := map[string]ModelID{}
 	for _, id := range ids {
 		idsmap[id.String()] = id
@@ -243,6 +644,19 @@ func (r *Router) filterListToMapedModels(orig []api.ListModelResponse, ids ...Mo
 					})
 				}
 			}
+			// presets are always listed, they are models of their own
+			for _, p := range r.model2presets[id] {
+				res = append(res, api.ListModelResponse{
+					Name:       p.String(),
+					Model:      p.String(),
+					ModifiedAt: m.ModifiedAt,
+					Size:       m.Size,
+					Digest:     m.Digest,
+					Details:    m.Details,
+				})
+			}
+		} else if r.isDiscoveredOn(cid, m.Model) {
+			res = append(res, m)
 		} else {
 			log.WithField("name", m.Name).WithField("model", m.Model).Trace("Model has been filtered out of response.")
 		}
@@ -250,6 +664,28 @@ func (r *Router) filterListToMapedModels(orig []api.ListModelResponse, ids ...Mo
 	return res
 }
 
+func (r *Router) matchWildcard(name string) *wildcardRoute {
+	if r.discovery == nil {
+		return nil
+	}
+	return r.discovery.match(name)
+}
+
+// isDiscoveredOn reports whether a model listed by the connection is exposed by its wildcard routes,
+// models with an explicit route are only listed from the connections of that route.
+func (r *Router) isDiscoveredOn(cid ConnectionID, name string) bool {
+	if r.discovery == nil {
+		return false
+	}
+	if _, ok := r.all2ModelID[ModelID(name)]; ok {
+		return false
+	}
+	if _, ok := r.all2ModelID[ModelID(modelKey(name))]; ok {
+		return false
+	}
+	return r.discovery.matches(cid, name)
+}
+
 func (r *Router) ListRunning(ctx context.Context) (*api.ProcessResponse, error) {
 	type rsp struct {
 		v *api.ProcessResponse
@@ -264,10 +700,12 @@ func (r *Router) ListRunning(ctx context.Context) (*api.ProcessResponse, error)
 			v, err := cl.ListRunning(ctx)
 			if err != nil {
 				log.WithField("connection_id", cid).WithError(err).Errorf("Failed to retrieve running models.")
+			} else if v != nil {
+				r.residency.update(cid, v.Models)
 			}
 			if v != nil {
 				ids := r.cids2models[cid]
-				v.Models = r.filterRunningListToMapedModels(v.Models, ids...)
+				v = &api.ProcessResponse{Models: r.filterRunningListToMapedModels(cid, v.Models, ids...)}
 			}
 			ch <- &rsp{
 				v: v,
@@ -289,10 +727,15 @@ func (r *Router) ListRunning(ctx context.Context) (*api.ProcessResponse, error)
 		// sort by name
 		return -1 * cmp.Compare(j.Name, i.Name)
 	})
+	// models running on several connections are listed once, with the instance which stays loaded the longest
+	res.Models = dedupeModels(res.Models, func(m api.ProcessModelResponse) string { return m.Model }, func(a, b api.ProcessModelResponse) bool {
+		return a.ExpiresAt.After(b.ExpiresAt)
+	})
+	res.Models = allowedModels(ctx, r, res.Models, func(m api.ProcessModelResponse) string { return m.Model })
 	return &res, nil
 }
 
-func (r *Router) filterRunningListToMapedModels(orig []api.ProcessModelResponse, ids ...ModelID) []api.ProcessModelResponse {
+func (r *Router) filterRunningListToMapedModels(cid ConnectionID, orig []api.ProcessModelResponse, ids ...ModelID) []api.ProcessModelResponse {
 	idsmap := map[string]ModelID{}
 	for _, id := range ids {
 		idsmap[id.String()] = id
@@ -318,6 +761,8 @@ func (r *Router) filterRunningListToMapedModels(orig []api.ProcessModelResponse,
 					})
 				}
 			}
+		} else if r.isDiscoveredOn(cid, m.Model) {
+			res = append(res, m)
 		} else {
 			log.WithField("name", m.Name).WithField("model", m.Model).Trace("Model has been filtered out of response.")
 		}
@@ -325,17 +770,36 @@ func (r *Router) filterRunningListToMapedModels(orig []api.ProcessModelResponse,
 	return res
 }
 
+// Pull pulls a model on one of the connections of its route, or of the wildcard route it matches.
+// The pulls are limited like the other requests of the client but they are not queued:
+// they download the model without loading it, and would hold the slot of a connection for minutes.
 func (r *Router) Pull(ctx context.Context, req *api.PullRequest, fn api.PullProgressFunc) error {
-	cl, m, err := r.getClientAndModelByModelName(cmp.Or(req.Model, req.Name))
+	name := cmp.Or(req.Model, req.Name)
+	if err := r.authorize(ctx, name); err != nil {
+		return err
+	}
+	route, m, err := r.getRouteAndModelByModelName(ctx, name)
+	if err != nil {
+		// models matching a wildcard route can be pulled on its connections
+		var httpErr *HttpError
+		w := r.matchWildcard(name)
+		if w == nil || !errors.As(err, &httpErr) || httpErr.StatusCode() != http.StatusNotFound {
+			return err
+		}
+		m = ModelID(name)
+		route = w.newRoute(m, w.backends)
+	}
+	done, err := r.admit(ctx, route)
 	if err != nil {
 		return err
 	}
+	defer done(0, "")
 	if req.Model == "" {
 		req.Name = m.String()
 	} else {
 		req.Model = m.String()
 	}
-	return cl.Pull(ctx, req, fn)
+	return route.pick().Pull(ctx, req, fn)
 }
 
 func (r *Router) Push(ctx context.Context, req *api.PushRequest, fn api.PushProgressFunc) error {
@@ -343,16 +807,19 @@ func (r *Router) Push(ctx context.Context, req *api.PushRequest, fn api.PushProg
 }
 
 func (r *Router) Show(ctx context.Context, req *api.ShowRequest) (*api.ShowResponse, error) {
-	cl, m, err := r.getClientAndModelByModelName(cmp.Or(req.Model, req.Name))
+	_, route, err := r.routeModel(ctx, cmp.Or(req.Model, req.Name))
 	if err != nil {
 		return nil, err
 	}
+	m := route.model
 	if req.Model == "" {
 		req.Name = m.String()
 	} else {
 		req.Model = m.String()
 	}
-	return cl.Show(ctx, req)
+	return callRoute(ctx, route, func(cl *connection, _ *atomic.Bool) (*api.ShowResponse, error) {
+		return cl.Show(ctx, req)
+	})
 }
 
 func (r *Router) Version(ctx context.Context) (string, error) {
@@ -392,16 +859,32 @@ func (r *Router) setAliases(aliases map[ModelID]ModelID) error {
 	if r.model2aliases == nil {
 		r.model2aliases = map[ModelID][]ModelID{}
 	}
-	for k, v := range aliases {
-		if err := r.addAlias(k, v); err != nil {
-			return err
+	for _, k := range slices.Sorted(maps.Keys(aliases)) {
+		if err := r.addAlias(k, aliases[k]); err != nil {
+			return newConfigEntryError(aliasesSection, k.String(), err)
 		}
 	}
 	return nil
 }
 
+// validateAliasesAndPresets checks the aliases and presets against the models the same way as NewRouter,
+// so that the errors of a configuration file can be given the line of their entry.
+func validateAliasesAndPresets(models map[ModelID]ModelConfig, aliases map[ModelID]ModelID, presets map[ModelID]PresetConfig) error {
+	r := &Router{modelCfg: models, all2ModelID: map[ModelID]ModelID{}}
+	for id := range models {
+		if !id.IsWildcard() {
+			r.all2ModelID[id] = id
+			r.all2ModelID[ModelID(model.ParseName(id.String()).DisplayShortest())] = id
+		}
+	}
+	if err := r.setAliases(aliases); err != nil {
+		return err
+	}
+	return r.setPresets(presets)
+}
+
 func (r *Router) addAlias(alias, model ModelID) error {
-	if _, ok := r.modelCfg[model]; !ok {
+	if _, ok := r.modelCfg[model]; !ok || model.IsWildcard() {
 		return fmt.Errorf("alias %s points to unknown model %s", alias, model)
 	}
 	if _, ok := r.modelCfg[alias]; ok {
@@ -412,7 +895,28 @@ func (r *Router) addAlias(alias, model ModelID) error {
 	return nil
 }
 
-func (r *Router) getClientAndModelByModelName(modelName string) (IOllamaClient, ModelID, error) {
+// routeModel returns the route of the model requested by a client, and the preset it names if any,
+// once the API key of the request is allowed to use it.
+func (r *Router) routeModel(ctx context.Context, name string) (*preset, *modelRoute, error) {
+	if err := r.authorize(ctx, name); err != nil {
+		return nil, nil, err
+	}
+	p := r.lookupPreset(name)
+	route, _, err := r.getRouteAndModelByModelName(ctx, p.modelName(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	var alias ModelID
+	if p != nil {
+		alias = p.name
+	} else if _, ok := r.all2ModelID[ModelID(name)]; !ok && r.alias2model[ModelID(name)] != "" {
+		alias = ModelID(name)
+	}
+	requestInfoFromContext(ctx).routed(name, alias)
+	return p, route, nil
+}
+
+func (r *Router) getRouteAndModelByModelName(ctx context.Context, modelName string) (*modelRoute, ModelID, error) {
 	requested := ModelID(modelName)
 	log.WithField("requested_model", requested).Trace("Routing: request.")
 	modelID, ok := r.all2ModelID[requested]
@@ -425,21 +929,52 @@ func (r *Router) getClientAndModelByModelName(modelName string) (IOllamaClient,
 			log.WithField("requested_model", requested).Trace("Routing: no route to model.")
 		}
 	}
-	cid := r.modelCfg[modelID].ConnectionID
-	cl := r.cmap[cid]
-	if cl == nil {
+	route := r.routes[modelID]
+	if route == nil && modelID == "" && r.discovery != nil {
+		// explicit routes take precedence over the models discovered by wildcard routes
+		if route = r.discovery.lookupOrRefresh(ctx, modelName); route != nil {
+			log.WithField("model_id", route.model).WithField("requested_model", requested).Trace("Routing: selected discovered model.")
+			return route, route.model, nil
+		}
+	}
+	if route == nil {
 		if modelID != "" && modelID != requested {
 			return nil, requested, NewHttpErrorf(http.StatusNotFound, "gollamas router is missing a valid route to model %s (%s)", requested, modelID)
 		}
 		return nil, requested, NewHttpErrorf(http.StatusNotFound, "gollamas router is missing a valid route to model %s", requested)
 	}
-
-	return cl, modelID, nil
+	return route, modelID, nil
 }
 
 type ConnectionConfig struct {
-	ConnectionID ConnectionID
-	Url          string
+	ConnectionID ConnectionID `json:"-" yaml:"-" toml:"-"`
+	Url          string       `json:"url" yaml:"url" toml:"url"`
+	// Weight is the share of requests sent to the connection by the weighted balancer.
+	Weight int `json:"weight,omitempty" yaml:"weight,omitempty" toml:"weight,omitempty"`
+	// KeepAlive sets the keep_alive of the requests sent to the connection.
+	KeepAlive KeepAliveConfig `json:"keep_alive,omitempty" yaml:"keep_alive,omitempty" toml:"keep_alive,omitempty"`
+	// Queue limits the requests in flight to the connection, it overrides the default queue setting by setting.
+	Queue QueueConfig `json:"queue,omitempty" yaml:"queue,omitempty" toml:"queue,omitempty"`
+	// ConnectTimeout bounds the dial and the TLS handshake of the connections to the url, defaults to 30s and 10s.
+	ConnectTimeout Duration `json:"connect_timeout,omitempty" yaml:"connect_timeout,omitempty" toml:"connect_timeout,omitempty"`
+	// ResponseHeaderTimeout bounds the wait for the headers of the responses, disabled by default.
+	// It should cover the load of the models, ollama only answers once the model is loaded.
+	ResponseHeaderTimeout Duration `json:"response_header_timeout,omitempty" yaml:"response_header_timeout,omitempty" toml:"response_header_timeout,omitempty"`
+	// IdleConnTimeout closes the idle connections after it, defaults to 90s.
+	IdleConnTimeout Duration `json:"idle_conn_timeout,omitempty" yaml:"idle_conn_timeout,omitempty" toml:"idle_conn_timeout,omitempty"`
+	// MaxIdleConns is the number of idle connections kept open, defaults to 100.
+	MaxIdleConns int `json:"max_idle_conns,omitempty" yaml:"max_idle_conns,omitempty" toml:"max_idle_conns,omitempty"`
+	// CAFile holds the PEM CA certificates trusted for the url, in addition to the ones of the system.
+	CAFile string `json:"ca_file,omitempty" yaml:"ca_file,omitempty" toml:"ca_file,omitempty"`
+	// CertFile and KeyFile are the PEM client certificate and key presented to the url.
+	CertFile string `json:"cert_file,omitempty" yaml:"cert_file,omitempty" toml:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty" yaml:"key_file,omitempty" toml:"key_file,omitempty"`
+	// InsecureSkipVerify accepts any certificate presented by the url.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty" yaml:"insecure_skip_verify,omitempty" toml:"insecure_skip_verify,omitempty"`
+	// ProxyURL is the proxy the requests go through, defaults to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	ProxyURL string `json:"proxy_url,omitempty" yaml:"proxy_url,omitempty" toml:"proxy_url,omitempty"`
+	// Headers are sent with every request, ie: the Authorization of a reverse proxy in front of ollama.
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty" toml:"headers,omitempty"`
 }
 
 func reconcileConnectionsAndProxyConfigs(cc map[ConnectionID]ConnectionConfig, pc map[ModelID]ModelConfig) (map[ConnectionID]ConnectionConfig, map[ModelID]ModelConfig, error) {
@@ -461,61 +996,74 @@ func reconcileConnectionsAndProxyConfigs(cc map[ConnectionID]ConnectionConfig, p
 			return nil, nil, fmt.Errorf("duplicate connection id: %s", k)
 		}
 		if v.ConnectionID != "" && v.ConnectionID != k {
-			return nil, nil, fmt.Errorf("connection id mismatch: %s != %s", k, v.ConnectionID)
+			return nil, nil, newConfigEntryError(connectionsSection, k.String(), fmt.Errorf("connection id mismatch: %s != %s", k, v.ConnectionID))
 		}
 		if v.Url == "" {
-			return nil, nil, fmt.Errorf("connection %s has an empty url", k)
+			return nil, nil, newConfigEntryError(connectionsSection, k.String(), fmt.Errorf("connection %s has an empty url", k))
 		}
 		u, err := url.Parse(v.Url)
 		if err != nil || u.Scheme == "" {
-			return nil, nil, fmt.Errorf("invalid connection url: %s", k)
+			return nil, nil, newConfigEntryError(connectionsSection, k.String(), fmt.Errorf("invalid connection url: %s", k))
 		}
 		urls2ids[v.Url] = append(urls2ids[v.Url], k)
-		cconf[k] = ConnectionConfig{
-			ConnectionID: k,
-			Url:          v.Url,
-		}
+		v.ConnectionID = k
+		cconf[k] = v
 	}
 	for k, v := range pc {
-		// if the connection id known
-		if _, ok := cconf[v.ConnectionID]; ok {
-			pconf[k] = ModelConfig{
-				ConnectionID: v.ConnectionID,
+		var cids []ConnectionID
+		ids := v.ConnectionIDs()
+		if len(ids) == 0 {
+			ids = []ConnectionID{v.ConnectionID}
+		}
+		for _, cid := range ids {
+			id, err := reconcileConnection(cconf, urls2ids, cid)
+			if err != nil {
+				return nil, nil, newConfigEntryError(modelsSection, k.String(), err)
 			}
-		} else {
-			// it should be a url
-
-			// if the connection url is already known by another connection id
-			if cid, ok := urls2ids[v.ConnectionID.String()]; ok {
-				pconf[k] = ModelConfig{
-					ConnectionID: ConnectionID(cid[0]),
-				}
-			} else {
-				if u, err := url.Parse(v.ConnectionID.String()); err != nil {
-					return nil, nil, fmt.Errorf("invalid connection id: %s, could not convert to valid url: %w", v.ConnectionID, err)
-				} else if strings.ToLower(u.Scheme) != "http" && strings.ToLower(u.Scheme) != "https" {
-					return nil, nil, fmt.Errorf("invalid connection id: %s, invalid url scheme", v.ConnectionID)
-				}
-				url := v.ConnectionID.String()
-				// we have a new connection
-				cconf[v.ConnectionID] = ConnectionConfig{
-					ConnectionID: v.ConnectionID,
-					Url:          v.ConnectionID.String(),
-				}
-				pconf[k] = ModelConfig{
-					ConnectionID: v.ConnectionID,
-				}
-				urls2ids[url] = append(urls2ids[url], v.ConnectionID)
-				cconf[v.ConnectionID] = ConnectionConfig{
-					ConnectionID: v.ConnectionID,
-					Url:          url,
-				}
+			if !slices.Contains(cids, id) {
+				cids = append(cids, id)
 			}
 		}
+		mc := v
+		mc.ConnectionID, mc.Connections = "", nil
+		if len(cids) > 0 {
+			mc.ConnectionID = cids[0]
+		}
+		if len(cids) > 1 {
+			mc.Connections = cids[1:]
+		}
+		pconf[k] = mc
 	}
 	return cconf, pconf, nil
 }
 
+// reconcileConnection returns the id of a known connection, or creates a new connection when given a url.
+func reconcileConnection(cconf map[ConnectionID]ConnectionConfig, urls2ids map[string][]ConnectionID, cid ConnectionID) (ConnectionID, error) {
+	// if the connection id known
+	if _, ok := cconf[cid]; ok {
+		return cid, nil
+	}
+	// it should be a url
+
+	// if the connection url is already known by another connection id
+	if ids, ok := urls2ids[cid.String()]; ok {
+		return ids[0], nil
+	}
+	if u, err := url.Parse(cid.String()); err != nil {
+		return "", fmt.Errorf("invalid connection id: %s, could not convert to valid url: %w", cid, err)
+	} else if strings.ToLower(u.Scheme) != "http" && strings.ToLower(u.Scheme) != "https" {
+		return "", fmt.Errorf("invalid connection id: %s, invalid url scheme", cid)
+	}
+	url := cid.String()
+	// we have a new connection
+	urls2ids[url] = append(urls2ids[url], cid)
+	cconf[cid] = ConnectionConfig{
+		ConnectionID: cid,
+		Url:          url,
+	}
+	return cid, nil
+}
+
 func initClients(cconf map[ConnectionID]ConnectionConfig) (map[ConnectionID]IOllamaClient, error) {
 	if cconf == nil {
 		return nil, errors.New("missing proxy config")
@@ -529,7 +1077,11 @@ func initClients(cconf map[ConnectionID]ConnectionConfig) (map[ConnectionID]IOll
 		if err != nil {
 			return nil, err
 		}
-		client := api.NewClient(remote, http.DefaultClient)
+		hc, err := newHTTPClient(v)
+		if err != nil {
+			return nil, newConfigEntryError(connectionsSection, k.String(), fmt.Errorf("connection %s: %w", k, err))
+		}
+		client := api.NewClient(remote, hc)
 		cmap[k] = client
 	}
 
@@ -1,5 +1,7 @@
 package main
 
+import "fmt"
+
 type RouterOption interface {
 	ApplyTo(opts *RouterOptions) error
 }
@@ -7,11 +9,110 @@ type RouterOption interface {
 type RouterOptions struct {
 	ExposeAliases bool
 	Aliases       map[ModelID]ModelID
+	// Balancer is the default balancing strategy for models served by several connections.
+	Balancer string
+	Weights  map[ConnectionID]int
+	// HealthCheck enables the active health checks of the connections when its interval is set.
+	HealthCheck HealthCheckConfig
+	// Retry is the default retry policy of the models.
+	Retry RetryConfig
+	// CircuitBreaker enables a circuit breaker on each connection when its failure ratio is set.
+	CircuitBreaker CircuitBreakerConfig
+	// DiscoveryInterval is the interval at which the models of the wildcard routes are refreshed.
+	DiscoveryInterval Duration
+	// PreferLoaded routes the requests to the connections which already have the model loaded.
+	PreferLoaded bool
+	// PreferLoadedInterval is the interval at which the loaded models are refreshed.
+	PreferLoadedInterval Duration
+	// KeepWarmInterval is the interval at which the models kept warm are checked.
+	KeepWarmInterval Duration
+	// KeepAlive is the keep alive policy of the models and connections which do not set one.
+	KeepAlive           KeepAliveConfig
+	ConnectionKeepAlive map[ConnectionID]KeepAliveConfig
+	// Options is the default options policy of the models.
+	Options OptionsPolicy
+	Presets map[ModelID]PresetConfig
+	// APIKeys are the keys accepted by the router, the requests are not authenticated without keys.
+	APIKeys []APIKeyConfig
+	// RateLimit limits the requests of each client for all the models.
+	RateLimit RateLimitConfig
+	// Queue is the default queue of the connections, ConnectionQueues override it setting by setting.
+	Queue            QueueConfig
+	ConnectionQueues map[ConnectionID]QueueConfig
+	// Readiness sets when the router reports it is ready.
+	Readiness ReadinessConfig
 }
 
 func (o *RouterOptions) ApplyTo(opts *RouterOptions) error {
 	opts.ExposeAliases = o.ExposeAliases
 	applyOptionAliasConfig(opts, o.Aliases)
+	applyOptionPresets(opts, o.Presets)
+	opts.APIKeys = append(opts.APIKeys, o.APIKeys...)
+	if o.Balancer != "" {
+		opts.Balancer = o.Balancer
+	}
+	applyOptionWeights(opts, o.Weights)
+	if o.HealthCheck != (HealthCheckConfig{}) {
+		if err := o.HealthCheck.validate(); err != nil {
+			return err
+		}
+		opts.HealthCheck = o.HealthCheck
+	}
+	if o.Retry != (RetryConfig{}) {
+		if err := o.Retry.validate(); err != nil {
+			return err
+		}
+		opts.Retry = o.Retry
+	}
+	if o.CircuitBreaker != (CircuitBreakerConfig{}) {
+		if err := o.CircuitBreaker.validate(); err != nil {
+			return err
+		}
+		opts.CircuitBreaker = o.CircuitBreaker
+	}
+	if o.DiscoveryInterval != 0 {
+		opts.DiscoveryInterval = o.DiscoveryInterval
+	}
+	if o.PreferLoaded {
+		opts.PreferLoaded = true
+	}
+	if o.PreferLoadedInterval != 0 {
+		opts.PreferLoadedInterval = o.PreferLoadedInterval
+	}
+	if o.KeepWarmInterval != 0 {
+		opts.KeepWarmInterval = o.KeepWarmInterval
+	}
+	if !o.KeepAlive.IsZero() {
+		opts.KeepAlive = o.KeepAlive
+	}
+	applyOptionConnectionKeepAlive(opts, o.ConnectionKeepAlive)
+	if !o.RateLimit.IsZero() {
+		if err := o.RateLimit.validate(); err != nil {
+			return err
+		}
+		opts.RateLimit = o.RateLimit
+	}
+	if !o.Queue.IsZero() {
+		if err := o.Queue.validate(); err != nil {
+			return err
+		}
+		opts.Queue = o.Queue
+	}
+	if err := applyOptionConnectionQueues(opts, o.ConnectionQueues); err != nil {
+		return err
+	}
+	if !o.Readiness.IsZero() {
+		if err := o.Readiness.validate(); err != nil {
+			return err
+		}
+		opts.Readiness = o.Readiness
+	}
+	if !o.Options.IsZero() {
+		if err := o.Options.validate(); err != nil {
+			return err
+		}
+		opts.Options = o.Options
+	}
 	return nil
 }
 
@@ -45,6 +146,215 @@ func WithExposeAliases(expose bool) RouterOptionFunc {
 	}
 }
 
+func WithBalancer(name string) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		if _, err := NewBalancer(name); err != nil {
+			return err
+		}
+		opts.Balancer = name
+		return nil
+	}
+}
+
+func WithConnectionWeights(weights map[ConnectionID]int) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		applyOptionWeights(opts, weights)
+		return nil
+	}
+}
+
+func WithHealthCheck(cfg HealthCheckConfig) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		opts.HealthCheck = cfg
+		return nil
+	}
+}
+
+func WithRetry(cfg RetryConfig) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		opts.Retry = cfg
+		return nil
+	}
+}
+
+func WithCircuitBreaker(cfg CircuitBreakerConfig) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		opts.CircuitBreaker = cfg
+		return nil
+	}
+}
+
+func WithDiscoveryInterval(interval Duration) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		if interval < 0 {
+			return fmt.Errorf("invalid discovery interval: %s", interval)
+		}
+		opts.DiscoveryInterval = interval
+		return nil
+	}
+}
+
+func WithPreferLoaded(prefer bool, interval Duration) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		if interval < 0 {
+			return fmt.Errorf("invalid prefer loaded interval: %s", interval)
+		}
+		opts.PreferLoaded = prefer
+		opts.PreferLoadedInterval = interval
+		return nil
+	}
+}
+
+func WithKeepWarmInterval(interval Duration) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		if interval < 0 {
+			return fmt.Errorf("invalid keep warm interval: %s", interval)
+		}
+		opts.KeepWarmInterval = interval
+		return nil
+	}
+}
+
+func WithKeepAlive(cfg KeepAliveConfig) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		opts.KeepAlive = cfg
+		return nil
+	}
+}
+
+func WithConnectionKeepAlive(cfg map[ConnectionID]KeepAliveConfig) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		applyOptionConnectionKeepAlive(opts, cfg)
+		return nil
+	}
+}
+
+func WithOptionsPolicy(policy OptionsPolicy) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("invalid options policy: %w", err)
+		}
+		opts.Options = policy
+		return nil
+	}
+}
+
+func WithPresets(presets map[ModelID]PresetConfig) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		applyOptionPresets(opts, presets)
+		return nil
+	}
+}
+
+func WithPreset(name ModelID, preset PresetConfig) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		applyOptionPresets(opts, map[ModelID]PresetConfig{name: preset})
+		return nil
+	}
+}
+
+func WithRateLimit(cfg RateLimitConfig) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		if err := cfg.validate(); err != nil {
+			return fmt.Errorf("invalid rate limit: %w", err)
+		}
+		opts.RateLimit = cfg
+		return nil
+	}
+}
+
+func WithQueue(cfg QueueConfig) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		if err := cfg.validate(); err != nil {
+			return fmt.Errorf("invalid queue: %w", err)
+		}
+		opts.Queue = cfg
+		return nil
+	}
+}
+
+func WithReadiness(cfg ReadinessConfig) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		opts.Readiness = cfg
+		return nil
+	}
+}
+
+func WithConnectionQueues(cfg map[ConnectionID]QueueConfig) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		return applyOptionConnectionQueues(opts, cfg)
+	}
+}
+
+func WithAPIKeys(keys []APIKeyConfig) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		opts.APIKeys = append(opts.APIKeys, keys...)
+		return nil
+	}
+}
+
+func WithAPIKey(key APIKeyConfig) RouterOptionFunc {
+	return func(opts *RouterOptions) error {
+		opts.APIKeys = append(opts.APIKeys, key)
+		return nil
+	}
+}
+
+func applyOptionPresets(opts *RouterOptions, presets map[ModelID]PresetConfig) {
+	if len(presets) == 0 {
+		return
+	}
+	if opts.Presets == nil {
+		opts.Presets = map[ModelID]PresetConfig{}
+	}
+	for k, v := range presets {
+		opts.Presets[k] = v
+	}
+}
+
+func applyOptionConnectionQueues(opts *RouterOptions, cfg map[ConnectionID]QueueConfig) error {
+	if opts.ConnectionQueues == nil {
+		opts.ConnectionQueues = map[ConnectionID]QueueConfig{}
+	}
+	for k, v := range cfg {
+		if err := v.validate(); err != nil {
+			return fmt.Errorf("invalid queue for connection %s: %w", k, err)
+		}
+		opts.ConnectionQueues[k] = v
+	}
+	return nil
+}
+
+func applyOptionConnectionKeepAlive(opts *RouterOptions, cfg map[ConnectionID]KeepAliveConfig) {
+	if opts.ConnectionKeepAlive == nil {
+		opts.ConnectionKeepAlive = map[ConnectionID]KeepAliveConfig{}
+	}
+	for k, v := range cfg {
+		opts.ConnectionKeepAlive[k] = v
+	}
+}
+
+func applyOptionWeights(opts *RouterOptions, weights map[ConnectionID]int) {
+	if opts.Weights == nil {
+		opts.Weights = map[ConnectionID]int{}
+	}
+	for k, v := range weights {
+		opts.Weights[k] = v
+	}
+}
+
 func applyOptionAliasConfig(opts *RouterOptions, aliases map[ModelID]ModelID) {
 	if opts.Aliases == nil {
 		opts.Aliases = map[ModelID]ModelID{}
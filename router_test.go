@@ -3,7 +3,11 @@ package main_test
 import (
 	"context"
 	"errors"
+	"io"
+	"net/http"
+	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -132,13 +136,822 @@ func TestNewRouter(t *testing.T) {
 	c1.AssertExpectations(t)
 }
 
+func TestNewRouterFailOnUnknownBalancer(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1", Balancer: "unknown"}},
+	)
+	assert.EqualError(t, err, "invalid balancer for model llama3.2: unknown balancer unknown, expected one of least-outstanding, random, round-robin, weighted")
+	assert.Nil(t, r)
+
+	r, err = gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+		gollamas.WithBalancer("unknown"),
+	)
+	assert.EqualError(t, err, "failed to apply options: unknown balancer unknown, expected one of least-outstanding, random, round-robin, weighted")
+	assert.Nil(t, r)
+}
+
+func TestNewRouterFailsOnUnknownAdditionalConnectionID(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1", Connections: []gollamas.ConnectionID{"unknown"}}},
+	)
+	assert.EqualError(t, err, "unknown connection id for model llama3.2")
+	assert.Nil(t, r)
+}
+
 func newRouter(cmap map[gollamas.ConnectionID]gollamas.IOllamaClient, pmap map[gollamas.ModelID]gollamas.ModelConfig, opts ...gollamas.RouterOption) (context.Context, context.CancelFunc, *gollamas.Router, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	r, err := gollamas.NewRouter(cmap, pmap, opts...)
 	return ctx, cancel, r, err
 }
 
-func TestRouterChat(t *testing.T) {
+func TestRouterChat(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}, "other_model": {ConnectionID: "c2"}},
+		gollamas.WithAlias("llama3", "llama3.2"), gollamas.WithAlias("some_alias", "other_model"),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+	cb := func(api.ChatResponse) error { return nil }
+
+	err = r.Chat(ctx, &api.ChatRequest{
+		Model: "unknown_model",
+	}, cb)
+	assert.EqualError(t, err, "gollamas router is missing a valid route to model unknown_model")
+
+	req := &api.ChatRequest{
+		Model: "llama3.2",
+	}
+	c1.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
+	err = r.Chat(ctx, req, cb)
+	assert.NoError(t, err)
+
+	reqAlias := &api.ChatRequest{
+		Model: "llama3",
+	}
+	c1.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
+	err = r.Chat(ctx, reqAlias, cb)
+	assert.NoError(t, err)
+
+	req = &api.ChatRequest{
+		Model: "llama3.2:latest",
+	}
+	c1.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
+	err = r.Chat(ctx, req, cb)
+	assert.NoError(t, err)
+
+	req = &api.ChatRequest{
+		Model: "other_model",
+	}
+	c2.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
+	err = r.Chat(ctx, req, cb)
+	assert.NoError(t, err)
+
+	reqAlias = &api.ChatRequest{
+		Model: "some_alias",
+	}
+	c2.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
+	err = r.Chat(ctx, reqAlias, cb)
+	assert.NoError(t, err)
+
+	c2.On("Chat", ctx, req, mock.Anything).Once().Return(errors.New("some error"))
+	err = r.Chat(ctx, req, cb)
+	assert.EqualError(t, err, "some error")
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestRouterChatMultipleConnections(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1", Connections: []gollamas.ConnectionID{"c2"}}},
+		gollamas.WithAlias("llama3", "llama3.2"),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+	cb := func(api.ChatResponse) error { return nil }
+
+	req := &api.ChatRequest{
+		Model: "llama3.2",
+	}
+	c1.On("Chat", ctx, req, mock.Anything).Twice().Return(nil)
+	c2.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb))
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3"}, cb))
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2:latest"}, cb))
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestRouterChatLeastOutstanding(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1", Connections: []gollamas.ConnectionID{"c2"}}},
+		gollamas.WithBalancer(gollamas.LeastOutstandingBalancer),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+	cb := func(api.ChatResponse) error { return nil }
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	req := &api.ChatRequest{
+		Model: "llama3.2",
+	}
+	c1.On("Chat", ctx, req, mock.Anything).Once().Run(func(args mock.Arguments) {
+		close(started)
+		<-release
+	}).Return(nil)
+	c2.On("Chat", ctx, req, mock.Anything).Twice().Return(nil)
+
+	done := make(chan error)
+	go func() {
+		done <- r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb)
+	}()
+	<-started
+	// c1 is busy, both requests go to c2
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb))
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb))
+	close(release)
+	assert.NoError(t, <-done)
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func newRetryRouter(t *testing.T, mc gollamas.ModelConfig, opts ...gollamas.RouterOption) (context.Context, context.CancelFunc, *gollamas.Router, *mocks.IOllamaClient, *mocks.IOllamaClient) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	if mc.ConnectionID == "" {
+		mc.ConnectionID, mc.Connections = "c1", []gollamas.ConnectionID{"c2"}
+	}
+	opts = append([]gollamas.RouterOption{gollamas.WithRetry(gollamas.RetryConfig{MaxAttempts: 3, Backoff: gollamas.Duration(time.Millisecond)})}, opts...)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": mc},
+		opts...,
+	)
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+	return ctx, cancel, r, c1, c2
+}
+
+var errDial = &url.Error{Op: "Post", URL: "http://server1:11434/api/chat", Err: errors.New("dial tcp: connection refused")}
+
+func TestRouterChatRetriesOnAnotherConnection(t *testing.T) {
+	ctx, cancel, r, c1, c2 := newRetryRouter(t, gollamas.ModelConfig{})
+	defer cancel()
+	cb := func(api.ChatResponse) error { return nil }
+
+	req := &api.ChatRequest{
+		Model: "llama3.2",
+	}
+	c1.On("Chat", ctx, req, mock.Anything).Once().Return(errDial)
+	c2.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb))
+
+	// all the connections fail, the last error is returned
+	c2.On("Chat", ctx, req, mock.Anything).Once().Return(api.StatusError{StatusCode: http.StatusServiceUnavailable, ErrorMessage: "busy"})
+	c1.On("Chat", ctx, req, mock.Anything).Once().Return(errDial)
+	err := r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb)
+	assert.Equal(t, errDial, err)
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestRouterChatDoesNotRetryOnceStreamed(t *testing.T) {
+	ctx, cancel, r, c1, c2 := newRetryRouter(t, gollamas.ModelConfig{})
+	defer cancel()
+	var chunks []string
+	cb := func(resp api.ChatResponse) error {
+		chunks = append(chunks, resp.Message.Content)
+		return nil
+	}
+
+	req := &api.ChatRequest{
+		Model: "llama3.2",
+	}
+	c1.On("Chat", ctx, req, mock.Anything).Once().Run(func(args mock.Arguments) {
+		fn := args.Get(2).(api.ChatResponseFunc)
+		assert.NoError(t, fn(api.ChatResponse{Message: api.Message{Content: "the sky"}}))
+	}).Return(io.ErrUnexpectedEOF)
+	err := r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, []string{"the sky"}, chunks)
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestRouterGenerateDoesNotRetryRequestErrors(t *testing.T) {
+	ctx, cancel, r, c1, c2 := newRetryRouter(t, gollamas.ModelConfig{})
+	defer cancel()
+	cb := func(api.GenerateResponse) error { return nil }
+
+	req := &api.GenerateRequest{
+		Model: "llama3.2",
+	}
+	c1.On("Generate", ctx, req, mock.Anything).Once().Return(api.StatusError{StatusCode: http.StatusBadRequest, ErrorMessage: "invalid options"})
+	err := r.Generate(ctx, &api.GenerateRequest{Model: "llama3.2"}, cb)
+	assert.EqualError(t, err, "invalid options")
+
+	c2.On("Generate", ctx, req, mock.Anything).Once().Return(errDial)
+	c1.On("Generate", ctx, req, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Generate(ctx, &api.GenerateRequest{Model: "llama3.2"}, cb))
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestRouterEmbedRetriesOnAnotherConnection(t *testing.T) {
+	ctx, cancel, r, c1, c2 := newRetryRouter(t, gollamas.ModelConfig{})
+	defer cancel()
+
+	req := &api.EmbedRequest{
+		Model: "llama3.2",
+	}
+	resp := &api.EmbedResponse{Model: "llama3.2", Embeddings: [][]float32{{0.1}}}
+	c1.On("Embed", ctx, req).Once().Return(nil, api.StatusError{StatusCode: http.StatusServiceUnavailable, ErrorMessage: "busy"})
+	c2.On("Embed", ctx, req).Once().Return(resp, nil)
+	res, err := r.Embed(ctx, &api.EmbedRequest{Model: "llama3.2"})
+	assert.NoError(t, err)
+	assert.Equal(t, resp, res)
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestRouterModelRetryPolicy(t *testing.T) {
+	ctx, cancel, r, c1, c2 := newRetryRouter(t, gollamas.ModelConfig{ConnectionID: "c1", Connections: []gollamas.ConnectionID{"c2"}, Retry: &gollamas.RetryConfig{MaxAttempts: 1}})
+	defer cancel()
+
+	req := &api.ShowRequest{
+		Model: "llama3.2",
+	}
+	c1.On("Show", ctx, req).Once().Return(nil, errDial)
+	_, err := r.Show(ctx, &api.ShowRequest{Model: "llama3.2"})
+	assert.Equal(t, errDial, err)
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestRouterDoesNotRetryByDefault(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1", Connections: []gollamas.ConnectionID{"c2"}}},
+	)
+	defer cancel()
+	assert.NoError(t, err)
+
+	req := &api.EmbeddingRequest{
+		Model: "llama3.2",
+	}
+	c1.On("Embeddings", ctx, req).Once().Return(nil, errDial)
+	_, err = r.Embeddings(ctx, &api.EmbeddingRequest{Model: "llama3.2"})
+	assert.Equal(t, errDial, err)
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestRouterCircuitBreaker(t *testing.T) {
+	ctx, cancel, r, c1, c2 := newRetryRouter(t, gollamas.ModelConfig{},
+		gollamas.WithRetry(gollamas.RetryConfig{}),
+		gollamas.WithCircuitBreaker(gollamas.CircuitBreakerConfig{FailureRatio: 0.5, MinRequests: 1, OpenDuration: gollamas.Duration(time.Hour)}),
+	)
+	defer cancel()
+	cb := func(api.ChatResponse) error { return nil }
+
+	req := &api.ChatRequest{
+		Model: "llama3.2",
+	}
+	c1.On("Chat", ctx, req, mock.Anything).Once().Return(errDial)
+	err := r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb)
+	assert.Equal(t, errDial, err)
+	assert.Equal(t, "open", r.Health()[0].Circuit)
+	assert.Equal(t, "closed", r.Health()[1].Circuit)
+
+	// the circuit of c1 is open, requests go to c2
+	c2.On("Chat", ctx, req, mock.Anything).Times(3).Return(nil)
+	for range 3 {
+		assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb))
+	}
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestRouterCircuitBreakerFailsFast(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+		gollamas.WithCircuitBreaker(gollamas.CircuitBreakerConfig{FailureRatio: 0.5, MinRequests: 1}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+
+	req := &api.EmbedRequest{
+		Model: "llama3.2",
+	}
+	c1.On("Embed", ctx, req).Once().Return(nil, errDial)
+	_, err = r.Embed(ctx, &api.EmbedRequest{Model: "llama3.2"})
+	assert.Equal(t, errDial, err)
+
+	_, err = r.Embed(ctx, &api.EmbedRequest{Model: "llama3.2"})
+	assert.EqualError(t, err, "gollamas: connection c1 is unavailable, circuit breaker is open")
+
+	c1.AssertExpectations(t)
+}
+
+func TestNewRouterFailsOnInvalidRetryPolicy(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1", Retry: &gollamas.RetryConfig{MaxAttempts: -1}}},
+	)
+	assert.EqualError(t, err, "invalid retry policy for model llama3.2: invalid retry max attempts: -1")
+	assert.Nil(t, r)
+}
+
+func newWildcardRouter(t *testing.T, opts ...gollamas.RouterOption) (context.Context, context.CancelFunc, *gollamas.Router, *mocks.IOllamaClient, *mocks.IOllamaClient) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	c1.On("List", mock.Anything).Return(&api.ListResponse{Models: []api.ListModelResponse{
+		{Model: "llama3.2:latest", Name: "llama3.2:latest", ModifiedAt: time.UnixMilli(300)},
+		{Model: "qwen2.5:7b", Name: "qwen2.5:7b", ModifiedAt: time.UnixMilli(200)},
+		{Model: "mistral:latest", Name: "mistral:latest", ModifiedAt: time.UnixMilli(100)},
+	}}, nil)
+	c2.On("List", mock.Anything).Return(&api.ListResponse{Models: []api.ListModelResponse{
+		{Model: "llama3.2:latest", Name: "llama3.2:latest", ModifiedAt: time.UnixMilli(300)},
+		{Model: "mistral:latest", Name: "mistral:latest", ModifiedAt: time.UnixMilli(100)},
+		{Model: "phi:latest", Name: "phi:latest", ModifiedAt: time.UnixMilli(50)},
+	}}, nil)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"*": {ConnectionID: "c1"}, "llama*": {ConnectionID: "c2"}, "mistral": {ConnectionID: "c2"}},
+		opts...,
+	)
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+	t.Cleanup(func() { r.Close() })
+	return ctx, cancel, r, c1, c2
+}
+
+func TestRouterWildcardRoutes(t *testing.T) {
+	ctx, cancel, r, c1, c2 := newWildcardRouter(t)
+	defer cancel()
+	cb := func(api.ChatResponse) error { return nil }
+
+	// only on c1
+	req := &api.ChatRequest{Model: "qwen2.5:7b"}
+	c1.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "qwen2.5:7b"}, cb))
+
+	// llama* is more specific than *
+	req = &api.ChatRequest{Model: "llama3.2:latest"}
+	c2.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb))
+
+	// explicit routes have priority
+	req = &api.ChatRequest{Model: "mistral"}
+	c2.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "mistral:latest"}, cb))
+
+	// phi is on c2 which only exposes llama*
+	err := r.Chat(ctx, &api.ChatRequest{Model: "phi"}, cb)
+	assert.EqualError(t, err, "gollamas router is missing a valid route to model phi")
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestRouterListWildcardRoutes(t *testing.T) {
+	ctx, cancel, r, _, _ := newWildcardRouter(t)
+	defer cancel()
+
+	resp, err := r.List(ctx)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []api.ListModelResponse{
+		{Model: "llama3.2:latest", Name: "llama3.2:latest", ModifiedAt: time.UnixMilli(300)},
+		{Model: "qwen2.5:7b", Name: "qwen2.5:7b", ModifiedAt: time.UnixMilli(200)},
+		{Model: "mistral:latest", Name: "mistral:latest", ModifiedAt: time.UnixMilli(100)},
+	}, resp.Models)
+}
+
+func TestRouterPullWildcardRoutes(t *testing.T) {
+	ctx, cancel, r, c1, c2 := newWildcardRouter(t)
+	defer cancel()
+	cb := func(api.ProgressResponse) error { return nil }
+
+	req := &api.PullRequest{Model: "gemma3:4b"}
+	c1.On("Pull", ctx, req, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Pull(ctx, &api.PullRequest{Model: "gemma3:4b"}, cb))
+
+	req = &api.PullRequest{Model: "llama3.3"}
+	c2.On("Pull", ctx, req, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Pull(ctx, &api.PullRequest{Model: "llama3.3"}, cb))
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestRouterPullWildcardRoutesAuthorizesAndLimits(t *testing.T) {
+	ctx, cancel, r, _, c2 := newWildcardRouter(t,
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "ci", Key: "secret1", Models: []gollamas.ModelID{"llama*"}}),
+		gollamas.WithRateLimit(gollamas.RateLimitConfig{RequestsPerMinute: 1}),
+	)
+	defer cancel()
+	cb := func(api.ProgressResponse) error { return nil }
+	kctx, err := r.Authenticate(ctx, "secret1")
+	assert.NoError(t, err)
+
+	// the models matching a wildcard route are only pulled with a key allowed to use them
+	err = r.Pull(kctx, &api.PullRequest{Model: "gemma3:4b"}, cb)
+	assert.EqualError(t, err, "gollamas: api key ci is not allowed to use model gemma3:4b")
+	var httpErr *gollamas.HttpError
+	assert.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusForbidden, httpErr.StatusCode())
+
+	// the pulls count against the limits of the client
+	req := &api.PullRequest{Model: "llama3.3"}
+	c2.On("Pull", kctx, req, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Pull(kctx, &api.PullRequest{Model: "llama3.3"}, cb))
+	assert.EqualError(t, r.Pull(kctx, &api.PullRequest{Model: "llama3.3"}, cb), "gollamas: too many requests")
+}
+
+func TestNewRouterFailsOnAliasToWildcard(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"*": {ConnectionID: "c1"}},
+		gollamas.WithAlias("llama3", "*"),
+	)
+	assert.EqualError(t, err, "alias llama3 points to unknown model *")
+	assert.Nil(t, r)
+}
+
+func TestRouterPrefersLoadedConnections(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	c1.On("ListRunning", mock.Anything).Return(&api.ProcessResponse{}, nil)
+	c2.On("ListRunning", mock.Anything).Return(&api.ProcessResponse{Models: []api.ProcessModelResponse{
+		{Model: "llama3.2:latest", Name: "llama3.2:latest", ExpiresAt: time.Now().Add(time.Hour)},
+	}}, nil)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"llama3.2": {ConnectionID: "c1", Connections: []gollamas.ConnectionID{"c2"}},
+			"qwen2.5":  {ConnectionID: "c1", Connections: []gollamas.ConnectionID{"c2"}},
+		},
+		gollamas.WithPreferLoaded(true, gollamas.Duration(time.Hour)),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	defer r.Close()
+	_, err = r.ListRunning(ctx)
+	assert.NoError(t, err)
+	cb := func(api.ChatResponse) error { return nil }
+
+	// llama3.2 is loaded on c2
+	req := &api.ChatRequest{Model: "llama3.2"}
+	c2.On("Chat", ctx, req, mock.Anything).Times(3).Return(nil)
+	for range 3 {
+		assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb))
+	}
+
+	// qwen2.5 is not loaded, the first request is balanced and the next ones stay on the same connection
+	var loadedOn gollamas.ConnectionID
+	req = &api.ChatRequest{Model: "qwen2.5"}
+	c1.On("Chat", ctx, req, mock.Anything).Maybe().Return(nil).Run(func(mock.Arguments) { loadedOn = "c1" })
+	c2.On("Chat", ctx, req, mock.Anything).Maybe().Return(nil).Run(func(mock.Arguments) { loadedOn = "c2" })
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "qwen2.5"}, cb))
+	first := loadedOn
+	for range 3 {
+		assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "qwen2.5"}, cb))
+		assert.Equal(t, first, loadedOn)
+	}
+}
+
+func TestNewRouterFailsOnInvalidPreferLoadedInterval(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+		gollamas.WithPreferLoaded(true, gollamas.Duration(-time.Second)),
+	)
+	assert.EqualError(t, err, "failed to apply options: invalid prefer loaded interval: -1s")
+	assert.Nil(t, r)
+}
+
+func TestRouterKeepAlive(t *testing.T) {
+	d := func(d time.Duration) *gollamas.Duration { v := gollamas.Duration(d); return &v }
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"llama3.2":         {ConnectionID: "c1"},
+			"qwen2.5":          {ConnectionID: "c2"},
+			"nomic-embed-text": {ConnectionID: "c2", KeepAlive: gollamas.KeepAliveConfig{Override: d(0)}},
+		},
+		gollamas.WithKeepAlive(gollamas.KeepAliveConfig{Default: d(time.Hour)}),
+		gollamas.WithConnectionKeepAlive(map[gollamas.ConnectionID]gollamas.KeepAliveConfig{"c2": {Override: d(-time.Second)}}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	cb := func(api.ChatResponse) error { return nil }
+
+	// the global default is used when the request does not set keep_alive
+	c1.On("Chat", ctx, &api.ChatRequest{Model: "llama3.2", KeepAlive: &api.Duration{Duration: time.Hour}}, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb))
+	c1.On("Chat", ctx, &api.ChatRequest{Model: "llama3.2", KeepAlive: &api.Duration{Duration: time.Minute}}, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2", KeepAlive: &api.Duration{Duration: time.Minute}}, cb))
+
+	// the connection overrides the request
+	c2.On("Generate", ctx, &api.GenerateRequest{Model: "qwen2.5", KeepAlive: &api.Duration{Duration: -time.Second}}, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Generate(ctx, &api.GenerateRequest{Model: "qwen2.5", KeepAlive: &api.Duration{Duration: time.Minute}}, func(api.GenerateResponse) error { return nil }))
+
+	// the model takes precedence over the connection
+	c2.On("Embed", ctx, &api.EmbedRequest{Model: "nomic-embed-text", KeepAlive: &api.Duration{}}).Once().Return(&api.EmbedResponse{}, nil)
+	_, err = r.Embed(ctx, &api.EmbedRequest{Model: "nomic-embed-text"})
+	assert.NoError(t, err)
+}
+
+func TestRouterOptionsPolicy(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"llama3.2":         {ConnectionID: "c1", Options: gollamas.OptionsPolicy{Force: map[string]any{"temperature": 0.2}}},
+			"nomic-embed-text": {ConnectionID: "c1"},
+		},
+		gollamas.WithOptionsPolicy(gollamas.OptionsPolicy{
+			Defaults: map[string]any{"num_ctx": 8192},
+			Min:      map[string]float64{"num_ctx": 2048},
+		}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+
+	c1.On("Chat", ctx, &api.ChatRequest{Model: "llama3.2", Options: map[string]any{"num_ctx": float64(2048), "temperature": 0.2}}, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2", Options: map[string]any{"num_ctx": float64(512), "temperature": float64(1)}}, func(api.ChatResponse) error { return nil }))
+
+	c1.On("Embed", ctx, &api.EmbedRequest{Model: "nomic-embed-text", Options: map[string]any{"num_ctx": 8192}}).Once().Return(&api.EmbedResponse{}, nil)
+	_, err = r.Embed(ctx, &api.EmbedRequest{Model: "nomic-embed-text"})
+	assert.NoError(t, err)
+}
+
+func TestNewRouterFailsOnInvalidOptionsPolicy(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1", Options: gollamas.OptionsPolicy{Force: map[string]any{"num_context": 4096}}}},
+	)
+	assert.EqualError(t, err, "invalid options policy for model llama3.2: unknown option: num_context")
+	assert.Nil(t, r)
+}
+
+func TestRouterPresets(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"qwen2.5-coder:14b": {ConnectionID: "c1"},
+		},
+		gollamas.WithAlias("coder", "qwen2.5-coder:14b"),
+		gollamas.WithPreset("code-reviewer", gollamas.PresetConfig{
+			Model:    "coder",
+			System:   "You review code.",
+			Template: "{{ .System }} {{ .Prompt }}",
+			Options:  map[string]any{"temperature": 0.1, "num_ctx": 16384},
+		}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+
+	c1.On("Chat", ctx, &api.ChatRequest{
+		Model: "qwen2.5-coder:14b",
+		Messages: []api.Message{
+			{Role: "system", Content: "You review code."},
+			{Role: "user", Content: "func main() {}"},
+		},
+		Options: map[string]any{"temperature": 0.1, "num_ctx": 16384, "seed": float64(1)},
+	}, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{
+		Model:    "code-reviewer",
+		Messages: []api.Message{{Role: "user", Content: "func main() {}"}},
+		Options:  map[string]any{"temperature": float64(1), "seed": float64(1)},
+	}, func(api.ChatResponse) error { return nil }))
+
+	c1.On("Generate", ctx, &api.GenerateRequest{
+		Model:    "qwen2.5-coder:14b",
+		System:   "You review code.\n\nBe brief.",
+		Prompt:   "func main() {}",
+		Template: "{{ .System }} {{ .Prompt }}",
+		Options:  map[string]any{"temperature": 0.1, "num_ctx": 16384},
+	}, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Generate(ctx, &api.GenerateRequest{
+		Model:  "code-reviewer:latest",
+		System: "Be brief.",
+		Prompt: "func main() {}",
+	}, func(api.GenerateResponse) error { return nil }))
+
+	// the template of the request is kept
+	c1.On("Generate", ctx, &api.GenerateRequest{
+		Model:    "qwen2.5-coder:14b",
+		System:   "You review code.",
+		Prompt:   "func main() {}",
+		Template: "{{ .Prompt }}",
+		Options:  map[string]any{"temperature": 0.1, "num_ctx": 16384},
+	}, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Generate(ctx, &api.GenerateRequest{
+		Model:    "code-reviewer",
+		Prompt:   "func main() {}",
+		Template: "{{ .Prompt }}",
+	}, func(api.GenerateResponse) error { return nil }))
+
+	// presets are listed as models
+	c1.On("List", ctx).Once().Return(&api.ListResponse{Models: []api.ListModelResponse{
+		{Name: "qwen2.5-coder:14b", Model: "qwen2.5-coder:14b", Digest: "d1"},
+	}}, nil)
+	lr, err := r.List(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []api.ListModelResponse{
+		{Name: "qwen2.5-coder:14b", Model: "qwen2.5-coder:14b", Digest: "d1"},
+		{Name: "coder", Model: "coder", Digest: "d1"},
+		{Name: "code-reviewer", Model: "code-reviewer", Digest: "d1"},
+	}, lr.Models)
+}
+
+func TestRouterPresetsKeepTheOptionsPolicyOfTheModel(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"qwen2.5-coder:14b": {ConnectionID: "c1", Options: gollamas.OptionsPolicy{Max: map[string]float64{"num_ctx": 8192}}},
+		},
+		gollamas.WithPreset("code-reviewer", gollamas.PresetConfig{
+			Model:   "qwen2.5-coder:14b",
+			Options: map[string]any{"temperature": 0.1, "num_ctx": 16384},
+		}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+
+	// the options of the preset are clamped by the policy of the model
+	c1.On("Generate", ctx, &api.GenerateRequest{
+		Model:   "qwen2.5-coder:14b",
+		Prompt:  "func main() {}",
+		Options: map[string]any{"temperature": 0.1, "num_ctx": float64(8192)},
+	}, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Generate(ctx, &api.GenerateRequest{
+		Model:  "code-reviewer",
+		Prompt: "func main() {}",
+	}, func(api.GenerateResponse) error { return nil }))
+}
+
+func TestNewRouterFailsOnInvalidPresets(t *testing.T) {
+	for _, tc := range []struct {
+		preset gollamas.PresetConfig
+		name   gollamas.ModelID
+		err    string
+	}{
+		{gollamas.PresetConfig{Model: "mistral"}, "code-reviewer", "preset code-reviewer points to unknown model mistral"},
+		{gollamas.PresetConfig{}, "code-reviewer", "invalid preset code-reviewer: empty preset model"},
+		{gollamas.PresetConfig{Model: "llama3.2"}, "llama3.2:latest", "preset llama3.2:latest refers to an existing concrete model name"},
+		{gollamas.PresetConfig{Model: "llama3.2", Options: map[string]any{"temp": 0.1}}, "code-reviewer", "invalid preset code-reviewer: unknown option: temp"},
+	} {
+		r, err := gollamas.NewRouter(
+			map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": mocks.NewIOllamaClient(t)},
+			map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+			gollamas.WithPreset(tc.name, tc.preset),
+		)
+		assert.EqualError(t, err, tc.err)
+		assert.Nil(t, r)
+	}
+}
+
+func TestRouterFallbacks(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"deepseek-r1:70b": {ConnectionID: "c1", Fallbacks: []gollamas.ModelID{"deepseek-r1:14b", "small"}},
+			"deepseek-r1:14b": {ConnectionID: "c1"},
+			"llama3.2":        {ConnectionID: "c2", Options: gollamas.OptionsPolicy{Force: map[string]any{"num_ctx": 2048}}},
+		},
+		gollamas.WithAlias("small", "llama3.2"),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	cb := func(api.ChatResponse) error { return nil }
+
+	// the connection is down, then the model is missing
+	c1.On("Chat", ctx, &api.ChatRequest{Model: "deepseek-r1:70b"}, mock.Anything).Once().Return(errDial)
+	c1.On("Chat", ctx, &api.ChatRequest{Model: "deepseek-r1:14b"}, mock.Anything).Once().Return(api.StatusError{StatusCode: http.StatusNotFound, ErrorMessage: "model not found"})
+	c2.On("Chat", ctx, &api.ChatRequest{Model: "llama3.2", Options: map[string]any{"num_ctx": 2048}}, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "deepseek-r1:70b"}, cb))
+
+	// the requests are not sent to the fallbacks once streamed or when they are invalid
+	c1.On("Generate", ctx, &api.GenerateRequest{Model: "deepseek-r1:70b"}, mock.Anything).Once().Run(func(args mock.Arguments) {
+		fn := args.Get(2).(api.GenerateResponseFunc)
+		assert.NoError(t, fn(api.GenerateResponse{Response: "the sky"}))
+	}).Return(io.ErrUnexpectedEOF)
+	err = r.Generate(ctx, &api.GenerateRequest{Model: "deepseek-r1:70b"}, func(api.GenerateResponse) error { return nil })
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	c1.On("Generate", ctx, &api.GenerateRequest{Model: "deepseek-r1:70b", Prompt: "?"}, mock.Anything).Once().Return(api.StatusError{StatusCode: http.StatusBadRequest, ErrorMessage: "invalid options"})
+	err = r.Generate(ctx, &api.GenerateRequest{Model: "deepseek-r1:70b", Prompt: "?"}, func(api.GenerateResponse) error { return nil })
+	assert.EqualError(t, err, "invalid options")
+
+	// the last error is returned when all the models fail
+	c1.On("Embed", ctx, &api.EmbedRequest{Model: "deepseek-r1:70b"}).Once().Return(nil, errDial)
+	c1.On("Embed", ctx, &api.EmbedRequest{Model: "deepseek-r1:14b"}).Once().Return(nil, errDial)
+	c2.On("Embed", ctx, &api.EmbedRequest{Model: "llama3.2", Options: map[string]any{"num_ctx": 2048}}).Once().Return(nil, api.StatusError{StatusCode: http.StatusServiceUnavailable, ErrorMessage: "busy"})
+	_, err = r.Embed(ctx, &api.EmbedRequest{Model: "deepseek-r1:70b"})
+	assert.EqualError(t, err, "busy")
+
+	// the fallbacks of the fallbacks are not used
+	c1.On("Embeddings", ctx, &api.EmbeddingRequest{Model: "deepseek-r1:14b"}).Once().Return(nil, errDial)
+	_, err = r.Embeddings(ctx, &api.EmbeddingRequest{Model: "deepseek-r1:14b"})
+	assert.Equal(t, errDial, err)
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestRouterFallbacksAuthorizesAndLimits(t *testing.T) {
 	c1 := mocks.NewIOllamaClient(t)
 	c2 := mocks.NewIOllamaClient(t)
 	ctx, cancel, r, err := newRouter(
@@ -146,62 +959,519 @@ func TestRouterChat(t *testing.T) {
 			"c1": c1,
 			"c2": c2,
 		},
-		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}, "other_model": {ConnectionID: "c2"}},
-		gollamas.WithAlias("llama3", "llama3.2"), gollamas.WithAlias("some_alias", "other_model"),
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"deepseek-r1:70b": {ConnectionID: "c1", Fallbacks: []gollamas.ModelID{"deepseek-r1:14b", "llama3.2"}, RateLimit: &gollamas.RateLimitConfig{TokensPerDay: 10}},
+			"deepseek-r1:14b": {ConnectionID: "c1", RateLimit: &gollamas.RateLimitConfig{TokensPerDay: 10}},
+			"llama3.2":        {ConnectionID: "c2"},
+		},
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "ci", Key: "secret1", Models: []gollamas.ModelID{"deepseek*"}}),
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "admin", Key: "secret2", Models: []gollamas.ModelID{"*"}, Admin: true}),
 	)
 	defer cancel()
 	assert.NoError(t, err)
-	assert.NotNil(t, r)
+	kctx, err := r.Authenticate(ctx, "secret1")
+	assert.NoError(t, err)
 	cb := func(api.ChatResponse) error { return nil }
 
-	err = r.Chat(ctx, &api.ChatRequest{
-		Model: "unknown_model",
-	}, cb)
-	assert.EqualError(t, err, "gollamas router is missing a valid route to model unknown_model")
+	// the tokens count against the fallback model which answered
+	c1.On("Chat", kctx, &api.ChatRequest{Model: "deepseek-r1:70b"}, mock.Anything).Twice().Return(errDial)
+	c1.On("Chat", kctx, &api.ChatRequest{Model: "deepseek-r1:14b"}, mock.Anything).Once().Run(func(args mock.Arguments) {
+		fn := args.Get(2).(api.ChatResponseFunc)
+		assert.NoError(t, fn(api.ChatResponse{Done: true, Metrics: api.Metrics{PromptEvalCount: 6, EvalCount: 5}}))
+	}).Return(nil)
+	assert.NoError(t, r.Chat(kctx, &api.ChatRequest{Model: "deepseek-r1:70b"}, cb))
 
-	req := &api.ChatRequest{
-		Model: "llama3.2",
-	}
-	c1.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
-	err = r.Chat(ctx, req, cb)
+	// the fallbacks over the limits of the client or which the key is not allowed to use are skipped
+	err = r.Chat(kctx, &api.ChatRequest{Model: "deepseek-r1:70b"}, cb)
+	assert.Equal(t, errDial, err)
+
+	actx, err := r.Authenticate(ctx, "secret2")
 	assert.NoError(t, err)
+	limits, err := r.Limits(actx)
+	assert.NoError(t, err)
+	tokens := map[gollamas.ModelID]int{}
+	for _, l := range limits {
+		tokens[l.Model] = l.TokensToday
+	}
+	assert.Equal(t, 0, tokens["deepseek-r1:70b"])
+	assert.Equal(t, 11, tokens["deepseek-r1:14b"])
 
-	reqAlias := &api.ChatRequest{
-		Model: "llama3",
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestNewRouterFailsOnInvalidFallbacks(t *testing.T) {
+	for _, tc := range []struct {
+		fallbacks []gollamas.ModelID
+		err       string
+	}{
+		{[]gollamas.ModelID{"mistral"}, "model llama3.2 falls back to unknown model mistral"},
+		{[]gollamas.ModelID{"llama3.2:latest"}, "model llama3.2 cannot fall back to itself"},
+	} {
+		r, err := gollamas.NewRouter(
+			map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": mocks.NewIOllamaClient(t)},
+			map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1", Fallbacks: tc.fallbacks}},
+		)
+		assert.EqualError(t, err, tc.err)
+		assert.Nil(t, r)
 	}
-	c1.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
-	err = r.Chat(ctx, reqAlias, cb)
+}
+
+func TestRouterAPIKeys(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"llama3.2":          {ConnectionID: "c1"},
+			"qwen2.5-coder:14b": {ConnectionID: "c1"},
+			"deepseek-r1:14b":   {ConnectionID: "c1"},
+		},
+		gollamas.WithAlias("small", "llama3.2"),
+		gollamas.WithPreset("code-reviewer", gollamas.PresetConfig{Model: "qwen2.5-coder:14b"}),
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "ci", Key: "secret1", Models: []gollamas.ModelID{"llama3.2", "code-reviewer"}}),
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "admin", Key: "secret2", Models: []gollamas.ModelID{"*"}}),
+	)
+	defer cancel()
 	assert.NoError(t, err)
+	cb := func(api.ChatResponse) error { return nil }
 
-	req = &api.ChatRequest{
-		Model: "llama3.2:latest",
-	}
-	c1.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
-	err = r.Chat(ctx, req, cb)
+	_, err = r.Authenticate(ctx, "")
+	assert.EqualError(t, err, "gollamas: missing or invalid api key")
+	_, err = r.Authenticate(ctx, "secret3")
+	assert.EqualError(t, err, "gollamas: missing or invalid api key")
+	kctx, err := r.Authenticate(ctx, "secret1")
 	assert.NoError(t, err)
 
-	req = &api.ChatRequest{
-		Model: "other_model",
+	// the models, their aliases and the presets listed by the key are allowed
+	c1.On("Chat", kctx, &api.ChatRequest{Model: "llama3.2"}, mock.Anything).Twice().Return(nil)
+	assert.NoError(t, r.Chat(kctx, &api.ChatRequest{Model: "llama3.2"}, cb))
+	assert.NoError(t, r.Chat(kctx, &api.ChatRequest{Model: "small"}, cb))
+	c1.On("Chat", kctx, &api.ChatRequest{Model: "qwen2.5-coder:14b"}, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(kctx, &api.ChatRequest{Model: "code-reviewer"}, cb))
+
+	err = r.Chat(kctx, &api.ChatRequest{Model: "qwen2.5-coder:14b"}, cb)
+	assert.EqualError(t, err, "gollamas: api key ci is not allowed to use model qwen2.5-coder:14b")
+	var httpErr *gollamas.HttpError
+	assert.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusForbidden, httpErr.StatusCode())
+	_, err = r.Embed(kctx, &api.EmbedRequest{Model: "deepseek-r1:14b"})
+	assert.EqualError(t, err, "gollamas: api key ci is not allowed to use model deepseek-r1:14b")
+	_, err = r.Show(kctx, &api.ShowRequest{Model: "deepseek-r1:14b"})
+	assert.EqualError(t, err, "gollamas: api key ci is not allowed to use model deepseek-r1:14b")
+	err = r.Pull(kctx, &api.PullRequest{Model: "deepseek-r1:14b"}, func(api.ProgressResponse) error { return nil })
+	assert.EqualError(t, err, "gollamas: api key ci is not allowed to use model deepseek-r1:14b")
+
+	// only the models allowed are listed
+	c1.On("List", mock.Anything).Twice().Return(&api.ListResponse{Models: []api.ListModelResponse{
+		{Name: "llama3.2", Model: "llama3.2"},
+		{Name: "qwen2.5-coder:14b", Model: "qwen2.5-coder:14b"},
+		{Name: "deepseek-r1:14b", Model: "deepseek-r1:14b"},
+	}}, nil)
+	lr, err := r.List(kctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []api.ListModelResponse{
+		{Name: "llama3.2", Model: "llama3.2"},
+		{Name: "small", Model: "small"},
+		{Name: "code-reviewer", Model: "code-reviewer"},
+	}, lr.Models)
+	actx, err := r.Authenticate(ctx, "secret2")
+	assert.NoError(t, err)
+	lr, err = r.List(actx)
+	assert.NoError(t, err)
+	assert.Len(t, lr.Models, 5)
+}
+
+func TestRouterAPIKeysByClientCertificate(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"llama3.2":        {ConnectionID: "c1"},
+			"deepseek-r1:14b": {ConnectionID: "c1"},
+		},
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "ci", Certificate: "ci.gollamas.local", Models: []gollamas.ModelID{"llama3.2"}}),
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "admin", Key: "secret2", Certificate: "admin", Models: []gollamas.ModelID{"*"}}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	cb := func(api.ChatResponse) error { return nil }
+
+	// the certificates without a key are not authenticated
+	_, err = r.Authenticate(gollamas.WithClientCertificate(ctx, "dev"), "")
+	assert.EqualError(t, err, "gollamas: missing or invalid api key")
+	kctx, err := r.Authenticate(gollamas.WithClientCertificate(ctx, "ci.gollamas.local"), "")
+	assert.NoError(t, err)
+	c1.On("Chat", kctx, &api.ChatRequest{Model: "llama3.2"}, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(kctx, &api.ChatRequest{Model: "llama3.2"}, cb))
+	err = r.Chat(kctx, &api.ChatRequest{Model: "deepseek-r1:14b"}, cb)
+	assert.EqualError(t, err, "gollamas: api key ci is not allowed to use model deepseek-r1:14b")
+	assert.EqualError(t, r.AuthorizeAdmin(kctx), "gollamas: api key ci is not an admin key")
+
+	// the token sent by the client takes precedence over its certificate
+	actx, err := r.Authenticate(gollamas.WithClientCertificate(ctx, "ci.gollamas.local"), "secret2")
+	assert.NoError(t, err)
+	c1.On("Chat", actx, &api.ChatRequest{Model: "deepseek-r1:14b"}, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(actx, &api.ChatRequest{Model: "deepseek-r1:14b"}, cb))
+	_, err = r.Authenticate(gollamas.WithClientCertificate(ctx, "admin"), "secret3")
+	assert.EqualError(t, err, "gollamas: missing or invalid api key")
+}
+
+func TestNewRouterFailsOnInvalidAPIKeys(t *testing.T) {
+	for _, tc := range []struct {
+		keys []gollamas.APIKeyConfig
+		err  string
+	}{
+		{[]gollamas.APIKeyConfig{{Key: "secret1", Models: []gollamas.ModelID{"*"}}}, "invalid api key: empty api key name"},
+		{[]gollamas.APIKeyConfig{{Name: "ci", Models: []gollamas.ModelID{"*"}}}, "invalid api key: empty key for api key ci"},
+		{[]gollamas.APIKeyConfig{{Name: "ci", Key: "secret1"}}, "invalid api key: api key ci allows no models"},
+		{[]gollamas.APIKeyConfig{
+			{Name: "ci", Key: "secret1", Models: []gollamas.ModelID{"*"}},
+			{Name: "admin", Key: "secret1", Models: []gollamas.ModelID{"*"}},
+		}, "duplicate api key admin"},
+		{[]gollamas.APIKeyConfig{
+			{Name: "ci", Certificate: "ci", Models: []gollamas.ModelID{"*"}},
+			{Name: "admin", Certificate: "ci", Models: []gollamas.ModelID{"*"}},
+		}, "duplicate api key admin"},
+	} {
+		r, err := gollamas.NewRouter(
+			map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": mocks.NewIOllamaClient(t)},
+			map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+			gollamas.WithAPIKeys(tc.keys),
+		)
+		assert.EqualError(t, err, tc.err)
+		assert.Nil(t, r)
 	}
-	c2.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
-	err = r.Chat(ctx, req, cb)
+}
+
+func TestRouterRateLimits(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"llama3.2":        {ConnectionID: "c1"},
+			"deepseek-r1:70b": {ConnectionID: "c1", RateLimit: &gollamas.RateLimitConfig{TokensPerDay: 10}},
+		},
+		gollamas.WithRateLimit(gollamas.RateLimitConfig{RequestsPerMinute: 2}),
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "ci", Key: "secret1", Models: []gollamas.ModelID{"*"}}),
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "admin", Key: "secret2", Models: []gollamas.ModelID{"*"}, Admin: true}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	kctx, err := r.Authenticate(gollamas.WithClientIP(ctx, "10.0.0.1"), "secret1")
 	assert.NoError(t, err)
 
-	reqAlias = &api.ChatRequest{
-		Model: "some_alias",
+	// the tokens of the final response are counted
+	c1.On("Generate", kctx, &api.GenerateRequest{Model: "deepseek-r1:70b"}, mock.Anything).Once().Run(func(args mock.Arguments) {
+		fn := args.Get(2).(api.GenerateResponseFunc)
+		assert.NoError(t, fn(api.GenerateResponse{Done: true, Metrics: api.Metrics{PromptEvalCount: 6, EvalCount: 5}}))
+	}).Return(nil)
+	assert.NoError(t, r.Generate(kctx, &api.GenerateRequest{Model: "deepseek-r1:70b"}, func(api.GenerateResponse) error { return nil }))
+	err = r.Generate(kctx, &api.GenerateRequest{Model: "deepseek-r1:70b"}, func(api.GenerateResponse) error { return nil })
+	assert.EqualError(t, err, "gollamas: daily token quota exceeded")
+	var httpErr *gollamas.HttpError
+	assert.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusTooManyRequests, httpErr.StatusCode())
+
+	c1.On("Embed", kctx, &api.EmbedRequest{Model: "llama3.2"}).Once().Return(&api.EmbedResponse{PromptEvalCount: 3}, nil)
+	_, err = r.Embed(kctx, &api.EmbedRequest{Model: "llama3.2"})
+	assert.NoError(t, err)
+	_, err = r.Embed(kctx, &api.EmbedRequest{Model: "llama3.2"})
+	assert.EqualError(t, err, "gollamas: too many requests")
+
+	// the requests without a client, ie: sent by the router itself, are not limited
+	c1.On("Embed", ctx, &api.EmbedRequest{Model: "llama3.2"}).Times(4).Return(&api.EmbedResponse{}, nil)
+	for range 4 {
+		_, err = r.Embed(ctx, &api.EmbedRequest{Model: "llama3.2"})
+		assert.NoError(t, err)
 	}
-	c2.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
-	err = r.Chat(ctx, reqAlias, cb)
+
+	_, err = r.Limits(kctx)
+	assert.EqualError(t, err, "gollamas: api key ci is not an admin key")
+	actx, err := r.Authenticate(ctx, "secret2")
+	assert.NoError(t, err)
+	limits, err := r.Limits(actx)
 	assert.NoError(t, err)
+	assert.Len(t, limits, 2)
+	assert.Equal(t, "key:ci", limits[0].Client)
+	assert.Equal(t, gollamas.ModelID(""), limits[0].Model)
+	assert.Equal(t, 14, limits[0].TokensToday)
+	assert.Equal(t, 0, *limits[0].Requests)
+	assert.Equal(t, gollamas.ModelID("deepseek-r1:70b"), limits[1].Model)
+	assert.Equal(t, 11, limits[1].TokensToday)
+}
 
-	c2.On("Chat", ctx, req, mock.Anything).Once().Return(errors.New("some error"))
-	err = r.Chat(ctx, req, cb)
-	assert.EqualError(t, err, "some error")
+func TestRouterRateLimitsCountInterruptedStreams(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"llama3.2": {ConnectionID: "c1", RateLimit: &gollamas.RateLimitConfig{TokensPerDay: 100}},
+		},
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "ci", Key: "secret1", Models: []gollamas.ModelID{"*"}}),
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "admin", Key: "secret2", Models: []gollamas.ModelID{"*"}, Admin: true}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	kctx, err := r.Authenticate(ctx, "secret1")
+	assert.NoError(t, err)
+
+	// the client disconnects after the second chunk
+	disconnected := errors.New("client disconnected")
+	c1.On("Chat", kctx, &api.ChatRequest{Model: "llama3.2"}, mock.Anything).Once().Return(func(_ context.Context, _ *api.ChatRequest, fn api.ChatResponseFunc) error {
+		for range 3 {
+			if err := fn(api.ChatResponse{Message: api.Message{Content: "a"}}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	chunks := 0
+	err = r.Chat(kctx, &api.ChatRequest{Model: "llama3.2"}, func(api.ChatResponse) error {
+		if chunks++; chunks == 2 {
+			return disconnected
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, disconnected)
+
+	// the request is canceled before the final response
+	cctx, ccancel := context.WithCancel(kctx)
+	c1.On("Generate", cctx, &api.GenerateRequest{Model: "llama3.2"}, mock.Anything).Once().Return(func(ctx context.Context, _ *api.GenerateRequest, fn api.GenerateResponseFunc) error {
+		for range 3 {
+			assert.NoError(t, fn(api.GenerateResponse{Response: "a"}))
+		}
+		ccancel()
+		return ctx.Err()
+	})
+	err = r.Generate(cctx, &api.GenerateRequest{Model: "llama3.2"}, func(api.GenerateResponse) error { return nil })
+	assert.ErrorIs(t, err, context.Canceled)
+
+	actx, err := r.Authenticate(ctx, "secret2")
+	assert.NoError(t, err)
+	limits, err := r.Limits(actx)
+	assert.NoError(t, err)
+	assert.Len(t, limits, 1)
+	assert.Equal(t, gollamas.ModelID("llama3.2"), limits[0].Model)
+	assert.Equal(t, 5, limits[0].TokensToday)
+}
+
+func TestNewRouterFailsOnInvalidRateLimit(t *testing.T) {
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": mocks.NewIOllamaClient(t)},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1", RateLimit: &gollamas.RateLimitConfig{Concurrency: -1}}},
+	)
+	assert.EqualError(t, err, "invalid rate limit for model llama3.2: invalid rate limit concurrency: -1")
+	assert.Nil(t, r)
+
+	r, err = gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": mocks.NewIOllamaClient(t)},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+		gollamas.WithRateLimit(gollamas.RateLimitConfig{TokensPerDay: -1}),
+	)
+	assert.EqualError(t, err, "failed to apply options: invalid rate limit: invalid rate limit tokens per day: -1")
+	assert.Nil(t, r)
+}
+
+func TestRouterQueues(t *testing.T) {
+	depth := 1
+	c1 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"llama3.2": {ConnectionID: "c1", Queue: &gollamas.QueueConfig{Concurrency: 1, MaxDepth: &depth}},
+		},
+		gollamas.WithQueue(gollamas.QueueConfig{Concurrency: 2}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	c1.On("Embed", mock.Anything, &api.EmbedRequest{Model: "llama3.2"}).Once().Run(func(mock.Arguments) {
+		close(started)
+		<-unblock
+	}).Return(&api.EmbedResponse{}, nil)
+	first := make(chan error)
+	go func() {
+		_, err := r.Embed(ctx, &api.EmbedRequest{Model: "llama3.2"})
+		first <- err
+	}()
+	<-started
+	assert.Equal(t, 1, r.Health()[0].Queue.InFlight)
+
+	qctx, qcancel := context.WithCancel(ctx)
+	queued := make(chan error)
+	go func() {
+		_, err := r.Embed(qctx, &api.EmbedRequest{Model: "llama3.2"})
+		queued <- err
+	}()
+	assert.Eventually(t, func() bool { return r.Queues()[0].Depth == 1 }, time.Second, time.Millisecond)
+
+	_, err = r.Embed(ctx, &api.EmbedRequest{Model: "llama3.2"})
+	assert.EqualError(t, err, "gollamas: too many requests queued for model llama3.2")
+	var httpErr *gollamas.HttpError
+	assert.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusServiceUnavailable, httpErr.StatusCode())
+
+	// the client of the queued request goes away
+	qcancel()
+	assert.ErrorIs(t, <-queued, context.Canceled)
+	queues := r.Queues()
+	assert.Len(t, queues, 1)
+	assert.Equal(t, gollamas.ModelID("llama3.2"), queues[0].Model)
+	assert.Equal(t, 0, queues[0].Depth)
+	assert.Equal(t, 1, queues[0].InFlight)
+	assert.Equal(t, int64(1), queues[0].Rejected)
+
+	close(unblock)
+	assert.NoError(t, <-first)
+	assert.Equal(t, 0, r.Queues()[0].InFlight)
+	assert.Equal(t, 0, r.Health()[0].Queue.InFlight)
+	assert.Equal(t, 2, r.Health()[0].Queue.Concurrency)
+}
+
+func TestRouterQueueRejectionsAreNotRetried(t *testing.T) {
+	depth := 0
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"llama3.2": {ConnectionID: "c1", Fallbacks: []gollamas.ModelID{"qwen2.5"}},
+			"qwen2.5":  {ConnectionID: "c2"},
+		},
+		gollamas.WithRetry(gollamas.RetryConfig{MaxAttempts: 2}),
+		gollamas.WithConnectionQueues(map[gollamas.ConnectionID]gollamas.QueueConfig{"c1": {Concurrency: 1, MaxDepth: &depth}}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
 
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	c1.On("Embed", mock.Anything, &api.EmbedRequest{Model: "llama3.2"}).Once().Run(func(mock.Arguments) {
+		close(started)
+		<-unblock
+	}).Return(&api.EmbedResponse{}, nil)
+	first := make(chan error)
+	go func() {
+		_, err := r.Embed(ctx, &api.EmbedRequest{Model: "llama3.2"})
+		first <- err
+	}()
+	<-started
+
+	// the full queue is answered with 503, the request is not sent to the fallback model
+	_, err = r.Embed(ctx, &api.EmbedRequest{Model: "llama3.2"})
+	assert.EqualError(t, err, "gollamas: too many requests queued for connection c1")
+	var httpErr *gollamas.HttpError
+	assert.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusServiceUnavailable, httpErr.StatusCode())
+	// and the show requests wait in the queue of the connection as well
+	_, err = r.Show(ctx, &api.ShowRequest{Model: "llama3.2"})
+	assert.EqualError(t, err, "gollamas: too many requests queued for connection c1")
+
+	close(unblock)
+	assert.NoError(t, <-first)
 	c1.AssertExpectations(t)
 	c2.AssertExpectations(t)
 }
 
+func TestNewRouterFailsOnInvalidQueue(t *testing.T) {
+	depth := -1
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": mocks.NewIOllamaClient(t)},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1", Queue: &gollamas.QueueConfig{MaxDepth: &depth}}},
+	)
+	assert.EqualError(t, err, "invalid queue for model llama3.2: invalid queue max depth: -1")
+	assert.Nil(t, r)
+
+	r, err = gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": mocks.NewIOllamaClient(t)},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+		gollamas.WithConnectionQueues(map[gollamas.ConnectionID]gollamas.QueueConfig{"c1": {Concurrency: -1}}),
+	)
+	assert.EqualError(t, err, "failed to apply options: invalid queue for connection c1: invalid queue concurrency: -1")
+	assert.Nil(t, r)
+}
+
+func TestRouterReady(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": c1, "c2": c2},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}, "phi4:14b": {ConnectionID: "c2"}},
+		gollamas.WithReadiness(gollamas.ReadinessConfig{MinConnections: 2, CacheTTL: gollamas.Duration(time.Hour)}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	c1.On("Heartbeat", mock.Anything).Once().Return(nil)
+	c2.On("Heartbeat", mock.Anything).Once().Return(errors.New("connection refused"))
+
+	res := r.Ready(ctx)
+	assert.False(t, res.Ready)
+	assert.Equal(t, "1 of 2 connections reachable, 2 required", res.Reason)
+	if assert.Len(t, res.Connections, 2) {
+		assert.Equal(t, gollamas.ConnectionID("c1"), res.Connections[0].ConnectionID)
+		assert.True(t, res.Connections[0].Reachable)
+		assert.Equal(t, gollamas.ConnectionID("c2"), res.Connections[1].ConnectionID)
+		assert.False(t, res.Connections[1].Reachable)
+		assert.Equal(t, "connection refused", res.Connections[1].Error)
+	}
+	// the checks are cached
+	assert.Equal(t, res, r.Ready(ctx))
+}
+
+func TestRouterReadyRequiredModels(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": c1, "c2": c2},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {Connections: []gollamas.ConnectionID{"c1", "c2"}}, "phi4:14b": {ConnectionID: "c2"}},
+		gollamas.WithAlias("llama", "llama3.2"),
+		gollamas.WithReadiness(gollamas.ReadinessConfig{RequiredModels: []gollamas.ModelID{"llama"}, CacheTTL: gollamas.Duration(time.Millisecond)}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	c1.On("List", mock.Anything).Return(&api.ListResponse{Models: []api.ListModelResponse{{Name: "llama3.2:latest", Model: "llama3.2:latest"}}}, nil)
+	c2.On("List", mock.Anything).Once().Return(&api.ListResponse{Models: []api.ListModelResponse{{Name: "phi4:14b", Model: "phi4:14b"}}}, nil)
+
+	res := r.Ready(ctx)
+	assert.True(t, res.Ready)
+	assert.Equal(t, []gollamas.ModelReadiness{{Model: "llama", Available: true, Connections: []gollamas.ConnectionID{"c1"}}}, res.Models)
+
+	// the checks expire
+	time.Sleep(2 * time.Millisecond)
+	c1.On("List", mock.Anything).Unset()
+	c1.On("List", mock.Anything).Return(nil, errors.New("connection refused"))
+	c2.On("List", mock.Anything).Return(&api.ListResponse{}, nil)
+	res = r.Ready(ctx)
+	assert.False(t, res.Ready)
+	assert.Equal(t, "model llama is not available", res.Reason)
+	assert.Equal(t, []gollamas.ModelReadiness{{Model: "llama"}}, res.Models)
+}
+
+func TestNewRouterFailsOnInvalidReadiness(t *testing.T) {
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": mocks.NewIOllamaClient(t)},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+		gollamas.WithReadiness(gollamas.ReadinessConfig{MinConnections: -1}),
+	)
+	assert.EqualError(t, err, "failed to apply options: invalid readiness min connections: -1")
+	assert.Nil(t, r)
+}
+
 func TestRouterCopy(t *testing.T) {
 	c1 := mocks.NewIOllamaClient(t)
 	c2 := mocks.NewIOllamaClient(t)
@@ -575,10 +1845,127 @@ func TestRouterHeartbeat(t *testing.T) {
 	err = r.Heartbeat(ctx)
 	assert.NoError(t, err)
 
+	c1.On("Heartbeat", ctx).Once().Return(nil)
+	c2.On("Heartbeat", ctx).Once().Return(errors.New("connection refused"))
+	err = r.Heartbeat(ctx)
+	assert.EqualError(t, err, "connection c2: connection refused")
+
 	c1.AssertExpectations(t)
 	c2.AssertExpectations(t)
 }
 
+func TestRouterHealthChecks(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	var c1Down atomic.Bool
+	c1Down.Store(true)
+	c1.On("Heartbeat", mock.Anything).Return(func(context.Context) error {
+		if c1Down.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	c2.On("Heartbeat", mock.Anything).Return(nil)
+	c2.On("Version", mock.Anything).Return("0.6.8", nil)
+	c1.On("Version", mock.Anything).Return("0.6.8", nil).Maybe()
+
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1", Connections: []gollamas.ConnectionID{"c2"}}},
+		gollamas.WithHealthCheck(gollamas.HealthCheckConfig{
+			Interval:           gollamas.Duration(5 * time.Millisecond),
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 2,
+			CheckVersion:       true,
+		}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+	defer r.Close()
+
+	assert.Eventually(t, func() bool {
+		h := r.Health()
+		return len(h) == 2 && !h[0].Healthy && h[1].Healthy
+	}, time.Second, time.Millisecond)
+	h := r.Health()
+	assert.Equal(t, gollamas.ConnectionID("c1"), h[0].ConnectionID)
+	assert.Equal(t, "connection refused", h[0].LastError)
+	assert.GreaterOrEqual(t, h[0].ConsecutiveFailures, 2)
+	assert.NotNil(t, h[0].LastCheck)
+
+	// c1 is unhealthy, all requests go to c2
+	cb := func(api.ChatResponse) error { return nil }
+	req := &api.ChatRequest{
+		Model: "llama3.2",
+	}
+	c2.On("Chat", ctx, req, mock.Anything).Times(3).Return(nil)
+	for range 3 {
+		assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb))
+	}
+
+	c1Down.Store(false)
+	assert.Eventually(t, func() bool {
+		return r.Health()[0].Healthy
+	}, time.Second, time.Millisecond)
+
+	assert.NoError(t, r.Close())
+	c2.AssertExpectations(t)
+}
+
+func TestRouterHealthChecksKeepsRoutingWhenAllConnectionsAreUnhealthy(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	c1.On("Heartbeat", mock.Anything).Return(errors.New("connection refused"))
+	c2.On("Heartbeat", mock.Anything).Return(errors.New("connection refused"))
+
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1", Connections: []gollamas.ConnectionID{"c2"}}},
+		gollamas.WithHealthCheck(gollamas.HealthCheckConfig{
+			Interval:           gollamas.Duration(5 * time.Millisecond),
+			UnhealthyThreshold: 1,
+		}),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+	defer r.Close()
+
+	assert.Eventually(t, func() bool {
+		h := r.Health()
+		return !h[0].Healthy && !h[1].Healthy
+	}, time.Second, time.Millisecond)
+
+	cb := func(api.ChatResponse) error { return nil }
+	req := &api.ChatRequest{
+		Model: "llama3.2",
+	}
+	c1.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
+	c2.On("Chat", ctx, req, mock.Anything).Once().Return(nil)
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb))
+	assert.NoError(t, r.Chat(ctx, &api.ChatRequest{Model: "llama3.2"}, cb))
+}
+
+func TestNewRouterFailsOnInvalidHealthCheck(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+		gollamas.WithHealthCheck(gollamas.HealthCheckConfig{Interval: gollamas.Duration(-time.Second)}),
+	)
+	assert.EqualError(t, err, "failed to apply options: invalid health check interval: -1s")
+	assert.Nil(t, r)
+}
+
 // List(ctx context.Context) (*api.ListResponse, error)
 func TestRouterListNoExposeAliases(t *testing.T) {
 	c1 := mocks.NewIOllamaClient(t)
@@ -761,6 +2148,49 @@ func TestRouterListRunning(t *testing.T) {
 	c2.AssertExpectations(t)
 }
 
+func TestRouterListMultipleConnections(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	ctx, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1", Connections: []gollamas.ConnectionID{"c2"}}, "other_model": {ConnectionID: "c2"}},
+		gollamas.WithAlias("llama3", "llama3.2"), gollamas.WithExposeAliases(true),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+
+	c1.On("List", ctx).Once().Return(&api.ListResponse{Models: []api.ListModelResponse{{Model: "llama3.2", Name: "llama3.2", ModifiedAt: time.UnixMilli(123456789), Digest: "old"}}}, nil)
+	c2.On("List", ctx).Once().Return(&api.ListResponse{Models: []api.ListModelResponse{
+		{Model: "llama3.2", Name: "llama3.2", ModifiedAt: time.UnixMilli(223456789), Digest: "new"},
+		{Model: "other_model", Name: "other_model", ModifiedAt: time.UnixMilli(23456789)},
+	}}, nil)
+
+	resp, err := r.List(ctx)
+	assert.NoError(t, err)
+	assert.EqualValues(t, &api.ListResponse{Models: []api.ListModelResponse{
+		{Model: "llama3.2", Name: "llama3.2", ModifiedAt: time.UnixMilli(223456789), Digest: "new"},
+		{Model: "llama3", Name: "llama3", ModifiedAt: time.UnixMilli(223456789), Digest: "new"},
+		{Model: "other_model", Name: "other_model", ModifiedAt: time.UnixMilli(23456789)},
+	}}, resp)
+
+	c1.On("ListRunning", ctx).Once().Return(&api.ProcessResponse{Models: []api.ProcessModelResponse{{Model: "llama3.2", Name: "llama3.2", ExpiresAt: time.UnixMilli(323456789)}}}, nil)
+	c2.On("ListRunning", ctx).Once().Return(&api.ProcessResponse{Models: []api.ProcessModelResponse{{Model: "llama3.2", Name: "llama3.2", ExpiresAt: time.UnixMilli(123456789)}}}, nil)
+
+	presp, err := r.ListRunning(ctx)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []api.ProcessModelResponse{
+		{Model: "llama3.2", Name: "llama3.2", ExpiresAt: time.UnixMilli(323456789)},
+		{Model: "llama3", Name: "llama3", ExpiresAt: time.UnixMilli(323456789)},
+	}, presp.Models)
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
 // Pull(ctx context.Context, req *api.PullRequest, fn api.PullProgressFunc) error
 func TestRouterPull(t *testing.T) {
 	c1 := mocks.NewIOllamaClient(t)
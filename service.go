@@ -6,9 +6,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/envconfig"
@@ -45,9 +50,11 @@ func NewService(r IOllamaClient) (*Service, error) {
 	if r == nil {
 		return nil, errors.New("missing ollama client")
 	}
-	return &Service{
-		r: r,
-	}, nil
+	s := &Service{}
+	s.r.Store(&serviceClient{r})
+	s.metrics = newServiceMetrics(s)
+	s.SetAccessLogOutput(os.Stdout)
+	return s, nil
 }
 
 //go:generate mockery --name IOllamaClient --output mocks
@@ -69,8 +76,40 @@ type IOllamaClient interface {
 	Version(ctx context.Context) (string, error)
 }
 
+// serviceClient wraps the client so it can be swapped atomically.
+type serviceClient struct {
+	IOllamaClient
+}
+
 type Service struct {
-	r IOllamaClient
+	r         atomic.Pointer[serviceClient]
+	metrics   *serviceMetrics
+	accessLog atomic.Pointer[log.Logger]
+	inFlight  atomic.Int64
+	draining  atomic.Bool
+	// clientCert requires a verified client certificate on the routes which are not left open, with mutual TLS
+	clientCert atomic.Bool
+}
+
+// SetClient replaces the client used by the service.
+// Requests already being processed carry on with the previous client.
+func (s *Service) SetClient(r IOllamaClient) error {
+	if r == nil {
+		return errors.New("missing ollama client")
+	}
+	s.r.Store(&serviceClient{r})
+	return nil
+}
+
+// SetRequireClientCertificate requires a client certificate verified during the TLS handshake on the routes
+// which are not left open for the probes.
+func (s *Service) SetRequireClientCertificate(required bool) {
+	s.clientCert.Store(required)
+}
+
+// Client returns the client currently used by the service.
+func (s *Service) Client() IOllamaClient {
+	return s.r.Load().IOllamaClient
 }
 
 func (s *Service) HomeHandler(c *gin.Context) {
@@ -78,23 +117,23 @@ func (s *Service) HomeHandler(c *gin.Context) {
 }
 
 func (s *Service) PullHandler(c *gin.Context) {
-	handleStreamRequest(c, s.r.Pull)
+	handleStreamRequest(c, s.Client().Pull)
 }
 
 func (s *Service) GenerateHandler(c *gin.Context) {
-	handleStreamRequest(c, s.r.Generate)
+	handleStreamRequest(c, s.Client().Generate)
 }
 
 func (s *Service) ChatHandler(c *gin.Context) {
-	handleStreamRequest(c, s.r.Chat)
+	handleStreamRequest(c, s.Client().Chat)
 }
 
 func (s *Service) EmbedHandler(c *gin.Context) {
-	handleRequest(c, s.r.Embed)
+	handleRequest(c, s.Client().Embed)
 }
 
 func (s *Service) EmbeddingsHandler(c *gin.Context) {
-	handleRequest(c, s.r.Embeddings)
+	handleRequest(c, s.Client().Embeddings)
 }
 
 func (s *Service) CreateHandler(c *gin.Context) {
@@ -114,7 +153,7 @@ func (s *Service) DeleteHandler(c *gin.Context) {
 }
 
 func (s *Service) ShowHandler(c *gin.Context) {
-	handleRequest(c, s.r.Show)
+	handleRequest(c, s.Client().Show)
 }
 
 func (s *Service) CreateBlobHandler(c *gin.Context) {
@@ -126,15 +165,148 @@ func (s *Service) HeadBlobHandler(c *gin.Context) {
 }
 
 func (s *Service) PsHandler(c *gin.Context) {
-	handle(c, s.r.ListRunning)
+	handle(c, s.Client().ListRunning)
 }
 
 func (s *Service) ListHandler(c *gin.Context) {
-	handle(c, s.r.List)
+	handle(c, s.Client().List)
 }
 
 func (s *Service) VersionHandler(c *gin.Context) {
-	handle(c, s.r.Version)
+	handle(c, s.Client().Version)
+}
+
+// HealthHandler reports the health state of the connections, of the preloaded models and of the queues of the models.
+func (s *Service) HealthHandler(c *gin.Context) {
+	hr, ok := s.Client().(interface{ Health() []ConnectionHealth })
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "gollamas: health state is not available"})
+		return
+	}
+	res := HealthResponse{Connections: hr.Health()}
+	if wr, ok := hr.(interface{ Warm() []WarmState }); ok {
+		res.Models = wr.Warm()
+	}
+	if qr, ok := hr.(interface{ Queues() []QueueState }); ok {
+		res.Queues = qr.Queues()
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// LiveHandler reports that the router is alive, whatever the state of its connections.
+func (s *Service) LiveHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "alive"})
+}
+
+// ReadyHandler reports whether the router accepts requests: it is not ready once it is shutting down,
+// nor when the router reports that too few connections or not all the required models are reachable.
+func (s *Service) ReadyHandler(c *gin.Context) {
+	if s.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, ReadyResponse{Reason: "shutting down"})
+		return
+	}
+	rr, ok := s.Client().(interface {
+		Ready(ctx context.Context) ReadyResponse
+	})
+	if !ok {
+		c.JSON(http.StatusOK, ReadyResponse{Ready: true})
+		return
+	}
+	res := rr.Ready(c.Request.Context())
+	if !res.Ready {
+		c.JSON(http.StatusServiceUnavailable, res)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// MetricsMiddleware records the metrics of each request, with the models and connection the router reports through its context.
+func (s *Service) MetricsMiddleware(c *gin.Context) {
+	ctx, ri := withRequestInfo(c.Request.Context(), s.metrics)
+	c.Request = c.Request.WithContext(ctx)
+	route := c.FullPath()
+	s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	s.metrics.requestsInFlight.WithLabelValues(route).Inc()
+	defer s.metrics.requestsInFlight.WithLabelValues(route).Dec()
+	c.Next()
+	s.metrics.observe(ri, route, c.Writer.Status())
+}
+
+// MetricsHandler serves the metrics in the Prometheus format, only to the admin API keys when the requests are authenticated.
+func (s *Service) MetricsHandler(c *gin.Context) {
+	if a, ok := s.Client().(interface {
+		AuthorizeAdmin(ctx context.Context) error
+	}); ok {
+		if err := a.AuthorizeAdmin(c.Request.Context()); err != nil {
+			abortGinError(c, err)
+			return
+		}
+	}
+	s.MetricsServer().ServeHTTP(c.Writer, c.Request)
+}
+
+// MetricsServer serves the metrics without authentication, ie: on a separate listener.
+func (s *Service) MetricsServer() http.Handler {
+	return promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// AuthHandler identifies the clients by their IP address, or their certificate with mutual TLS,
+// and authenticates the requests with the API key sent as a bearer token, when the client requires one.
+func (s *Service) AuthHandler(c *gin.Context) {
+	ctx := WithClientIP(c.Request.Context(), c.ClientIP())
+	if p := tlsPrincipal(c.Request.TLS); p != "" {
+		ctx = WithClientCertificate(ctx, p)
+	}
+	c.Request = c.Request.WithContext(ctx)
+	a, ok := s.Client().(interface {
+		Authenticate(ctx context.Context, token string) (context.Context, error)
+	})
+	// the home page, liveness and readiness are left open for the probes
+	if c.Request.URL.Path == "/" || c.Request.URL.Path == "/healthz" || c.Request.URL.Path == "/readyz" {
+		return
+	}
+	// the client certificate is optional during the handshake so that the probes reach the open routes
+	if s.clientCert.Load() && principalFromContext(ctx) == "" {
+		abortAuthError(c, NewHttpError(http.StatusUnauthorized, "gollamas: missing or invalid client certificate"))
+		return
+	}
+	if !ok {
+		return
+	}
+	scheme, token, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		token = ""
+	}
+	ctx, err := a.Authenticate(c.Request.Context(), strings.TrimSpace(token))
+	if err != nil {
+		c.Header("WWW-Authenticate", "Bearer")
+		abortAuthError(c, err)
+		return
+	}
+	c.Request = c.Request.WithContext(ctx)
+}
+
+// abortAuthError rejects a request which could not be authenticated, in the format of its API.
+func abortAuthError(c *gin.Context, err error) {
+	var httpErr *HttpError
+	if errors.As(err, &httpErr) && strings.HasPrefix(c.Request.URL.Path, "/v1/") {
+		c.AbortWithStatusJSON(httpErr.StatusCode(), openai.NewError(httpErr.StatusCode(), httpErr.Error()))
+		return
+	}
+	abortGinError(c, err)
+}
+
+// LimitsHandler reports the state of the rate limits of the clients.
+func (s *Service) LimitsHandler(c *gin.Context) {
+	lr, ok := s.Client().(interface {
+		Limits(ctx context.Context) ([]LimitState, error)
+	})
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "gollamas: limits are not available"})
+		return
+	}
+	handle(c, lr.Limits)
 }
 
 func BindRequest(c *gin.Context, req any) bool {
@@ -162,11 +334,14 @@ func handleRequest[T any, R any](c *gin.Context, fn func(context.Context, *T) (R
 	if !BindRequest(c, &req) {
 		return
 	}
-	resp, err := fn(c.Request.Context(), &req)
+	ctx := withServedModel(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+	resp, err := fn(ctx, &req)
 	if err != nil {
 		abortGinError(c, err)
 		return
 	}
+	setModelHeader(c)
 	c.JSON(http.StatusOK, resp)
 }
 
@@ -181,11 +356,16 @@ type IGinService interface {
 	EmbedHandler(c *gin.Context)
 	GenerateHandler(c *gin.Context)
 	HeadBlobHandler(c *gin.Context)
+	HealthHandler(c *gin.Context)
 	HomeHandler(c *gin.Context)
+	LimitsHandler(c *gin.Context)
 	ListHandler(c *gin.Context)
+	LiveHandler(c *gin.Context)
+	MetricsHandler(c *gin.Context)
 	PsHandler(c *gin.Context)
 	PullHandler(c *gin.Context)
 	PushHandler(c *gin.Context)
+	ReadyHandler(c *gin.Context)
 	ShowHandler(c *gin.Context)
 	VersionHandler(c *gin.Context)
 }
@@ -200,6 +380,7 @@ func GenerateRoutes(s IGinService) *gin.Engine {
 		"User-Agent",
 		"Accept",
 		"X-Requested-With",
+		RequestIDHeader,
 
 		// OpenAI compatibility headers
 		"x-stainless-lang",
@@ -215,17 +396,33 @@ func GenerateRoutes(s IGinService) *gin.Engine {
 		"x-stainless-custom-poll-interval",
 		"x-stainless-timeout",
 	}
+	corsConfig.ExposeHeaders = []string{ModelHeader, RequestIDHeader}
 	corsConfig.AllowOrigins = envconfig.AllowedOrigins()
-	r := gin.Default()
+	r := gin.New()
 	r.Use(
+		gin.Recovery(),
 		cors.New(corsConfig),
 	)
+	if l, ok := s.(interface{ AccessLogMiddleware(c *gin.Context) }); ok {
+		r.Use(l.AccessLogMiddleware)
+	}
+	if t, ok := s.(interface{ TracingMiddleware(c *gin.Context) }); ok {
+		r.Use(t.TracingMiddleware)
+	}
+	if m, ok := s.(interface{ MetricsMiddleware(c *gin.Context) }); ok {
+		r.Use(m.MetricsMiddleware)
+	}
+	if a, ok := s.(interface{ AuthHandler(c *gin.Context) }); ok {
+		r.Use(a.AuthHandler)
+	}
 
 	// refer to https://github.com/ollama/ollama/blob/0667baddc658d3f556a369701819e7695477f59a/server/routes.go#L1146
 	// for the routes and setup in this file
 	// General
 	r.HEAD("/", s.HomeHandler)
 	r.GET("/", s.HomeHandler)
+	r.GET("/healthz", s.LiveHandler)
+	r.GET("/readyz", s.ReadyHandler)
 	r.HEAD("/api/version", s.VersionHandler)
 	r.GET("/api/version", s.VersionHandler)
 
@@ -257,5 +454,10 @@ func GenerateRoutes(s IGinService) *gin.Engine {
 	r.GET("/v1/models", openai.ListMiddleware(), s.ListHandler)
 	r.GET("/v1/models/:model", openai.RetrieveMiddleware(), s.ShowHandler)
 
+	// Gollamas
+	r.GET("/gollamas/health", s.HealthHandler)
+	r.GET("/gollamas/limits", s.LimitsHandler)
+	r.GET("/metrics", s.MetricsHandler)
+
 	return r
 }
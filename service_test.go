@@ -3,15 +3,27 @@ package main_test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ollama/ollama/api"
 	gollamas "github.com/slawo/gollamas"
 	"github.com/slawo/gollamas/mocks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestNewServerFailsOnMissingRouter(t *testing.T) {
@@ -30,6 +42,63 @@ func TestNewServerSuccess(t *testing.T) {
 	r.AssertExpectations(t)
 }
 
+func TestServerSetClientFailsOnMissingClient(t *testing.T) {
+	r := mocks.NewIOllamaClient(t)
+	s, _ := gollamas.NewService(r)
+
+	assert.EqualError(t, s.SetClient(nil), "missing ollama client")
+	assert.Equal(t, r, s.Client())
+}
+
+func TestServerSetClientKeepsInFlightStreams(t *testing.T) {
+	jsonReq := []byte(`{"model": "some_model", "messages": [{"role": "user", "content": "hello"}]}`)
+	r1 := mocks.NewIOllamaClient(t)
+	r2 := mocks.NewIOllamaClient(t)
+	s, _ := gollamas.NewService(r1)
+	sr := gollamas.GenerateRoutes(s)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	r1.On("Chat", MockContext, mock.AnythingOfType("*api.ChatRequest"), mock.Anything).Run(func(args mock.Arguments) {
+		fn := args.Get(2).(api.ChatResponseFunc)
+		assert.NoError(t, fn(api.ChatResponse{Model: "some_model", Message: api.Message{Role: "bot", Content: "old"}}))
+		close(started)
+		<-release
+		assert.NoError(t, fn(api.ChatResponse{Model: "some_model", Message: api.Message{Role: "bot", Content: "router"}, Done: true}))
+	}).Once().Return(nil)
+	r2.On("Chat", MockContext, mock.AnythingOfType("*api.ChatRequest"), mock.Anything).Run(func(args mock.Arguments) {
+		fn := args.Get(2).(api.ChatResponseFunc)
+		assert.NoError(t, fn(api.ChatResponse{Model: "some_model", Message: api.Message{Role: "bot", Content: "new router"}, Done: true}))
+	}).Once().Return(nil)
+
+	w1 := CreateTestResponseRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hreq, _ := http.NewRequest("POST", "/api/chat", bytes.NewBuffer(jsonReq))
+		sr.ServeHTTP(w1, hreq)
+	}()
+	<-started
+
+	assert.NoError(t, s.SetClient(r2))
+	w2 := CreateTestResponseRecorder()
+	hreq, _ := http.NewRequest("POST", "/api/chat", bytes.NewBuffer(jsonReq))
+	sr.ServeHTTP(w2, hreq)
+	assert.Equal(t, 200, w2.Code)
+	assert.Equal(t, `{"model":"some_model","created_at":"0001-01-01T00:00:00Z","message":{"role":"bot","content":"new router"},"done":true}
+`, w2.Body.String())
+
+	close(release)
+	<-done
+	assert.Equal(t, 200, w1.Code)
+	assert.Equal(t, `{"model":"some_model","created_at":"0001-01-01T00:00:00Z","message":{"role":"bot","content":"old"},"done":false}
+{"model":"some_model","created_at":"0001-01-01T00:00:00Z","message":{"role":"bot","content":"router"},"done":true}
+`, w1.Body.String())
+
+	r1.AssertExpectations(t)
+	r2.AssertExpectations(t)
+}
+
 func TestServerHome(t *testing.T) {
 	r := mocks.NewIOllamaClient(t)
 	s, _ := gollamas.NewService(r)
@@ -45,6 +114,41 @@ func TestServerHome(t *testing.T) {
 	r.AssertExpectations(t)
 }
 
+func TestServerGETHealth(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": c1},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+	)
+	assert.NoError(t, err)
+	s, _ := gollamas.NewService(r)
+	sr := gollamas.GenerateRoutes(s)
+
+	w := CreateTestResponseRecorder()
+	req, _ := http.NewRequest("GET", "/gollamas/health", nil)
+	sr.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `{"connections":[{"connection_id":"c1","healthy":true,"consecutive_failures":0,"consecutive_successes":0,"in_flight":0,"circuit":"closed"}]}`, w.Body.String())
+
+	c1.AssertExpectations(t)
+}
+
+func TestServerGETHealthNotAvailable(t *testing.T) {
+	r := mocks.NewIOllamaClient(t)
+	s, _ := gollamas.NewService(r)
+	sr := gollamas.GenerateRoutes(s)
+
+	w := CreateTestResponseRecorder()
+	req, _ := http.NewRequest("GET", "/gollamas/health", nil)
+	sr.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, `{"error":"gollamas: health state is not available"}`, w.Body.String())
+
+	r.AssertExpectations(t)
+}
+
 func TestServerPOSTChatMissingRequest(t *testing.T) {
 	r := mocks.NewIOllamaClient(t)
 	s, _ := gollamas.NewService(r)
@@ -157,6 +261,381 @@ func TestServerPOSTChatStreamRequest(t *testing.T) {
 	r.AssertExpectations(t)
 }
 
+func TestServerModelHeader(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	_, cancel, r, err := newRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{
+			"c1": c1,
+			"c2": c2,
+		},
+		map[gollamas.ModelID]gollamas.ModelConfig{
+			"deepseek-r1:70b": {ConnectionID: "c1", Fallbacks: []gollamas.ModelID{"deepseek-r1:14b"}},
+			"deepseek-r1:14b": {ConnectionID: "c2"},
+			"llama3.2":        {ConnectionID: "c2"},
+		},
+		gollamas.WithAlias("all-minilm", "llama3.2"),
+	)
+	defer cancel()
+	assert.NoError(t, err)
+	s, _ := gollamas.NewService(r)
+	sr := gollamas.GenerateRoutes(s)
+
+	// the header names the fallback model which answered
+	c1.On("Chat", mock.Anything, mock.AnythingOfType("*api.ChatRequest"), mock.Anything).Twice().Return(errDial)
+	c2.On("Chat", mock.Anything, mock.AnythingOfType("*api.ChatRequest"), mock.Anything).Twice().Run(func(args mock.Arguments) {
+		fn := args.Get(2).(api.ChatResponseFunc)
+		assert.NoError(t, fn(api.ChatResponse{Model: "deepseek-r1:14b", Done: true}))
+	}).Return(nil)
+	c2.On("Embed", mock.Anything, mock.AnythingOfType("*api.EmbedRequest")).Once().Return(&api.EmbedResponse{Model: "llama3.2"}, nil)
+
+	for _, stream := range []string{"true", "false"} {
+		w := CreateTestResponseRecorder()
+		hreq, _ := http.NewRequest("POST", "/api/chat", bytes.NewBufferString(`{"model":"deepseek-r1:70b","stream":`+stream+`}`))
+		sr.ServeHTTP(w, hreq)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "deepseek-r1:14b", w.Header().Get(gollamas.ModelHeader))
+	}
+
+	// and the model of an alias
+	w := CreateTestResponseRecorder()
+	hreq, _ := http.NewRequest("POST", "/api/embed", bytes.NewBufferString(`{"model":"all-minilm","input":"why is the sky blue?"}`))
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "llama3.2", w.Header().Get(gollamas.ModelHeader))
+
+	c1.AssertExpectations(t)
+	c2.AssertExpectations(t)
+}
+
+func TestServerMetrics(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": c1},
+		map[gollamas.ModelID]gollamas.ModelConfig{"granite3.3:8b": {ConnectionID: "c1"}},
+		gollamas.WithAlias("granite", "granite3.3:8b"),
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "ci", Key: "secret1", Models: []gollamas.ModelID{"*"}}),
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "prometheus", Key: "secret2", Models: []gollamas.ModelID{"*"}, Admin: true}),
+	)
+	assert.NoError(t, err)
+	s, _ := gollamas.NewService(r)
+	sr := gollamas.GenerateRoutes(s)
+	c1.On("Chat", MockContext, mock.AnythingOfType("*api.ChatRequest"), mock.Anything).Once().Run(func(args mock.Arguments) {
+		fn := args.Get(2).(api.ChatResponseFunc)
+		assert.NoError(t, fn(api.ChatResponse{Model: "granite3.3:8b", Done: true, Metrics: api.Metrics{PromptEvalCount: 5, EvalCount: 40, EvalDuration: 2 * time.Second}}))
+	}).Return(nil)
+	c1.On("Embed", MockContext, mock.AnythingOfType("*api.EmbedRequest")).Once().Return(nil, api.StatusError{StatusCode: http.StatusBadGateway})
+
+	w := CreateTestResponseRecorder()
+	hreq, _ := http.NewRequest("POST", "/api/chat", bytes.NewBufferString(`{"model":"granite"}`))
+	hreq.Header.Set("Authorization", "Bearer secret1")
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 200, w.Code)
+
+	w = CreateTestResponseRecorder()
+	hreq, _ = http.NewRequest("POST", "/api/embed", bytes.NewBufferString(`{"model":"granite3.3:8b","input":"hi"}`))
+	hreq.Header.Set("Authorization", "Bearer secret1")
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 502, w.Code)
+
+	w = CreateTestResponseRecorder()
+	hreq, _ = http.NewRequest("GET", "/metrics", nil)
+	hreq.Header.Set("Authorization", "Bearer secret1")
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 403, w.Code)
+
+	w = CreateTestResponseRecorder()
+	hreq, _ = http.NewRequest("GET", "/metrics", nil)
+	hreq.Header.Set("Authorization", "Bearer secret2")
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 200, w.Code)
+	body := w.Body.String()
+	labels := `alias="granite",connection_id="c1",model="granite3.3:8b",requested_model="granite",route="/api/chat"`
+	assert.Contains(t, body, `gollamas_requests_total{`+labels+`,status="200"} 1`)
+	assert.Contains(t, body, `gollamas_request_duration_seconds_count{`+labels+`} 1`)
+	assert.Contains(t, body, `gollamas_time_to_first_token_seconds_count{`+labels+`} 1`)
+	assert.Contains(t, body, `gollamas_tokens_per_second_sum{`+labels+`} 20`)
+	assert.Contains(t, body, `gollamas_tokens_total{`+labels+`,type="eval"} 40`)
+	assert.Contains(t, body, `gollamas_tokens_total{`+labels+`,type="prompt"} 5`)
+	assert.Contains(t, body, `gollamas_requests_total{alias="",connection_id="c1",model="granite3.3:8b",requested_model="granite3.3:8b",route="/api/embed",status="502"} 1`)
+	assert.Contains(t, body, `gollamas_upstream_errors_total{connection_id="c1",model="granite3.3:8b",reason="502"} 1`)
+	assert.Contains(t, body, `gollamas_upstream_requests_total{connection_id="c1",model="granite3.3:8b"} 2`)
+	assert.Contains(t, body, `gollamas_connection_in_flight{connection_id="c1"} 0`)
+	assert.Contains(t, body, `gollamas_connection_circuit_state{connection_id="c1",state="closed"} 1`)
+	assert.Contains(t, body, `gollamas_requests_in_flight{route="/metrics"} 1`)
+	// the connections are not health checked
+	assert.NotContains(t, body, `gollamas_connection_up`)
+}
+
+func TestServerTracing(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+
+	c1 := mocks.NewIOllamaClient(t)
+	c2 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": c1, "c2": c2},
+		map[gollamas.ModelID]gollamas.ModelConfig{"granite3.3:8b": {ConnectionID: "c1"}, "llama3.2": {ConnectionID: "c2"}},
+		gollamas.WithAlias("granite", "granite3.3:8b"),
+	)
+	assert.NoError(t, err)
+	s, _ := gollamas.NewService(r)
+	sr := gollamas.GenerateRoutes(s)
+	var upstream trace.SpanContext
+	c1.On("Chat", MockContext, mock.AnythingOfType("*api.ChatRequest"), mock.Anything).Once().Run(func(args mock.Arguments) {
+		upstream = trace.SpanContextFromContext(args.Get(0).(context.Context))
+		fn := args.Get(2).(api.ChatResponseFunc)
+		assert.NoError(t, fn(api.ChatResponse{Model: "granite3.3:8b", Done: true, Metrics: api.Metrics{PromptEvalCount: 5, EvalCount: 40}}))
+	}).Return(nil)
+	c1.On("List", MockContext).Once().Return(&api.ListResponse{Models: []api.ListModelResponse{{Name: "granite3.3:8b", Model: "granite3.3:8b"}}}, nil)
+	c2.On("List", MockContext).Once().Return(nil, api.StatusError{StatusCode: http.StatusBadGateway})
+
+	w := CreateTestResponseRecorder()
+	hreq, _ := http.NewRequest("POST", "/api/chat", bytes.NewBufferString(`{"model":"granite","stream":false}`))
+	hreq.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 200, w.Code)
+
+	spans := exp.GetSpans().Snapshots()
+	if assert.Len(t, spans, 2) {
+		chat, server := spans[0], spans[1]
+		assert.Equal(t, "POST /api/chat", server.Name())
+		assert.Equal(t, trace.SpanKindServer, server.SpanKind())
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+		assert.Subset(t, server.Attributes(), []attribute.KeyValue{
+			attribute.String("http.route", "/api/chat"),
+			attribute.Int("http.response.status_code", 200),
+			attribute.Bool("gollamas.stream", false),
+			attribute.String("gollamas.requested_model", "granite"),
+			attribute.String("gollamas.alias", "granite"),
+			attribute.String("gollamas.model", "granite3.3:8b"),
+			attribute.String("gollamas.connection_id", "c1"),
+			attribute.Int("gollamas.tokens.prompt", 5),
+			attribute.Int("gollamas.tokens.eval", 40),
+		})
+
+		assert.Equal(t, "ollama chat", chat.Name())
+		assert.Equal(t, trace.SpanKindClient, chat.SpanKind())
+		assert.Equal(t, server.SpanContext().SpanID(), chat.Parent().SpanID())
+		assert.Equal(t, chat.SpanContext(), upstream)
+		assert.Subset(t, chat.Attributes(), []attribute.KeyValue{
+			attribute.String("gollamas.connection_id", "c1"),
+			attribute.String("gollamas.model", "granite3.3:8b"),
+			attribute.Int("gollamas.tokens.eval", 40),
+		})
+	}
+
+	exp.Reset()
+	w = CreateTestResponseRecorder()
+	hreq, _ = http.NewRequest("GET", "/api/tags", nil)
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 200, w.Code)
+
+	spans = exp.GetSpans().Snapshots()
+	if assert.Len(t, spans, 3) {
+		server := spans[2]
+		assert.Equal(t, "GET /api/tags", server.Name())
+		assert.False(t, server.Parent().IsValid())
+		failed := map[string]bool{}
+		for _, sp := range spans[:2] {
+			assert.Equal(t, "ollama list", sp.Name())
+			assert.Equal(t, server.SpanContext().SpanID(), sp.Parent().SpanID())
+			for _, a := range sp.Attributes() {
+				if a.Key == "gollamas.connection_id" {
+					failed[a.Value.AsString()] = sp.Status().Code == codes.Error
+				}
+			}
+		}
+		assert.Equal(t, map[string]bool{"c1": false, "c2": true}, failed)
+	}
+}
+
+func TestServerAccessLog(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": c1},
+		map[gollamas.ModelID]gollamas.ModelConfig{"granite3.3:8b": {ConnectionID: "c1"}},
+		gollamas.WithAlias("granite", "granite3.3:8b"),
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "ci", Key: "secret1", Models: []gollamas.ModelID{"*"}}),
+	)
+	assert.NoError(t, err)
+	s, _ := gollamas.NewService(r)
+	var out bytes.Buffer
+	s.SetAccessLogOutput(&out)
+	sr := gollamas.GenerateRoutes(s)
+	c1.On("Chat", MockContext, mock.AnythingOfType("*api.ChatRequest"), mock.Anything).Once().Run(func(args mock.Arguments) {
+		fn := args.Get(2).(api.ChatResponseFunc)
+		assert.NoError(t, fn(api.ChatResponse{Model: "granite3.3:8b", Message: api.Message{Content: "hi"}}))
+		assert.NoError(t, fn(api.ChatResponse{Model: "granite3.3:8b", Done: true, Metrics: api.Metrics{PromptEvalCount: 5, EvalCount: 40}}))
+	}).Return(nil)
+
+	w := CreateTestResponseRecorder()
+	hreq, _ := http.NewRequest("POST", "/api/chat", bytes.NewBufferString(`{"model":"granite"}`))
+	hreq.Header.Set("Authorization", "Bearer secret1")
+	hreq.Header.Set("X-Request-ID", "req-42")
+	hreq.RemoteAddr = "10.0.0.1:1234"
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "req-42", w.Header().Get("X-Request-ID"))
+
+	var entry map[string]any
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, "request", entry["msg"])
+	assert.Equal(t, "req-42", entry["request_id"])
+	assert.Equal(t, "10.0.0.1", entry["client"])
+	assert.Equal(t, "ci", entry["api_key"])
+	assert.Equal(t, "/api/chat", entry["route"])
+	assert.Equal(t, "granite", entry["requested_model"])
+	assert.Equal(t, "granite", entry["alias"])
+	assert.Equal(t, "granite3.3:8b", entry["model"])
+	assert.Equal(t, "c1", entry["connection_id"])
+	assert.Equal(t, float64(200), entry["status"])
+	assert.Equal(t, true, entry["stream"])
+	assert.Equal(t, float64(5), entry["prompt_tokens"])
+	assert.Equal(t, float64(40), entry["eval_tokens"])
+	assert.Contains(t, entry, "duration_ms")
+	assert.Contains(t, entry, "ttft_ms")
+
+	// an id is generated when the client does not send one
+	out.Reset()
+	w = CreateTestResponseRecorder()
+	hreq, _ = http.NewRequest("GET", "/api/tags", nil)
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 401, w.Code)
+	id := w.Header().Get("X-Request-ID")
+	assert.Len(t, id, 36)
+	entry = nil
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, id, entry["request_id"])
+	assert.Equal(t, float64(401), entry["status"])
+	assert.NotContains(t, entry, "model")
+}
+
+func TestServerProbes(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": c1},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "ci", Key: "secret1", Models: []gollamas.ModelID{"*"}}),
+		gollamas.WithReadiness(gollamas.ReadinessConfig{CacheTTL: gollamas.Duration(time.Hour)}),
+	)
+	assert.NoError(t, err)
+	s, _ := gollamas.NewService(r)
+	sr := gollamas.GenerateRoutes(s)
+	c1.On("Heartbeat", mock.Anything).Once().Return(errors.New("connection refused"))
+
+	// the probes are served without api key
+	w := CreateTestResponseRecorder()
+	hreq, _ := http.NewRequest("GET", "/healthz", nil)
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `{"status":"alive"}`, w.Body.String())
+
+	w = CreateTestResponseRecorder()
+	hreq, _ = http.NewRequest("GET", "/readyz", nil)
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 503, w.Code)
+	var res gollamas.ReadyResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.False(t, res.Ready)
+	assert.Equal(t, "0 of 1 connections reachable, 1 required", res.Reason)
+	if assert.Len(t, res.Connections, 1) {
+		assert.Equal(t, gollamas.ConnectionID("c1"), res.Connections[0].ConnectionID)
+		assert.Equal(t, "connection refused", res.Connections[0].Error)
+	}
+
+	s.Drain()
+	w = CreateTestResponseRecorder()
+	hreq, _ = http.NewRequest("GET", "/readyz", nil)
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, `{"ready":false,"reason":"shutting down"}`, w.Body.String())
+	w = CreateTestResponseRecorder()
+	hreq, _ = http.NewRequest("GET", "/healthz", nil)
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestServerAuthentication(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": c1},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}, "deepseek-r1:14b": {ConnectionID: "c1"}},
+		gollamas.WithAPIKey(gollamas.APIKeyConfig{Name: "ci", Key: "secret1", Models: []gollamas.ModelID{"llama3.2"}}),
+	)
+	assert.NoError(t, err)
+	s, _ := gollamas.NewService(r)
+	sr := gollamas.GenerateRoutes(s)
+	c1.On("List", mock.Anything).Return(&api.ListResponse{Models: []api.ListModelResponse{
+		{Name: "llama3.2", Model: "llama3.2"},
+		{Name: "deepseek-r1:14b", Model: "deepseek-r1:14b"},
+	}}, nil)
+
+	for _, tc := range []struct {
+		method, url, token, body string
+		code                     int
+		expected                 string
+	}{
+		{"GET", "/", "", "", 200, "Golamas is running"},
+		{"GET", "/api/tags", "", "", 401, `{"error":"gollamas: missing or invalid api key"}`},
+		{"GET", "/v1/models", "secret2", "", 401, `{"error":{"message":"gollamas: missing or invalid api key","type":"api_error","param":null,"code":null}}`},
+		{"GET", "/api/tags", "secret1", "", 200, `{"models":[{"name":"llama3.2","model":"llama3.2","modified_at":"0001-01-01T00:00:00Z","size":0,"digest":"","details":{"parent_model":"","format":"","family":"","families":null,"parameter_size":"","quantization_level":""}}]}`},
+		{"POST", "/api/embed", "secret1", `{"model":"deepseek-r1:14b","input":"hi"}`, 403, `{"error":"gollamas: api key ci is not allowed to use model deepseek-r1:14b"}`},
+		{"POST", "/v1/embeddings", "secret1", `{"model":"deepseek-r1:14b","input":"hi"}`, 403, `{"error":{"message":"gollamas: api key ci is not allowed to use model deepseek-r1:14b","type":"api_error","param":null,"code":null}}`},
+	} {
+		w := CreateTestResponseRecorder()
+		hreq, _ := http.NewRequest(tc.method, tc.url, bytes.NewBufferString(tc.body))
+		if tc.token != "" {
+			hreq.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		sr.ServeHTTP(w, hreq)
+		assert.Equal(t, tc.code, w.Code, tc.url)
+		assert.Equal(t, tc.expected, strings.TrimSpace(w.Body.String()), tc.url)
+	}
+}
+
+func TestServerRateLimits(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": c1},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+		gollamas.WithRateLimit(gollamas.RateLimitConfig{RequestsPerMinute: 1}),
+	)
+	assert.NoError(t, err)
+	s, _ := gollamas.NewService(r)
+	sr := gollamas.GenerateRoutes(s)
+	c1.On("Embed", MockContext, mock.AnythingOfType("*api.EmbedRequest")).Once().Return(&api.EmbedResponse{Model: "llama3.2"}, nil)
+
+	w := CreateTestResponseRecorder()
+	hreq, _ := http.NewRequest("POST", "/api/embed", bytes.NewBufferString(`{"model":"llama3.2","input":"hi"}`))
+	hreq.RemoteAddr = "10.0.0.1:1234"
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 200, w.Code)
+
+	w = CreateTestResponseRecorder()
+	hreq, _ = http.NewRequest("POST", "/api/embed", bytes.NewBufferString(`{"model":"llama3.2","input":"hi"}`))
+	hreq.RemoteAddr = "10.0.0.1:1234"
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Equal(t, `{"error":"gollamas: too many requests"}`, w.Body.String())
+
+	w = CreateTestResponseRecorder()
+	hreq, _ = http.NewRequest("GET", "/gollamas/limits", nil)
+	hreq.RemoteAddr = "10.0.0.1:1234"
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `[{"client":"ip:10.0.0.1","requests":0,"in_flight":0,"tokens_today":0,"tokens_this_month":0}]`, w.Body.String())
+}
+
 func TestServerPOSTCopyRequest(t *testing.T) {
 	jsonReq := []byte(`{"source": "llama3.2", "destination": "llama3-backup"}`)
 	r := mocks.NewIOllamaClient(t)
@@ -286,6 +765,120 @@ func TestServerPOSTEmbedRequest(t *testing.T) {
 	r.AssertExpectations(t)
 }
 
+func TestServerPOSTChatStreamErrors(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": c1},
+		map[gollamas.ModelID]gollamas.ModelConfig{"llama3.2": {ConnectionID: "c1"}},
+	)
+	assert.NoError(t, err)
+	s, _ := gollamas.NewService(r)
+	sr := gollamas.GenerateRoutes(s)
+	// the first two requests fail before any response, the last two in the middle of the stream
+	c1.On("Chat", MockContext, mock.AnythingOfType("*api.ChatRequest"), mock.Anything).Twice().
+		Return(api.StatusError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable", ErrorMessage: "server busy"})
+	c1.On("Chat", MockContext, mock.AnythingOfType("*api.ChatRequest"), mock.Anything).Twice().Run(func(args mock.Arguments) {
+		fn := args.Get(2).(api.ChatResponseFunc)
+		assert.NoError(t, fn(api.ChatResponse{Model: "llama3.2", Message: api.Message{Role: "assistant", Content: "because"}}))
+	}).Return(errors.New("model runner has unexpectedly stopped"))
+
+	for _, tc := range []struct {
+		name, body  string
+		code        int
+		contentType string
+		expected    string
+	}{
+		{"unknown model", `{"model":"unknown"}`, 404, "application/json; charset=utf-8", `{"error":"gollamas router is missing a valid route to model unknown"}`},
+		{"unknown model without stream", `{"model":"unknown","stream":false}`, 404, "application/json", `{"error":"gollamas router is missing a valid route to model unknown"}`},
+		{"upstream error", `{"model":"llama3.2"}`, 503, "application/json; charset=utf-8", `{"error":"server busy"}`},
+		{"upstream error without stream", `{"model":"llama3.2","stream":false}`, 503, "application/json", `{"error":"server busy"}`},
+		{"error in stream", `{"model":"llama3.2"}`, 200, "application/x-ndjson", `{"model":"llama3.2","created_at":"0001-01-01T00:00:00Z","message":{"role":"assistant","content":"because"},"done":false}
+{"error":"model runner has unexpectedly stopped"}
+`},
+		{"error before the final response", `{"model":"llama3.2","stream":false}`, 500, "application/json", `{"error":"model runner has unexpectedly stopped"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := CreateTestResponseRecorder()
+			hreq, _ := http.NewRequest("POST", "/api/chat", bytes.NewBufferString(tc.body))
+			sr.ServeHTTP(w, hreq)
+			assert.Equal(t, tc.code, w.Code)
+			assert.Equal(t, tc.contentType, w.Header().Get("Content-Type"))
+			assert.Equal(t, tc.expected, w.Body.String())
+		})
+	}
+}
+
+func TestServerCancelsUpstreamOnClientDisconnect(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	r, err := gollamas.NewRouter(
+		map[gollamas.ConnectionID]gollamas.IOllamaClient{"c1": c1},
+		map[gollamas.ModelID]gollamas.ModelConfig{"phi4:14b": {ConnectionID: "c1"}},
+	)
+	assert.NoError(t, err)
+	s, _ := gollamas.NewService(r)
+	var out bytes.Buffer
+	s.SetAccessLogOutput(&out)
+	sr := gollamas.GenerateRoutes(s)
+	baseline := runtime.NumGoroutine()
+
+	started := make(chan struct{})
+	upstreamErr := make(chan error, 1)
+	// the upstream generates until the router stops reading its responses, like the ollama client
+	c1.On("Chat", MockContext, mock.AnythingOfType("*api.ChatRequest"), mock.Anything).Once().Run(func(args mock.Arguments) {
+		ctx := args.Get(0).(context.Context)
+		fn := args.Get(2).(api.ChatResponseFunc)
+		close(started)
+		for {
+			if err := fn(api.ChatResponse{Model: "phi4:14b", Message: api.Message{Role: "assistant", Content: "and"}}); err != nil {
+				assert.Error(t, ctx.Err())
+				upstreamErr <- err
+				return
+			}
+		}
+	}).Return(context.Canceled)
+
+	w := CreateTestResponseRecorder()
+	hreq, _ := http.NewRequest("POST", "/api/chat", bytes.NewBufferString(`{"model":"phi4:14b"}`))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sr.ServeHTTP(w, hreq)
+	}()
+	<-started
+	w.closeClient()
+	<-done
+	assert.ErrorIs(t, <-upstreamErr, context.Canceled)
+	assert.Equal(t, 200, w.Code)
+
+	// without stream the client disconnects before the response
+	ctx, cancel := context.WithCancel(context.Background())
+	c1.On("Chat", MockContext, mock.AnythingOfType("*api.ChatRequest"), mock.Anything).Once().Run(func(args mock.Arguments) {
+		ctx := args.Get(0).(context.Context)
+		fn := args.Get(2).(api.ChatResponseFunc)
+		assert.NoError(t, fn(api.ChatResponse{Model: "phi4:14b", Message: api.Message{Role: "assistant", Content: "and"}}))
+		cancel()
+		<-ctx.Done()
+	}).Return(context.Canceled)
+	w = CreateTestResponseRecorder()
+	hreq, _ = http.NewRequestWithContext(ctx, "POST", "/api/chat", bytes.NewBufferString(`{"model":"phi4:14b","stream":false}`))
+	sr.ServeHTTP(w, hreq)
+	assert.Equal(t, 499, w.Code)
+
+	assertNoLeakedGoroutines(t, baseline)
+	dec := json.NewDecoder(&out)
+	for range 2 {
+		var entry map[string]any
+		assert.NoError(t, dec.Decode(&entry))
+		assert.Equal(t, true, entry["canceled"])
+	}
+
+	w = CreateTestResponseRecorder()
+	hreq, _ = http.NewRequest("GET", "/metrics", nil)
+	sr.ServeHTTP(w, hreq)
+	assert.Contains(t, w.Body.String(), `gollamas_requests_canceled_total{alias="",connection_id="c1",model="phi4:14b",requested_model="phi4:14b",route="/api/chat"} 2`)
+	assert.Contains(t, w.Body.String(), `gollamas_upstream_errors_total{connection_id="c1",model="phi4:14b",reason="canceled"} 2`)
+}
+
 func TestServerPOSTGenerateRequest(t *testing.T) {
 	jsonReq := []byte(`{
   "model": "llama3.2",
@@ -563,6 +1156,19 @@ func TestServerGETVersionRequest(t *testing.T) {
 
 // VersionHandler(c *gin.Context)
 
+// assertNoLeakedGoroutines waits for the goroutines started since the baseline to end,
+// without assert.Eventually which runs the condition in goroutines of its own.
+func assertNoLeakedGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > baseline; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Errorf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-baseline, buf[:runtime.Stack(buf, true)])
+			return
+		}
+	}
+}
+
 type TestResponseRecorder struct {
 	*httptest.ResponseRecorder
 	closeChannel chan bool
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultDrainTimeout = 20 * time.Second
+
+// ShutdownConfig drains the requests in flight when the router is stopped with SIGTERM or SIGINT.
+type ShutdownConfig struct {
+	// Delay keeps the router serving once it reports it is not ready, while the load balancers stop sending it requests.
+	// Disabled by default.
+	Delay Duration `json:"delay,omitempty" yaml:"delay,omitempty" toml:"delay,omitempty"`
+	// DrainTimeout bounds the wait for the requests in flight once the router stops accepting requests, defaults to 20s.
+	// The requests still in flight are canceled after it.
+	DrainTimeout Duration `json:"drain_timeout,omitempty" yaml:"drain_timeout,omitempty" toml:"drain_timeout,omitempty"`
+}
+
+func (sc ShutdownConfig) validate() error {
+	if sc.Delay < 0 {
+		return fmt.Errorf("invalid shutdown delay: %s", sc.Delay)
+	}
+	if sc.DrainTimeout < 0 {
+		return fmt.Errorf("invalid drain timeout: %s", sc.DrainTimeout)
+	}
+	return nil
+}
+
+func (sc ShutdownConfig) withDefaults() ShutdownConfig {
+	if sc.DrainTimeout == 0 {
+		sc.DrainTimeout = Duration(defaultDrainTimeout)
+	}
+	return sc
+}
+
+// Drain marks the service as shutting down, it reports that it is not ready from then on.
+func (s *Service) Drain() {
+	s.draining.Store(true)
+}
+
+// InFlight returns the number of requests being served.
+func (s *Service) InFlight() int64 {
+	return s.inFlight.Load()
+}
+
+// serve serves the requests accepted on l, over TLS when the server has a TLS configuration, until ctx is done,
+// then shuts the server down gracefully:
+// the router reports it is not ready, stops accepting requests after the shutdown delay and waits for the requests in flight,
+// the requests still in flight after the drain timeout are canceled.
+// The auxiliary servers, ie: the metrics, are served until the router is stopped and then closed.
+func serve(ctx context.Context, s *Service, srv *http.Server, l net.Listener, cfg ShutdownConfig, aux ...*http.Server) error {
+	cfg = cfg.withDefaults()
+	defer func() {
+		for _, a := range aux {
+			if err := a.Close(); err != nil {
+				log.WithError(err).Warn("Could not close the server.")
+			}
+		}
+	}()
+	// the requests are canceled through their base context once the drain timeout expires
+	base, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv.BaseContext = func(net.Listener) context.Context { return base }
+	served := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// the certificates are set by the TLS configuration, which also enables HTTP/2
+			served <- srv.ServeTLS(l, "", "")
+			return
+		}
+		served <- srv.Serve(l)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.Drain()
+	log.WithField("in_flight", s.InFlight()).Warn("Shutting down, the router reports it is not ready.")
+	if cfg.Delay > 0 {
+		log.WithField("delay", cfg.Delay).Info("Serving until the shutdown delay expires.")
+		time.Sleep(time.Duration(cfg.Delay))
+	}
+	log.WithField("in_flight", s.InFlight()).WithField("drain_timeout", cfg.DrainTimeout).Info("Stopped accepting requests, draining the requests in flight.")
+	drainCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.DrainTimeout))
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() {
+		drained <- srv.Shutdown(drainCtx)
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-drained:
+			if err == nil {
+				log.Info("All the requests ended, the router is stopped.")
+				return nil
+			}
+			log.WithField("in_flight", s.InFlight()).Warn("The drain timeout expired, canceling the requests in flight.")
+			cancelRequests()
+			return srv.Close()
+		case <-ticker.C:
+			log.WithField("in_flight", s.InFlight()).Info("Waiting for the requests in flight.")
+		}
+	}
+}
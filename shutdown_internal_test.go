@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/slawo/gollamas/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// startServe serves the routes of a service whose chat requests stream until release is closed.
+func startServe(t *testing.T, cfg ShutdownConfig, release <-chan struct{}) (*Service, string, context.CancelFunc, <-chan error, <-chan error) {
+	cl := mocks.NewIOllamaClient(t)
+	upstream := make(chan error, 1)
+	cl.On("Chat", mock.Anything, mock.AnythingOfType("*api.ChatRequest"), mock.Anything).Once().Run(func(args mock.Arguments) {
+		ctx := args.Get(0).(context.Context)
+		fn := args.Get(2).(api.ChatResponseFunc)
+		assert.NoError(t, fn(api.ChatResponse{Model: "llama3.2", Message: api.Message{Content: "why"}}))
+		select {
+		case <-release:
+			assert.NoError(t, fn(api.ChatResponse{Model: "llama3.2", Done: true}))
+			upstream <- nil
+		case <-ctx.Done():
+			upstream <- ctx.Err()
+		}
+	}).Return(nil)
+	s, err := NewService(cl)
+	assert.NoError(t, err)
+	s.SetAccessLogOutput(nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, s, &http.Server{Handler: GenerateRoutes(s)}, l, cfg)
+	}()
+	return s, "http://" + l.Addr().String(), stop, served, upstream
+}
+
+// startStream sends a chat request and waits for its first response.
+func startStream(t *testing.T, url string) (*http.Response, *bufio.Reader) {
+	res, err := http.Post(url+"/api/chat", "application/json", strings.NewReader(`{"model":"llama3.2"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	body := bufio.NewReader(res.Body)
+	line, err := body.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Contains(t, line, `"content":"why"`)
+	return res, body
+}
+
+func TestServeDrainsRequestsInFlight(t *testing.T) {
+	release := make(chan struct{})
+	s, url, stop, served, upstream := startServe(t, ShutdownConfig{Delay: Duration(200 * time.Millisecond), DrainTimeout: Duration(5 * time.Second)}, release)
+	res, body := startStream(t, url)
+	defer res.Body.Close()
+
+	res, err := http.Get(url + "/readyz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+
+	stop()
+	assert.Eventually(t, s.draining.Load, time.Second, time.Millisecond)
+	// the router keeps serving during the shutdown delay, reporting it is not ready
+	res, err = http.Get(url + "/readyz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	res.Body.Close()
+	assert.Equal(t, int64(1), s.InFlight())
+
+	close(release)
+	line, err := body.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Contains(t, line, `"done":true`)
+	assert.NoError(t, <-upstream)
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not stop once the requests ended")
+	}
+	_, err = http.Get(url + "/readyz")
+	assert.Error(t, err)
+}
+
+func TestServeCancelsRequestsAfterDrainTimeout(t *testing.T) {
+	_, url, stop, served, upstream := startServe(t, ShutdownConfig{DrainTimeout: Duration(100 * time.Millisecond)}, nil)
+	res, _ := startStream(t, url)
+	defer res.Body.Close()
+
+	start := time.Now()
+	stop()
+	assert.ErrorIs(t, <-upstream, context.Canceled)
+	assert.NoError(t, <-served)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestServeReturnsListenerErrors(t *testing.T) {
+	s, err := NewService(mocks.NewIOllamaClient(t))
+	assert.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	l.Close()
+	assert.Error(t, serve(context.Background(), s, &http.Server{}, l, ShutdownConfig{}))
+}
+
+func TestServeClosesAuxiliaryServers(t *testing.T) {
+	s, err := NewService(mocks.NewIOllamaClient(t))
+	assert.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ml, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	metrics := &http.Server{Handler: http.NotFoundHandler()}
+	metricsServed := make(chan error, 1)
+	go func() {
+		metricsServed <- metrics.Serve(ml)
+	}()
+
+	ctx, stop := context.WithCancel(context.Background())
+	stop()
+	assert.NoError(t, serve(ctx, s, &http.Server{Handler: GenerateRoutes(s)}, l, ShutdownConfig{}, metrics))
+	select {
+	case err := <-metricsServed:
+		assert.ErrorIs(t, err, http.ErrServerClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the metrics server was not closed with the router")
+	}
+}
+
+func TestShutdownConfigValidate(t *testing.T) {
+	assert.NoError(t, ShutdownConfig{}.validate())
+	assert.EqualError(t, ShutdownConfig{Delay: Duration(-time.Second)}.validate(), "invalid shutdown delay: -1s")
+	assert.EqualError(t, ShutdownConfig{DrainTimeout: Duration(-time.Second)}.validate(), "invalid drain timeout: -1s")
+	assert.Equal(t, Duration(defaultDrainTimeout), ShutdownConfig{}.withDefaults().DrainTimeout)
+}
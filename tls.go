@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// TLSConfig terminates TLS on the listener, the certificates are loaded again when their files change.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM encoded certificate chain and private key of the router.
+	CertFile string `json:"cert_file,omitempty" yaml:"cert_file,omitempty" toml:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty" yaml:"key_file,omitempty" toml:"key_file,omitempty"`
+	// ClientCAFile enables mutual TLS, the clients must present a certificate signed by one of its CAs,
+	// except on the routes left open for the probes.
+	ClientCAFile string `json:"client_ca_file,omitempty" yaml:"client_ca_file,omitempty" toml:"client_ca_file,omitempty"`
+}
+
+func (tc TLSConfig) enabled() bool {
+	return tc.CertFile != ""
+}
+
+func (tc TLSConfig) validate() error {
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return errors.New("invalid tls configuration: both the certificate and the key are required")
+	}
+	if tc.ClientCAFile != "" && tc.CertFile == "" {
+		return errors.New("invalid tls configuration: the client ca requires a certificate and a key")
+	}
+	return nil
+}
+
+// certReloader holds the certificates of the listener, they are loaded again when their files change
+// so that the renewed certificates are served without a restart.
+type certReloader struct {
+	cfg    TLSConfig
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+func newCertReloader(cfg TLSConfig) (*certReloader, error) {
+	cr := &certReloader{cfg: cfg}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload loads the certificates, the current ones are kept on failure.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.cfg.CertFile, cr.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("could not load tls certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+		Certificates: []tls.Certificate{cert},
+	}
+	if cr.cfg.ClientCAFile != "" {
+		data, err := os.ReadFile(cr.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("could not read tls client ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in tls client ca %s", cr.cfg.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		// the probes do not present a certificate, it is required by the service on the other routes
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.config = config
+	return nil
+}
+
+// TLSConfig returns the configuration of the listener, each handshake uses the certificates loaded last.
+func (cr *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cr.mu.RLock()
+			defer cr.mu.RUnlock()
+			return cr.config, nil
+		},
+	}
+}
+
+// watch reloads the certificates when their files change, until ctx is done.
+func (cr *certReloader) watch(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// the directories are watched as the files are often replaced, kubernetes swaps a symlink to the secret's directory
+	dirs := map[string]bool{}
+	for _, f := range []string{cr.cfg.CertFile, cr.cfg.KeyFile, cr.cfg.ClientCAFile} {
+		if f == "" || dirs[filepath.Dir(f)] {
+			continue
+		}
+		dirs[filepath.Dir(f)] = true
+		if err := w.Add(filepath.Dir(f)); err != nil {
+			_ = w.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer w.Close()
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-w.Events:
+				if e.Op == fsnotify.Chmod {
+					continue
+				}
+				log.WithField("path", e.Name).WithField("op", e.Op.String()).Debug("TLS certificates changed.")
+				debounce = time.After(reloadDebounce)
+			case err := <-w.Errors:
+				log.WithError(err).Error("Failed to watch the tls certificates.")
+			case <-debounce:
+				debounce = nil
+				if err := cr.reload(); err != nil {
+					log.WithError(err).Error("Failed to reload the tls certificates, keeping the current certificates.")
+					continue
+				}
+				log.Info("TLS certificates reloaded.")
+			}
+		}
+	}()
+	return nil
+}
+
+type clientCertCtxKey struct{}
+
+// WithClientCertificate returns a context carrying the identity of the certificate verified for the client.
+func WithClientCertificate(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, clientCertCtxKey{}, principal)
+}
+
+// principalFromContext returns the identity of the client certificate, empty without mutual TLS.
+func principalFromContext(ctx context.Context) string {
+	p, _ := ctx.Value(clientCertCtxKey{}).(string)
+	return p
+}
+
+// certPrincipal returns the identity of a client certificate: its common name,
+// or its first DNS, URI or email subject alternative name.
+func certPrincipal(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// tlsPrincipal returns the identity of the client certificate verified during the handshake, if any.
+func tlsPrincipal(cs *tls.ConnectionState) string {
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return certPrincipal(cs.VerifiedChains[0][0])
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slawo/gollamas/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate from the template, signed by parent or self signed when parent is nil.
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func newTestCA(t *testing.T, cn string) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newTestServerCert(t *testing.T, cn string, ca *testCert) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+}
+
+func newTestClientCert(t *testing.T, cn string, ca *testCert) tls.Certificate {
+	c := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// syncBuffer is written by the access log of the server while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startServeTLS serves the routes of a service over TLS with the certificates of cfg.
+func startServeTLS(t *testing.T, cfg TLSConfig, access *syncBuffer) string {
+	s, err := NewService(mocks.NewIOllamaClient(t))
+	assert.NoError(t, err)
+	s.SetAccessLogOutput(access)
+	s.SetRequireClientCertificate(cfg.ClientCAFile != "")
+	cr, err := newCertReloader(cfg)
+	assert.NoError(t, err)
+	ctx, stop := context.WithCancel(context.Background())
+	assert.NoError(t, cr.watch(ctx))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, s, &http.Server{Handler: GenerateRoutes(s), TLSConfig: cr.TLSConfig()}, l, ShutdownConfig{})
+	}()
+	t.Cleanup(func() {
+		stop()
+		assert.NoError(t, <-served)
+	})
+	return "https://" + l.Addr().String()
+}
+
+func newTLSClient(roots *x509.CertPool, certs []tls.Certificate, http2 bool) *http.Client {
+	tr := &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+		ForceAttemptHTTP2: http2,
+	}
+	return &http.Client{Transport: tr}
+}
+
+func TestServeTLS(t *testing.T) {
+	saveDebounce := reloadDebounce
+	reloadDebounce = 10 * time.Millisecond
+	t.Cleanup(func() { reloadDebounce = saveDebounce })
+
+	ca := newTestCA(t, "gollamas ca")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dir := t.TempDir()
+	cfg := TLSConfig{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	srvCert := newTestServerCert(t, "gollamas", ca)
+	writeTestFile(t, cfg.CertFile, srvCert.certPEM)
+	writeTestFile(t, cfg.KeyFile, srvCert.keyPEM)
+	var access syncBuffer
+	url := startServeTLS(t, cfg, &access)
+
+	for proto, http2 := range map[int]bool{1: false, 2: true} {
+		res, err := newTLSClient(roots, nil, http2).Get(url + "/healthz")
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, proto, res.ProtoMajor)
+			assert.Equal(t, "gollamas", res.TLS.PeerCertificates[0].Subject.CommonName)
+			res.Body.Close()
+		}
+	}
+
+	// the renewed certificate is served once its files change
+	renewed := newTestServerCert(t, "gollamas renewed", ca)
+	writeTestFile(t, cfg.CertFile, renewed.certPEM)
+	writeTestFile(t, cfg.KeyFile, renewed.keyPEM)
+	assert.Eventually(t, func() bool {
+		res, err := newTLSClient(roots, nil, false).Get(url + "/healthz")
+		if err != nil {
+			return false
+		}
+		defer res.Body.Close()
+		return res.TLS.PeerCertificates[0].Subject.CommonName == "gollamas renewed"
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// a broken certificate is not loaded, the current one keeps being served
+	writeTestFile(t, cfg.CertFile, []byte("broken"))
+	time.Sleep(100 * time.Millisecond)
+	res, err := newTLSClient(roots, nil, false).Get(url + "/healthz")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "gollamas renewed", res.TLS.PeerCertificates[0].Subject.CommonName)
+		res.Body.Close()
+	}
+}
+
+func TestServeMutualTLS(t *testing.T) {
+	ca := newTestCA(t, "gollamas ca")
+	clientCA := newTestCA(t, "clients ca")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dir := t.TempDir()
+	cfg := TLSConfig{
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	srvCert := newTestServerCert(t, "gollamas", ca)
+	writeTestFile(t, cfg.CertFile, srvCert.certPEM)
+	writeTestFile(t, cfg.KeyFile, srvCert.keyPEM)
+	writeTestFile(t, cfg.ClientCAFile, clientCA.certPEM)
+	var access syncBuffer
+	url := startServeTLS(t, cfg, &access)
+
+	// the clients presenting a certificate which is not signed by the client ca are rejected during the handshake
+	other := newTestClientCert(t, "ci", ca)
+	cl := newTLSClient(roots, nil, true)
+	cl.Transport.(*http.Transport).TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &other, nil
+	}
+	_, err := cl.Get(url + "/healthz")
+	assert.Error(t, err)
+	assert.Empty(t, access.Bytes())
+
+	res, err := newTLSClient(roots, []tls.Certificate{newTestClientCert(t, "ci", clientCA)}, true).Get(url + "/healthz")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, 2, res.ProtoMajor)
+		res.Body.Close()
+	}
+	// the identity of the certificate is logged as the principal of the request
+	var entry map[string]any
+	assert.NoError(t, json.Unmarshal(access.Bytes(), &entry))
+	assert.Equal(t, "ci", entry["principal"])
+
+	// the probes reach the open routes without a certificate, the other routes require one
+	for path, status := range map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusOK, "/gollamas/limits": http.StatusUnauthorized, "/v1/models": http.StatusUnauthorized} {
+		res, err := newTLSClient(roots, nil, true).Get(url + path)
+		if assert.NoError(t, err) {
+			assert.Equal(t, status, res.StatusCode, path)
+			res.Body.Close()
+		}
+	}
+	res, err = newTLSClient(roots, []tls.Certificate{newTestClientCert(t, "ci", clientCA)}, true).Get(url + "/gollamas/limits")
+	if assert.NoError(t, err) {
+		// past the authentication, the mocked client reports no limits
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+		res.Body.Close()
+	}
+}
+
+func TestCertPrincipal(t *testing.T) {
+	ca := newTestCA(t, "clients ca")
+	assert.Equal(t, "ci", certPrincipal(newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "ci"}, DNSNames: []string{"ci.local"}}, ca).cert))
+	assert.Equal(t, "ci.local", certPrincipal(newTestCert(t, &x509.Certificate{DNSNames: []string{"ci.local"}}, ca).cert))
+	assert.Equal(t, "ci@example.com", certPrincipal(newTestCert(t, &x509.Certificate{EmailAddresses: []string{"ci@example.com"}}, ca).cert))
+	assert.Equal(t, "", tlsPrincipal(nil))
+	assert.Equal(t, "", tlsPrincipal(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{ca.cert}}))
+	assert.Equal(t, "clients ca", tlsPrincipal(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{ca.cert}}}))
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	assert.NoError(t, TLSConfig{}.validate())
+	assert.NoError(t, TLSConfig{CertFile: "tls.crt", KeyFile: "tls.key", ClientCAFile: "ca.crt"}.validate())
+	assert.EqualError(t, TLSConfig{CertFile: "tls.crt"}.validate(), "invalid tls configuration: both the certificate and the key are required")
+	assert.EqualError(t, TLSConfig{ClientCAFile: "ca.crt"}.validate(), "invalid tls configuration: the client ca requires a certificate and a key")
+	_, err := newCertReloader(TLSConfig{CertFile: filepath.Join(t.TempDir(), "tls.crt"), KeyFile: "tls.key"})
+	assert.ErrorContains(t, err, "could not load tls certificate")
+}
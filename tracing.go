@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ollama/ollama/api"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/slawo/gollamas"
+
+// TracingConfig exports the traces of the requests to an OpenTelemetry collector.
+// The traces are not exported when OTLPEndpoint is empty, the trace context of the requests is propagated nonetheless.
+type TracingConfig struct {
+	// OTLPEndpoint is the url of the OTLP/HTTP endpoint of the collector, ie: http://collector:4318.
+	// The headers of the exporter can be set with OTEL_EXPORTER_OTLP_HEADERS.
+	OTLPEndpoint string `json:"otlp_endpoint,omitempty" yaml:"otlp_endpoint,omitempty" toml:"otlp_endpoint,omitempty"`
+	// SampleRatio is the share of the traces started by gollamas which are sampled, defaults to 1.
+	// The traces started by the clients follow their sampling decision.
+	SampleRatio float64 `json:"sample_ratio,omitempty" yaml:"sample_ratio,omitempty" toml:"sample_ratio,omitempty"`
+}
+
+func (tc TracingConfig) validate() error {
+	if tc.OTLPEndpoint != "" {
+		if u, err := url.Parse(tc.OTLPEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid otlp endpoint: %s", tc.OTLPEndpoint)
+		}
+	}
+	if tc.SampleRatio < 0 || tc.SampleRatio > 1 {
+		return fmt.Errorf("invalid trace sample ratio: %v, expected a value between 0 and 1", tc.SampleRatio)
+	}
+	return nil
+}
+
+// initTracing installs the propagation of the trace context and, when an endpoint is set, the export of the traces.
+// shutdown flushes the traces which are not exported yet.
+func initTracing(ctx context.Context, cfg TracingConfig) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.OTLPEndpoint))
+	if err != nil {
+		return nil, fmt.Errorf("could not create the otlp exporter: %w", err)
+	}
+	ratio := 1.0
+	if cfg.SampleRatio > 0 {
+		ratio = cfg.SampleRatio
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("gollamas"),
+			semconv.ServiceVersion(Version),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	log.WithField("otlp_endpoint", cfg.OTLPEndpoint).Info("Exporting traces.")
+	return tp.Shutdown, nil
+}
+
+// tracer is looked up on each use so that it follows the tracer provider installed last.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// TracingMiddleware starts a span for each request, as a child of the trace context sent by the client.
+// The span is given the models, connection and tokens the router reports once the request is served.
+func (s *Service) TracingMiddleware(c *gin.Context) {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	route := c.FullPath()
+	name := c.Request.Method
+	if route != "" {
+		name += " " + route
+	}
+	ctx, span := tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(c.Request.Method),
+			semconv.HTTPRoute(route),
+		),
+	)
+	defer span.End()
+	if id := requestIDFromContext(ctx); id != "" {
+		span.SetAttributes(attribute.String("gollamas.request_id", id))
+	}
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	if ri := requestInfoFromContext(c.Request.Context()); ri != nil {
+		info := ri.snapshot()
+		attrs := []attribute.KeyValue{attribute.Bool("gollamas.stream", info.stream)}
+		if info.requestedModel != "" {
+			attrs = append(attrs, attribute.String("gollamas.requested_model", info.requestedModel))
+		}
+		if info.alias != "" {
+			attrs = append(attrs, attribute.String("gollamas.alias", info.alias.String()))
+		}
+		if info.model != "" {
+			attrs = append(attrs,
+				attribute.String("gollamas.model", info.model.String()),
+				attribute.String("gollamas.connection_id", info.connection.String()),
+				attribute.Int("gollamas.tokens.prompt", info.promptTokens),
+				attribute.Int("gollamas.tokens.eval", info.evalTokens),
+			)
+		}
+		span.SetAttributes(attrs...)
+	}
+}
+
+// startUpstreamSpan starts the span of a call to a connection as a child of the span of the context,
+// the calls made by the router on its own, ie: the health checks, are not traced.
+func startUpstreamSpan(ctx context.Context, name string, cid ConnectionID, model string) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	attrs := []attribute.KeyValue{attribute.String("gollamas.connection_id", cid.String())}
+	if model != "" {
+		attrs = append(attrs, attribute.String("gollamas.model", model))
+	}
+	return tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func setSpanTokens(span trace.Span, m api.Metrics) {
+	span.SetAttributes(
+		attribute.Int("gollamas.tokens.prompt", m.PromptEvalCount),
+		attribute.Int("gollamas.tokens.eval", m.EvalCount),
+	)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// upstreamTransport sends the static headers of the connection, the trace context and the id of the requests on to the connections.
+type upstreamTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	carrier := propagation.HeaderCarrier(t.headers.Clone())
+	if carrier == nil {
+		carrier = propagation.HeaderCarrier{}
+	}
+	otel.GetTextMapPropagator().Inject(req.Context(), carrier)
+	if id := requestIDFromContext(req.Context()); id != "" {
+		carrier.Set(RequestIDHeader, id)
+	}
+	if len(carrier) > 0 {
+		// the request must not be modified by the transport
+		req = req.Clone(req.Context())
+		for k, v := range carrier {
+			req.Header[k] = v
+		}
+	}
+	return t.base.RoundTrip(req)
+}
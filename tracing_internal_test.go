@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInitClientsPropagatesTraceContextAndRequestID(t *testing.T) {
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+	shutdown, err := initTracing(context.Background(), TracingConfig{})
+	assert.NoError(t, err)
+	defer shutdown(context.Background())
+	exp := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+
+	headers := make(chan http.Header, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"version":"0.6.8"}`))
+	}))
+	defer srv.Close()
+	cmap, err := initClients(map[ConnectionID]ConnectionConfig{"c1": {Url: srv.URL}})
+	assert.NoError(t, err)
+	c := newConnection("c1", cmap["c1"], 1)
+
+	ctx, span := tracer().Start(context.Background(), "test")
+	v, err := c.Version(ctx)
+	span.End()
+	assert.NoError(t, err)
+	assert.Equal(t, "0.6.8", v)
+	spans := exp.GetSpans().Snapshots()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, "ollama version", spans[0].Name())
+		sc := spans[0].SpanContext()
+		assert.Equal(t, "00-"+sc.TraceID().String()+"-"+sc.SpanID().String()+"-01", (<-headers).Get("traceparent"))
+	}
+
+	// the calls made without a trace do not start one
+	_, err = c.Version(WithRequestID(context.Background(), "req-1"))
+	assert.NoError(t, err)
+	h := <-headers
+	assert.Empty(t, h.Get("traceparent"))
+	assert.Equal(t, "req-1", h.Get(RequestIDHeader))
+	assert.Len(t, exp.GetSpans(), 2)
+}
+
+func TestTracingConfigValidate(t *testing.T) {
+	assert.NoError(t, TracingConfig{}.validate())
+	assert.NoError(t, TracingConfig{OTLPEndpoint: "http://localhost:4318", SampleRatio: 0.5}.validate())
+	assert.EqualError(t, TracingConfig{OTLPEndpoint: "localhost"}.validate(), "invalid otlp endpoint: localhost")
+	assert.EqualError(t, TracingConfig{SampleRatio: 2}.validate(), "invalid trace sample ratio: 2, expected a value between 0 and 1")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// the defaults of the http clients of the connections are the ones of http.DefaultTransport,
+// except for the idle connections kept to each connection, which are not limited to 2.
+const (
+	defaultConnectTimeout      = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultMaxIdleConns        = 100
+)
+
+// validateClient checks the settings of the http client of the connection, the files are read when the client is created.
+func (cc ConnectionConfig) validateClient() error {
+	if cc.ConnectTimeout < 0 {
+		return fmt.Errorf("invalid connect timeout: %s", cc.ConnectTimeout)
+	}
+	if cc.ResponseHeaderTimeout < 0 {
+		return fmt.Errorf("invalid response header timeout: %s", cc.ResponseHeaderTimeout)
+	}
+	if cc.IdleConnTimeout < 0 {
+		return fmt.Errorf("invalid idle connection timeout: %s", cc.IdleConnTimeout)
+	}
+	if cc.MaxIdleConns < 0 {
+		return fmt.Errorf("invalid max idle connections: %d", cc.MaxIdleConns)
+	}
+	if (cc.CertFile == "") != (cc.KeyFile == "") {
+		return errors.New("invalid client certificate: both the certificate and the key are required")
+	}
+	if cc.ProxyURL != "" {
+		u, err := url.Parse(cc.ProxyURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy url: %s", cc.ProxyURL)
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("invalid proxy url scheme: %s", cc.ProxyURL)
+		}
+	}
+	for k, v := range cc.Headers {
+		if !httpguts.ValidHeaderFieldName(k) || !httpguts.ValidHeaderFieldValue(v) {
+			return fmt.Errorf("invalid header: %s", k)
+		}
+	}
+	return nil
+}
+
+// newHTTPClient returns the http client of a connection, with its own transport so that the connections do not share
+// their timeouts, certificates or idle connections.
+func newHTTPClient(cc ConnectionConfig) (*http.Client, error) {
+	if err := cc.validateClient(); err != nil {
+		return nil, err
+	}
+	connectTimeout := time.Duration(cc.ConnectTimeout)
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	tlsHandshakeTimeout := time.Duration(cc.ConnectTimeout)
+	if tlsHandshakeTimeout == 0 {
+		tlsHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	idleConnTimeout := time.Duration(cc.IdleConnTimeout)
+	if idleConnTimeout == 0 {
+		idleConnTimeout = defaultIdleConnTimeout
+	}
+	maxIdleConns := cc.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+	proxy := http.ProxyFromEnvironment
+	if cc.ProxyURL != "" {
+		u, _ := url.Parse(cc.ProxyURL)
+		proxy = http.ProxyURL(u)
+	}
+	tlsConfig, err := cc.clientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tr := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: time.Duration(cc.ResponseHeaderTimeout),
+		IdleConnTimeout:       idleConnTimeout,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConns,
+		ExpectContinueTimeout: time.Second,
+	}
+	headers := http.Header{}
+	for k, v := range cc.Headers {
+		headers.Set(k, v)
+	}
+	// no client timeout, it would end the streamed responses
+	return &http.Client{Transport: &upstreamTransport{base: tr, headers: headers}}, nil
+}
+
+// clientTLSConfig returns the TLS configuration used to reach the connection, nil for the defaults.
+func (cc ConnectionConfig) clientTLSConfig() (*tls.Config, error) {
+	if cc.CAFile == "" && cc.CertFile == "" && !cc.InsecureSkipVerify {
+		return nil, nil
+	}
+	c := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cc.InsecureSkipVerify,
+	}
+	if cc.CAFile != "" {
+		data, err := os.ReadFile(cc.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca file: %w", err)
+		}
+		// the CAs of the file are trusted in addition to the ones of the system
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in ca file %s", cc.CAFile)
+		}
+		c.RootCAs = pool
+	}
+	if cc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cc.CertFile, cc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// versionHandler answers the version requests of the ollama client and sends the requests it receives on.
+func versionHandler(requests chan<- *http.Request) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"version":"0.6.8"}`))
+	})
+}
+
+func newTestConnection(t *testing.T, cc ConnectionConfig) *connection {
+	cmap, err := initClients(map[ConnectionID]ConnectionConfig{"c1": cc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newConnection("c1", cmap["c1"], 1)
+}
+
+func TestInitClientsWithTLSAndHeaders(t *testing.T) {
+	ca := newTestCA(t, "ollama ca")
+	clientCA := newTestCA(t, "gollamas ca")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+	srvCert := newTestServerCert(t, "ollama", ca)
+	requests := make(chan *http.Request, 1)
+	srv := httptest.NewUnstartedServer(versionHandler(requests))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{srvCert.cert.Raw}, PrivateKey: srvCert.key}},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	clientCert := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "gollamas"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, clientCA)
+	cc := ConnectionConfig{
+		Url:      srv.URL,
+		CAFile:   filepath.Join(dir, "ca.crt"),
+		CertFile: filepath.Join(dir, "tls.crt"),
+		KeyFile:  filepath.Join(dir, "tls.key"),
+		Headers:  map[string]string{"Authorization": "Bearer secret1", "x-tenant": "ci"},
+	}
+	writeTestFile(t, cc.CAFile, ca.certPEM)
+	writeTestFile(t, cc.CertFile, clientCert.certPEM)
+	writeTestFile(t, cc.KeyFile, clientCert.keyPEM)
+
+	v, err := newTestConnection(t, cc).Version(WithRequestID(context.Background(), "req-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "0.6.8", v)
+	r := <-requests
+	assert.Equal(t, "gollamas", r.TLS.PeerCertificates[0].Subject.CommonName)
+	assert.Equal(t, "Bearer secret1", r.Header.Get("Authorization"))
+	assert.Equal(t, "ci", r.Header.Get("X-Tenant"))
+	assert.Equal(t, "req-1", r.Header.Get(RequestIDHeader))
+
+	// the connections without the client certificate or the ca are refused
+	_, err = newTestConnection(t, ConnectionConfig{Url: srv.URL, CAFile: cc.CAFile}).Version(context.Background())
+	assert.Error(t, err)
+	_, err = newTestConnection(t, ConnectionConfig{Url: srv.URL, CertFile: cc.CertFile, KeyFile: cc.KeyFile}).Version(context.Background())
+	assert.ErrorContains(t, err, "certificate signed by unknown authority")
+	_, err = newTestConnection(t, ConnectionConfig{Url: srv.URL, CertFile: cc.CertFile, KeyFile: cc.KeyFile, InsecureSkipVerify: true}).Version(context.Background())
+	assert.NoError(t, err)
+	<-requests
+}
+
+func TestInitClientsWithProxy(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	proxy := httptest.NewServer(versionHandler(requests))
+	defer proxy.Close()
+
+	v, err := newTestConnection(t, ConnectionConfig{Url: "http://ollama.internal:11434", ProxyURL: proxy.URL}).Version(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "0.6.8", v)
+	assert.Equal(t, "http://ollama.internal:11434/api/version", (<-requests).RequestURI)
+}
+
+func TestInitClientsWithResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	start := time.Now()
+	_, err := newTestConnection(t, ConnectionConfig{Url: srv.URL, ResponseHeaderTimeout: Duration(50 * time.Millisecond)}).Version(context.Background())
+	assert.ErrorContains(t, err, "timeout awaiting response headers")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestResponseHeaderTimeoutFailsOver(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"model":"llama3.2","embeddings":[[0.1]]}`))
+	}))
+	defer ok.Close()
+
+	timeout := Duration(50 * time.Millisecond)
+	cmap, err := initClients(map[ConnectionID]ConnectionConfig{
+		"c1": {Url: hung.URL, ResponseHeaderTimeout: timeout},
+		"c2": {Url: ok.URL, ResponseHeaderTimeout: timeout},
+	})
+	assert.NoError(t, err)
+	r, err := NewRouter(cmap, map[ModelID]ModelConfig{"llama3.2": {ConnectionID: "c1", Connections: []ConnectionID{"c2"}}},
+		WithRetry(RetryConfig{MaxAttempts: 2}),
+		WithCircuitBreaker(CircuitBreakerConfig{FailureRatio: 1, MinRequests: 1}),
+	)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	// whichever connection is picked first, the timeout of c1 is retried on c2
+	for range 2 {
+		res, err := r.Embed(context.Background(), &api.EmbedRequest{Model: "llama3.2"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, [][]float32{{0.1}}, res.Embeddings)
+		}
+	}
+	// and counted as a failure by the circuit breaker of c1
+	assert.Equal(t, breakerOpen, r.cmap["c1"].breaker.State())
+	assert.Equal(t, breakerClosed, r.cmap["c2"].breaker.State())
+}
+
+func TestInitClientsFailsOnInvalidClientSettings(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		cc  ConnectionConfig
+		err string
+	}{
+		{ConnectionConfig{ConnectTimeout: Duration(-time.Second)}, "connection c1: invalid connect timeout: -1s"},
+		{ConnectionConfig{ResponseHeaderTimeout: Duration(-time.Second)}, "connection c1: invalid response header timeout: -1s"},
+		{ConnectionConfig{IdleConnTimeout: Duration(-time.Second)}, "connection c1: invalid idle connection timeout: -1s"},
+		{ConnectionConfig{MaxIdleConns: -1}, "connection c1: invalid max idle connections: -1"},
+		{ConnectionConfig{CertFile: "tls.crt"}, "connection c1: invalid client certificate: both the certificate and the key are required"},
+		{ConnectionConfig{ProxyURL: "proxy:3128"}, "connection c1: invalid proxy url: proxy:3128"},
+		{ConnectionConfig{ProxyURL: "ftp://proxy:3128"}, "connection c1: invalid proxy url scheme: ftp://proxy:3128"},
+		{ConnectionConfig{Headers: map[string]string{"Bad Header": "x"}}, "connection c1: invalid header: Bad Header"},
+		{ConnectionConfig{CAFile: filepath.Join(dir, "ca.crt")}, "connection c1: could not read ca file"},
+		{ConnectionConfig{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}, "connection c1: could not load client certificate"},
+	} {
+		tc.cc.Url = "http://localhost:11434"
+		_, err := initClients(map[ConnectionID]ConnectionConfig{"c1": tc.cc})
+		assert.ErrorContains(t, err, tc.err)
+	}
+}
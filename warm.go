@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultKeepWarmInterval = time.Minute
+
+// warmBackoff is the wait before retrying to load a model, doubled on each failure up to the keep warm interval.
+var warmBackoff = time.Second
+
+// WarmState is the state of a preloaded model on a connection as reported by the health endpoint.
+type WarmState struct {
+	Model               ModelID      `json:"model"`
+	ConnectionID        ConnectionID `json:"connection_id"`
+	KeepWarm            bool         `json:"keep_warm"`
+	Loaded              bool         `json:"loaded"`
+	ExpiresAt           *time.Time   `json:"expires_at,omitempty"`
+	LastLoad            *time.Time   `json:"last_load,omitempty"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	LastError           string       `json:"last_error,omitempty"`
+}
+
+// warmTarget is a model preloaded on one of its connections.
+type warmTarget struct {
+	model    ModelID
+	conn     *connection
+	keepWarm bool
+	// keepAlive is the keep_alive of the requests loading the model, set by the keep alive policy.
+	keepAlive *api.Duration
+	wake      chan struct{}
+
+	mu        sync.Mutex
+	state     WarmState
+	embedding bool // the model does not support generate, it is loaded with an empty embed request
+}
+
+func newWarmTarget(model ModelID, conn *connection, keepWarm bool, keepAlive *api.Duration) *warmTarget {
+	return &warmTarget{
+		model:     model,
+		conn:      conn,
+		keepWarm:  keepWarm,
+		keepAlive: keepAlive,
+		wake:      make(chan struct{}, 1),
+		state: WarmState{
+			Model:        model,
+			ConnectionID: conn.id,
+			KeepWarm:     keepWarm,
+		},
+	}
+}
+
+// wakeUp makes the target check its model straight away, ie: after its connection recovered.
+func (t *warmTarget) wakeUp() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (t *warmTarget) State() WarmState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// warmer loads the preloaded models on their connections at startup and after a connection recovers,
+// the models kept warm are pinged before they expire so that they are never unloaded.
+type warmer struct {
+	targets  []*warmTarget
+	interval time.Duration
+	now      func() time.Time
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func newWarmer(targets []*warmTarget, interval time.Duration) *warmer {
+	return &warmer{
+		targets:  targets,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+func (w *warmer) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	for _, t := range w.targets {
+		w.wg.Add(1)
+		go w.run(ctx, t)
+	}
+}
+
+func (w *warmer) stop() {
+	if w.cancel == nil {
+		return
+	}
+	w.cancel()
+	w.wg.Wait()
+}
+
+func (w *warmer) run(ctx context.Context, t *warmTarget) {
+	defer w.wg.Done()
+	failures := 0
+	for delay := time.Duration(0); ; {
+		if !w.wait(ctx, t, delay) {
+			return
+		}
+		err := w.warm(ctx, t)
+		if ctx.Err() != nil {
+			return
+		}
+		logger := log.WithField("model_id", t.model).WithField("connection_id", t.conn.id)
+		if err != nil {
+			failures++
+			delay = min(warmBackoff<<min(failures-1, 16), w.interval)
+			logger.WithError(err).WithField("failures", failures).WithField("retry_in", delay).Warn("Failed to preload model.")
+			continue
+		}
+		failures = 0
+		delay = w.interval
+		if !t.keepWarm {
+			// preloaded models are only loaded again when their connection recovers
+			delay = -1
+		}
+	}
+}
+
+// wait waits for the delay or for the target to be woken up, a negative delay only waits for the target to be woken up.
+func (w *warmer) wait(ctx context.Context, t *warmTarget, delay time.Duration) bool {
+	var tick <-chan time.Time
+	if delay >= 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		tick = timer.C
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.wake:
+	case <-tick:
+	}
+	return true
+}
+
+// warm loads the model when it is not running on the connection, or pings it when it is about to expire.
+func (w *warmer) warm(ctx context.Context, t *warmTarget) error {
+	ps, err := t.conn.ListRunning(ctx)
+	if err != nil {
+		t.failed(err)
+		return err
+	}
+	expires, loaded := findRunning(ps, t.model)
+	// a model kept warm is pinged when it would expire before the next check or the one after
+	if loaded && (!t.keepWarm || expires.Sub(w.now()) > 2*w.interval) {
+		t.checked(expires, nil)
+		return nil
+	}
+	if err := w.load(ctx, t); err != nil {
+		t.failed(err)
+		return err
+	}
+	now := w.now()
+	t.checked(time.Time{}, &now)
+	log.WithField("model_id", t.model).WithField("connection_id", t.conn.id).WithField("was_loaded", loaded).Debug("Preloaded model.")
+	return nil
+}
+
+// load sends an empty request to the connection which loads the model in memory, or resets its keep alive.
+func (w *warmer) load(ctx context.Context, t *warmTarget) error {
+	t.mu.Lock()
+	embedding := t.embedding
+	t.mu.Unlock()
+	if !embedding {
+		err := t.conn.Generate(ctx, &api.GenerateRequest{Model: t.model.String(), KeepAlive: t.keepAlive}, func(api.GenerateResponse) error { return nil })
+		var se api.StatusError
+		if !errors.As(err, &se) || se.StatusCode != http.StatusBadRequest {
+			return err
+		}
+		// embedding models do not support generate
+		log.WithField("model_id", t.model).WithField("connection_id", t.conn.id).WithError(err).Debug("Preloading model with an embed request.")
+	}
+	if _, err := t.conn.Embed(ctx, &api.EmbedRequest{Model: t.model.String(), KeepAlive: t.keepAlive}); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.embedding = true
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *warmTarget) failed(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.state.Loaded = false
+	t.state.ConsecutiveFailures++
+	t.state.LastError = err.Error()
+}
+
+// checked records that the model is loaded, loadedAt is set when it has just been loaded or pinged.
+func (t *warmTarget) checked(expires time.Time, loadedAt *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.state.Loaded = true
+	t.state.ConsecutiveFailures = 0
+	t.state.LastError = ""
+	if loadedAt != nil {
+		t.state.LastLoad = loadedAt
+	}
+	t.state.ExpiresAt = nil
+	if !expires.IsZero() {
+		t.state.ExpiresAt = &expires
+	}
+}
+
+// findRunning returns the expiry of the model when it is running.
+func findRunning(ps *api.ProcessResponse, model ModelID) (time.Time, bool) {
+	if ps == nil {
+		return time.Time{}, false
+	}
+	key := modelKey(model.String())
+	for _, m := range ps.Models {
+		if modelKey(m.Model) == key {
+			return m.ExpiresAt, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/slawo/gollamas/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestWarmerPreloadsModels(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	loaded := make(chan struct{}, 2)
+	c1.On("ListRunning", mock.Anything).Once().Return(&api.ProcessResponse{}, nil)
+	c1.On("Generate", mock.Anything, &api.GenerateRequest{Model: "llama3.2"}, mock.Anything).Once().Return(nil).Run(func(mock.Arguments) { loaded <- struct{}{} })
+	r, err := NewRouter(map[ConnectionID]IOllamaClient{"c1": c1}, map[ModelID]ModelConfig{"llama3.2": {ConnectionID: "c1", Preload: true}})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	<-loaded
+	assert.Eventually(t, func() bool { return r.Warm()[0].Loaded }, time.Second, time.Millisecond)
+	state := r.Warm()[0]
+	assert.Equal(t, ModelID("llama3.2"), state.Model)
+	assert.Equal(t, ConnectionID("c1"), state.ConnectionID)
+	assert.NotNil(t, state.LastLoad)
+
+	// the model is loaded again once the connection recovers
+	c1.On("ListRunning", mock.Anything).Once().Return(&api.ProcessResponse{}, nil)
+	c1.On("Generate", mock.Anything, &api.GenerateRequest{Model: "llama3.2"}, mock.Anything).Once().Return(nil).Run(func(mock.Arguments) { loaded <- struct{}{} })
+	r.cmap["c1"].recordCheck(errors.New("connection refused"), time.Now(), 1, 1)
+	r.cmap["c1"].recordCheck(nil, time.Now(), 1, 1)
+	<-loaded
+}
+
+func TestWarmerKeepsModelsWarm(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	pinged := make(chan struct{})
+	c1.On("ListRunning", mock.Anything).Once().Return(&api.ProcessResponse{Models: []api.ProcessModelResponse{
+		{Model: "llama3.2:latest", ExpiresAt: time.Now().Add(time.Hour)},
+	}}, nil)
+	c1.On("ListRunning", mock.Anything).Return(&api.ProcessResponse{Models: []api.ProcessModelResponse{
+		{Model: "llama3.2:latest", ExpiresAt: time.Now().Add(time.Millisecond)},
+	}}, nil)
+	c1.On("Generate", mock.Anything, &api.GenerateRequest{Model: "llama3.2"}, mock.Anything).Return(nil).Run(func(mock.Arguments) {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+	})
+	r, err := NewRouter(map[ConnectionID]IOllamaClient{"c1": c1}, map[ModelID]ModelConfig{"llama3.2": {ConnectionID: "c1", KeepWarm: true}},
+		WithKeepWarmInterval(Duration(10*time.Millisecond)))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	// the model expires after the first check, it is pinged on the next one
+	<-pinged
+}
+
+func TestWarmerRetriesWithBackoff(t *testing.T) {
+	defer func(d time.Duration) { warmBackoff = d }(warmBackoff)
+	warmBackoff = time.Millisecond
+	c1 := mocks.NewIOllamaClient(t)
+	loaded := make(chan struct{})
+	c1.On("ListRunning", mock.Anything).Return(&api.ProcessResponse{}, nil)
+	c1.On("Generate", mock.Anything, &api.GenerateRequest{Model: "llama3.2"}, mock.Anything).Twice().Return(api.StatusError{StatusCode: http.StatusInternalServerError, ErrorMessage: "out of memory"})
+	c1.On("Generate", mock.Anything, &api.GenerateRequest{Model: "llama3.2"}, mock.Anything).Once().Return(nil).Run(func(mock.Arguments) { close(loaded) })
+	r, err := NewRouter(map[ConnectionID]IOllamaClient{"c1": c1}, map[ModelID]ModelConfig{"llama3.2": {ConnectionID: "c1", Preload: true}})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	<-loaded
+	assert.Eventually(t, func() bool { return r.Warm()[0].Loaded }, time.Second, time.Millisecond)
+	assert.Equal(t, 0, r.Warm()[0].ConsecutiveFailures)
+	assert.Empty(t, r.Warm()[0].LastError)
+}
+
+func TestWarmerReportsFailures(t *testing.T) {
+	defer func(d time.Duration) { warmBackoff = d }(warmBackoff)
+	warmBackoff = time.Hour
+	c1 := mocks.NewIOllamaClient(t)
+	c1.On("ListRunning", mock.Anything).Once().Return(nil, errors.New("connection refused"))
+	r, err := NewRouter(map[ConnectionID]IOllamaClient{"c1": c1}, map[ModelID]ModelConfig{"llama3.2": {ConnectionID: "c1", Preload: true}})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	assert.Eventually(t, func() bool { return r.Warm()[0].ConsecutiveFailures == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, "connection refused", r.Warm()[0].LastError)
+	assert.False(t, r.Warm()[0].Loaded)
+}
+
+func TestWarmerLoadsEmbeddingModels(t *testing.T) {
+	c1 := mocks.NewIOllamaClient(t)
+	loaded := make(chan struct{})
+	c1.On("ListRunning", mock.Anything).Once().Return(&api.ProcessResponse{}, nil)
+	c1.On("Generate", mock.Anything, &api.GenerateRequest{Model: "nomic-embed-text"}, mock.Anything).Once().Return(api.StatusError{StatusCode: http.StatusBadRequest, ErrorMessage: `"nomic-embed-text" does not support generate`})
+	c1.On("Embed", mock.Anything, &api.EmbedRequest{Model: "nomic-embed-text"}).Once().Return(&api.EmbedResponse{}, nil).Run(func(mock.Arguments) { close(loaded) })
+	r, err := NewRouter(map[ConnectionID]IOllamaClient{"c1": c1}, map[ModelID]ModelConfig{"nomic-embed-text": {ConnectionID: "c1", Preload: true}})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	<-loaded
+}
+
+func TestNewRouterFailsOnPreloadedPattern(t *testing.T) {
+	r, err := NewRouter(map[ConnectionID]IOllamaClient{"c1": mocks.NewIOllamaClient(t)}, map[ModelID]ModelConfig{"llama*": {ConnectionID: "c1", KeepWarm: true}})
+	assert.EqualError(t, err, "model pattern llama* cannot be preloaded")
+	assert.Nil(t, r)
+}